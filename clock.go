@@ -0,0 +1,36 @@
+package aeunit
+
+import (
+	"time"
+)
+
+// Clock is the time of the services of a Context. It starts at the time the context was created and stands
+// still until it is advanced, so that tests of expirations and timeouts don't depend on the wall clock:
+//
+//	memcache.Set(c, &memcache.Item{Key: "k", Value: v, Expiration: time.Minute})
+//	c.Clock().Advance(time.Minute)
+//	_, err := memcache.Get(c, "k") // memcache.ErrCacheMiss
+type Clock struct {
+	now time.Time
+}
+
+// Now returns the current time of the clock
+func (this *Clock) Now() time.Time {
+	return this.now
+}
+
+// Advance moves the clock forward by d
+func (this *Clock) Advance(d time.Duration) {
+	this.now = this.now.Add(d)
+}
+
+// Set sets the current time of the clock
+func (this *Clock) Set(t time.Time) {
+	this.now = t
+}
+
+// Clock returns the clock of the context, which drives memcache expirations and delete locks, task ETAs and
+// datastore transaction timeouts. The latency of datastore faults advances it.
+func (this *Context) Clock() *Clock {
+	return this.clock
+}
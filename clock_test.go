@@ -0,0 +1,47 @@
+package aeunit
+
+import (
+	"appengine/datastore"
+	"appengine/memcache"
+	aedatastore "github.com/siniec/aeunit/datastore"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	c := NewContext(nil)
+	start := c.Clock().Now()
+	time.Sleep(time.Millisecond)
+	if now := c.Clock().Now(); !now.Equal(start) {
+		t.Errorf("Clock moved from %v to %v without being advanced", start, now)
+	}
+
+	err := memcache.Set(c, &memcache.Item{Key: "key", Value: []byte("value"), Expiration: time.Minute})
+	if err != nil {
+		t.Fatalf("Set returned error %v", err)
+	}
+	c.Clock().Advance(59 * time.Second)
+	if _, err = memcache.Get(c, "key"); err != nil {
+		t.Errorf("Get before the expiration returned error %v", err)
+	}
+	c.Clock().Advance(time.Second)
+	if _, err = memcache.Get(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get after the expiration returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+
+	// The latency of datastore faults advances the clock instead of sleeping
+	ds := c.services["datastore_v3"].(*aedatastore.InMemoryDatastore)
+	if err = ds.InjectFault(aedatastore.Fault{Method: "Get", Latency: time.Hour}); err != nil {
+		t.Fatalf("InjectFault returned error %v", err)
+	}
+	before := c.Clock().Now()
+	datastore.Get(c, datastore.NewKey(c, "Kind", "", 1, nil), &struct{}{})
+	if d := c.Clock().Now().Sub(before); d != time.Hour {
+		t.Errorf("Get with latency advanced the clock by %v, want %v", d, time.Hour)
+	}
+
+	c.Clock().Set(start)
+	if now := c.Clock().Now(); !now.Equal(start) {
+		t.Errorf("Clock was at %v after Set, want %v", now, start)
+	}
+}
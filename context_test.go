@@ -0,0 +1,62 @@
+package aeunit
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"errors"
+	"testing"
+)
+
+func TestContextTransactionalTasks(t *testing.T) {
+	c := NewContext(nil)
+	add := func(tc appengine.Context) error {
+		_, err := taskqueue.Add(tc, taskqueue.NewPOSTTask("/work", nil), "")
+		return err
+	}
+
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := add(tc); err != nil {
+			return err
+		}
+		if n := len(c.TaskQueue().Tasks("default")); n != 0 {
+			t.Errorf("Queue had %d tasks before the transaction committed, want 0", n)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("RunInTransaction returned error %v", err)
+	}
+	if n := len(c.TaskQueue().Tasks("default")); n != 1 {
+		t.Errorf("Queue had %d tasks after the transaction committed, want 1", n)
+	}
+
+	rollback := errors.New("rollback")
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := add(tc); err != nil {
+			return err
+		}
+		return rollback
+	}, nil)
+	if err != rollback {
+		t.Fatalf("RunInTransaction returned %v, want %v", err, rollback)
+	}
+	if n := len(c.TaskQueue().Tasks("default")); n != 1 {
+		t.Errorf("Queue had %d tasks after the transaction rolled back, want 1", n)
+	}
+
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		for i := 0; i < 6; i++ {
+			if err := add(tc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	if err == nil {
+		t.Errorf("RunInTransaction that added 6 tasks did not return an error")
+	}
+	if n := len(c.TaskQueue().Tasks("default")); n != 1 {
+		t.Errorf("Queue had %d tasks after a transaction with too many tasks, want 1", n)
+	}
+}
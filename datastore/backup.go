@@ -0,0 +1,269 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ImportBackup puts the entities of a datastore backup file in the datastore. The file must be in the LevelDB log
+// format used by the Datastore Admin backups and managed exports, with one EntityProto per record.
+// If kinds are given, only entities of those kinds are imported. If appID is not empty, the app ID of keys and key
+// values is set to appID, so that entities backed up from production can be read with the app ID used in tests.
+func (this *InMemoryDatastore) ImportBackup(r io.Reader, appID string, kinds ...string) error {
+	lr := newLogReader(r)
+	for {
+		b, err := lr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("aeunit datastore: could not read backup: %v", err)
+		}
+		e := &pb.EntityProto{}
+		if err := proto.Unmarshal(b, e); err != nil {
+			return fmt.Errorf("aeunit datastore: could not read backup: %v", err)
+		}
+		if len(e.GetKey().GetPath().GetElement()) == 0 {
+			return errors.New("aeunit datastore: could not read backup: entity has no key")
+		}
+		if !includesKind(kinds, entityProtoKind(e)) {
+			continue
+		}
+		if appID != "" {
+			setAppID(e, appID)
+		}
+		if err := this.load(e); err != nil {
+			return fmt.Errorf("aeunit datastore: could not read backup: %v", err)
+		}
+	}
+}
+
+// ExportBackup writes the entities in the datastore to w in the same format as read by ImportBackup.
+// If kinds are given, only entities of those kinds are exported.
+func (this *InMemoryDatastore) ExportBackup(w io.Writer, kinds ...string) error {
+	entities := make([]*pb.EntityProto, 0)
+	for _, e := range this.entities.Entities() {
+		if includesKind(kinds, entityProtoKind(e.Obj)) {
+			entities = append(entities, e.Obj)
+		}
+	}
+	lw := newLogWriter(w)
+	for _, e := range entities {
+		b, err := proto.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := lw.Write(b); err != nil {
+			return err
+		}
+	}
+	return lw.Close()
+}
+
+func includesKind(kinds []string, kind string) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// setAppID sets the app ID of the entity's key and of all its key values
+func setAppID(e *pb.EntityProto, appID string) {
+	e.Key.App = &appID
+	for _, props := range [][]*pb.Property{e.Property, e.RawProperty} {
+		for _, p := range props {
+			if ref := p.GetValue().GetReferencevalue(); ref != nil {
+				ref.App = &appID
+			}
+		}
+	}
+}
+
+// The LevelDB log format (https://github.com/google/leveldb/blob/master/doc/log_format.md) splits the file into
+// 32KiB blocks. Each record is stored as one or more fragments that don't cross block boundaries. A fragment has
+// a 7 byte header: the masked CRC-32C of the fragment type and data, the data length, and the fragment type.
+const (
+	logBlockSize  = 32 * 1024
+	logHeaderSize = 7
+
+	logFull   = 1
+	logFirst  = 2
+	logMiddle = 3
+	logLast   = 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func logChecksum(typ byte, data []byte) uint32 {
+	c := crc32.Update(0, crc32c, []byte{typ})
+	c = crc32.Update(c, crc32c, data)
+	return ((c >> 15) | (c << 17)) + 0xa282ead8
+}
+
+type logWriter struct {
+	w      io.Writer
+	offset int // offset in the current block
+}
+
+func newLogWriter(w io.Writer) *logWriter {
+	return &logWriter{w: w}
+}
+
+// Write writes data as one record
+func (this *logWriter) Write(data []byte) error {
+	first := true
+	for {
+		if left := logBlockSize - this.offset; left < logHeaderSize {
+			// Not enough room for a header: pad the rest of the block with zeros
+			if _, err := this.w.Write(make([]byte, left)); err != nil {
+				return err
+			}
+			this.offset = 0
+		}
+		n := logBlockSize - this.offset - logHeaderSize
+		if n > len(data) {
+			n = len(data)
+		}
+		last := n == len(data)
+		var typ byte
+		switch {
+		case first && last:
+			typ = logFull
+		case first:
+			typ = logFirst
+		case last:
+			typ = logLast
+		default:
+			typ = logMiddle
+		}
+		header := make([]byte, logHeaderSize)
+		binary.LittleEndian.PutUint32(header[0:4], logChecksum(typ, data[:n]))
+		binary.LittleEndian.PutUint16(header[4:6], uint16(n))
+		header[6] = typ
+		if _, err := this.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := this.w.Write(data[:n]); err != nil {
+			return err
+		}
+		this.offset += logHeaderSize + n
+		data = data[n:]
+		first = false
+		if last {
+			return nil
+		}
+	}
+}
+
+// Close pads the last block. LevelDB doesn't require it, but the backup files written by App Engine are padded.
+func (this *logWriter) Close() error {
+	if this.offset == 0 {
+		return nil
+	}
+	_, err := this.w.Write(make([]byte, logBlockSize-this.offset))
+	this.offset = 0
+	return err
+}
+
+type logReader struct {
+	r     io.Reader
+	block []byte // the unread part of the current block
+	eof   bool
+}
+
+func newLogReader(r io.Reader) *logReader {
+	return &logReader{r: r}
+}
+
+// Next returns the data of the next record, or io.EOF if there are no more records
+func (this *logReader) Next() ([]byte, error) {
+	var record []byte
+	inRecord := false
+	for {
+		typ, data, err := this.nextFragment()
+		if err == io.EOF && inRecord {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case logFull:
+			if inRecord {
+				return nil, errors.New("leveldb log: unexpected full record in fragmented record")
+			}
+			return data, nil
+		case logFirst:
+			if inRecord {
+				return nil, errors.New("leveldb log: unexpected first fragment in fragmented record")
+			}
+			record = append([]byte{}, data...)
+			inRecord = true
+		case logMiddle, logLast:
+			if !inRecord {
+				return nil, errors.New("leveldb log: fragment without a first fragment")
+			}
+			record = append(record, data...)
+			if typ == logLast {
+				return record, nil
+			}
+		default:
+			return nil, fmt.Errorf("leveldb log: unknown record type %d", typ)
+		}
+	}
+}
+
+func (this *logReader) nextFragment() (byte, []byte, error) {
+	for {
+		if len(this.block) < logHeaderSize {
+			// The rest of the block is padding
+			if err := this.readBlock(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		checksum := binary.LittleEndian.Uint32(this.block[0:4])
+		n := int(binary.LittleEndian.Uint16(this.block[4:6]))
+		typ := this.block[6]
+		if typ == 0 && n == 0 {
+			// Zero length records of type 0 are padding
+			this.block = nil
+			continue
+		}
+		if logHeaderSize+n > len(this.block) {
+			return 0, nil, errors.New("leveldb log: record is longer than its block")
+		}
+		data := this.block[logHeaderSize : logHeaderSize+n]
+		if logChecksum(typ, data) != checksum {
+			return 0, nil, errors.New("leveldb log: checksum mismatch")
+		}
+		this.block = this.block[logHeaderSize+n:]
+		return typ, data, nil
+	}
+}
+
+func (this *logReader) readBlock() error {
+	if this.eof {
+		return io.EOF
+	}
+	block := make([]byte, logBlockSize)
+	n, err := io.ReadFull(this.r, block)
+	if err == io.EOF {
+		return io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		// The last block of a file may be shorter than the block size
+		this.eof = true
+	} else if err != nil {
+		return err
+	}
+	this.block = block[:n]
+	return nil
+}
@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"appengine/datastore"
+	pb "appengine_internal/datastore"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"strings"
+	"testing"
+)
+
+func TestDatastoreBackup(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+
+	type Doc struct {
+		Body  string `datastore:",noindex"`
+		Owner *datastore.Key
+	}
+	owner := datastore.NewKey(c, "Owner", "", 1, nil)
+	// Documents big enough to be split over several blocks of the backup file
+	docKeys := []*datastore.Key{datastore.NewKey(c, "Doc", "", 1, owner), datastore.NewKey(c, "Doc", "", 2, owner)}
+	docs := []Doc{Doc{strings.Repeat("a", 100000), owner}, Doc{"b", owner}}
+	_, err := datastore.PutMulti(c, docKeys, docs)
+	PanicIfErr(err)
+	thingKey := datastore.NewKey(c, "Thing", "", 1, nil)
+	thing1 := thing(1)
+	_, err = datastore.Put(c, thingKey, &thing1)
+	PanicIfErr(err)
+
+	var buf bytes.Buffer
+	if err = ds.ExportBackup(&buf, "Doc"); err != nil {
+		t.Errorf("ExportBackup returned error: %v", err)
+		t.FailNow()
+	}
+	if buf.Len()%logBlockSize != 0 {
+		t.Errorf("Backup was not padded to a whole number of blocks. Length %d", buf.Len())
+	}
+
+	// Import into a datastore for another app
+	c2 := &otherAppContext{testContext{ds: New()}, "s~other"}
+	if err = c2.ds.ImportBackup(bytes.NewReader(buf.Bytes()), c2.FullyQualifiedAppID()); err != nil {
+		t.Errorf("ImportBackup returned error: %v", err)
+		t.FailNow()
+	}
+	otherOwner := datastore.NewKey(c2, "Owner", "", 1, nil)
+	got := make([]Doc, len(docs))
+	if err = datastore.GetMulti(c2, []*datastore.Key{datastore.NewKey(c2, "Doc", "", 1, otherOwner), datastore.NewKey(c2, "Doc", "", 2, otherOwner)}, got); err != nil {
+		t.Errorf("GetMulti returned error: %v", err)
+	} else {
+		for i := range docs {
+			if got[i].Body != docs[i].Body || !got[i].Owner.Equal(otherOwner) {
+				t.Errorf("Imported entity %d was not as expected. Got owner %v, want %v", i, got[i].Owner, otherOwner)
+			}
+		}
+	}
+	if err = datastore.Get(c2, datastore.NewKey(c2, "Thing", "", 1, nil), &Thing{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Entity of kind that was not exported was imported. Get returned %v", err)
+	}
+
+	// Import only some kinds
+	buf.Reset()
+	PanicIfErr(ds.ExportBackup(&buf))
+	ds2 := New()
+	PanicIfErr(ds2.ImportBackup(&buf, "", "Thing"))
+	entities := ds2.entities.Entities()
+	if len(entities) != 1 {
+		t.Errorf("Importing kind Thing imported %d entities, want 1", len(entities))
+	} else if !proto.Equal(entities[0].Obj, ds.entities.Get(entities[0].Key)) {
+		t.Errorf("Imported entity was not the same as the exported entity")
+	}
+
+	// Corrupt files are reported
+	buf.Reset()
+	PanicIfErr(ds.ExportBackup(&buf))
+	b := buf.Bytes()
+	b[logHeaderSize+1]++
+	if err = New().ImportBackup(bytes.NewReader(b), ""); err == nil {
+		t.Errorf("ImportBackup did not return an error for a corrupt file")
+	}
+	if err = New().ImportBackup(bytes.NewReader(b[:logHeaderSize+10]), ""); err == nil {
+		t.Errorf("ImportBackup did not return an error for a truncated file")
+	}
+
+	// Entities that are too big to be put are not imported
+	big := proto.Clone(ds.entities.Get(keyToProto(c.FullyQualifiedAppID(), thingKey))).(*pb.EntityProto)
+	big.RawProperty = append(big.RawProperty, &pb.Property{
+		Name:     proto.String("Body"),
+		Multiple: proto.Bool(false),
+		Value:    &pb.PropertyValue{StringValue: proto.String(strings.Repeat("a", maxEntitySize))},
+	})
+	b, err = proto.Marshal(big)
+	PanicIfErr(err)
+	buf.Reset()
+	lw := newLogWriter(&buf)
+	PanicIfErr(lw.Write(b))
+	PanicIfErr(lw.Close())
+	if err = New().ImportBackup(&buf, ""); err == nil {
+		t.Errorf("ImportBackup did not return an error for an entity that is too big")
+	}
+}
+
+type otherAppContext struct {
+	testContext
+	appID string
+}
+
+func (this *otherAppContext) FullyQualifiedAppID() string { return this.appID }
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"strconv"
+)
+
+// Operations counts the billable operations made on the datastore, following production's rules:
+//
+//   - a read for every entity got, and for every query plus every entity it returns
+//   - a small op for every key returned by a keys-only query, for every result skipped by an offset and for
+//     every call to AllocateIds
+//   - an entity write for every entity put or deleted, and an index write for every index entry that was added
+//     or removed, see writeCost
+//
+// Writes made in a transaction are counted when it is committed.
+type Operations struct {
+	Reads        int64
+	SmallOps     int64
+	EntityWrites int64
+	IndexWrites  int64
+}
+
+// Writes returns the number of entity and index writes
+func (this Operations) Writes() int64 {
+	return this.EntityWrites + this.IndexWrites
+}
+
+// Operations returns the operations made on the datastore since it was created or since ResetOperations
+func (this *InMemoryDatastore) Operations() Operations {
+	return this.ops
+}
+
+// ResetOperations sets the operation counters to zero
+func (this *InMemoryDatastore) ResetOperations() {
+	this.ops = Operations{}
+}
+
+// writeCost returns the cost of replacing the stored entity old by e. Either may be nil, for an entity that is
+// created or deleted. Like in production, a new or deleted entity costs 2 writes, plus 2 for every indexed value
+// (in the ascending and descending built-in indexes) and 1 for every composite index entry. Updating an entity
+// costs 1 write, plus 4 for every changed indexed value (removing the old entries and adding the new ones) and 2
+// for every changed composite index entry.
+func (this *InMemoryDatastore) writeCost(old, e *pb.EntityProto) *pb.Cost {
+	cost := newCost()
+	if old == nil && e == nil {
+		return cost
+	}
+	*cost.EntityWrites = 1
+	if e != nil {
+		*cost.EntityWriteBytes = int32(proto.Size(e))
+	}
+	ref := e
+	if ref == nil {
+		ref = old
+	}
+	kind, dictKey := entityProtoKind(ref), getDictKey(ref.Key)
+	if old == nil || e == nil {
+		// The entry in the index of entities by kind
+		*cost.IndexWrites = 1
+		*cost.IndexWriteBytes = int32(len(dictKey))
+	}
+
+	oldEntries, entries := this.indexEntries(old, kind), this.indexEntries(e, kind)
+	count := func(a, b map[string]int) {
+		for entry, writes := range a {
+			if _, ok := b[entry]; !ok {
+				*cost.IndexWrites += int32(writes)
+				*cost.IndexWriteBytes += int32(writes * (len(entry) + len(dictKey)))
+			}
+		}
+	}
+	count(oldEntries, entries)
+	count(entries, oldEntries)
+	return cost
+}
+
+func newCost() *pb.Cost {
+	return &pb.Cost{
+		EntityWrites:     proto.Int32(0),
+		EntityWriteBytes: proto.Int32(0),
+		IndexWrites:      proto.Int32(0),
+		IndexWriteBytes:  proto.Int32(0),
+	}
+}
+
+// indexEntries returns the index entries of the entity, with the number of index rows each of them is written
+// to: 2 for the built-in indexes, which are kept in ascending and descending order, and 1 for composite indexes
+func (this *InMemoryDatastore) indexEntries(e *pb.EntityProto, kind string) map[string]int {
+	entries := make(map[string]int)
+	if e == nil {
+		return entries
+	}
+	for _, p := range e.Property {
+		entries[p.GetName()+"\x00"+string(encodeValue(nil, p.Value))] = 2
+	}
+	for i, def := range this.entities.composite[kind] {
+		for _, entry := range newCompositeIndex(def).entriesFor(e, "") {
+			entries[strconv.Itoa(i)+"\x01"+string(entry.value)] = 1
+		}
+	}
+	return entries
+}
+
+// addCost adds the cost c to the total, and counts its writes
+func (this *InMemoryDatastore) addCost(total, c *pb.Cost) {
+	*total.EntityWrites += c.GetEntityWrites()
+	*total.EntityWriteBytes += c.GetEntityWriteBytes()
+	*total.IndexWrites += c.GetIndexWrites()
+	*total.IndexWriteBytes += c.GetIndexWriteBytes()
+	this.ops.EntityWrites += int64(c.GetEntityWrites())
+	this.ops.IndexWrites += int64(c.GetIndexWrites())
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"appengine"
+	"appengine/datastore"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"testing"
+)
+
+func TestDatastoreCost(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+	key := keyToProto("dev~aeunit", datastore.NewKey(c, "Thing", "", 1, nil))
+	put := func(i int64, str string) *pb.Cost {
+		e := &pb.EntityProto{
+			Key:         key,
+			EntityGroup: &pb.Path{},
+			Property: []*pb.Property{
+				&pb.Property{Name: proto.String("IntProp"), Value: &pb.PropertyValue{Int64Value: proto.Int64(i)}, Multiple: proto.Bool(false)},
+				&pb.Property{Name: proto.String("StrProp"), Value: &pb.PropertyValue{StringValue: proto.String(str)}, Multiple: proto.Bool(false)},
+			},
+		}
+		res := &pb.PutResponse{}
+		PanicIfErr(ds.PutMulti(&pb.PutRequest{Entity: []*pb.EntityProto{e}}, res))
+		return res.Cost
+	}
+	expectCost := func(name string, cost *pb.Cost, entityWrites, indexWrites int32) {
+		if cost.GetEntityWrites() != entityWrites || cost.GetIndexWrites() != indexWrites {
+			t.Errorf("%s cost %d entity writes and %d index writes, want %d and %d", name, cost.GetEntityWrites(), cost.GetIndexWrites(), entityWrites, indexWrites)
+		}
+	}
+
+	// A new entity with 2 indexed properties: 2 writes plus 2 for every property
+	expectCost("New entity", put(1, "a"), 1, 5)
+	// An update of 1 property: 1 write plus 4 for the changed property
+	expectCost("Update", put(2, "a"), 1, 4)
+	expectCost("Unchanged entity", put(2, "a"), 1, 0)
+	// Plus 2 for the changed composite index entry
+	ds.AddIndex(&pb.Index{
+		EntityType: proto.String("Thing"),
+		Ancestor:   proto.Bool(false),
+		Property: []*pb.Index_Property{
+			&pb.Index_Property{Name: proto.String("IntProp")},
+			&pb.Index_Property{Name: proto.String("StrProp")},
+		},
+	})
+	expectCost("Update with composite index", put(2, "b"), 1, 6)
+
+	res := &pb.DeleteResponse{}
+	PanicIfErr(ds.DeleteMulti(&pb.DeleteRequest{Key: []*pb.Reference{key}}, res))
+	expectCost("Delete", res.Cost, 1, 6)
+	res = &pb.DeleteResponse{}
+	PanicIfErr(ds.DeleteMulti(&pb.DeleteRequest{Key: []*pb.Reference{key}}, res))
+	expectCost("Delete of a missing entity", res.Cost, 0, 0)
+
+	// Cumulative counters
+	ds.ResetOperations()
+	keys := []*datastore.Key{datastore.NewKey(c, "Thing", "", 1, nil), datastore.NewKey(c, "Thing", "", 2, nil)}
+	_, err := datastore.PutMulti(c, keys, []Thing{thing(1), thing(2)})
+	PanicIfErr(err)
+	PanicIfErr(datastore.GetMulti(c, keys, make([]Thing, 2)))
+	_, err = datastore.NewQuery("Thing").GetAll(c, &[]Thing{})
+	PanicIfErr(err)
+	_, err = datastore.NewQuery("Thing").KeysOnly().GetAll(c, nil)
+	PanicIfErr(err)
+	_, err = datastore.NewQuery("Thing").Offset(1).GetAll(c, &[]Thing{})
+	PanicIfErr(err)
+	expect := Operations{Reads: 2 + 3 + 1 + 2, SmallOps: 2 + 1, EntityWrites: 2, IndexWrites: 2 * 10}
+	if ops := ds.Operations(); ops != expect {
+		t.Errorf("Operations were %+v, want %+v", ops, expect)
+	}
+
+	// Writes in a transaction are counted when it is committed
+	ds.ResetOperations()
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := datastore.Delete(tc, keys[0]); err != nil {
+			return err
+		}
+		obj := thing(2)
+		obj.BoolProp = !obj.BoolProp
+		_, err := datastore.Put(tc, keys[1], &obj)
+		return err
+	}, nil)
+	PanicIfErr(err)
+	expect = Operations{EntityWrites: 2, IndexWrites: 10 + 4}
+	if ops := ds.Operations(); ops != expect {
+		t.Errorf("Operations of the transaction were %+v, want %+v", ops, expect)
+	}
+	if n := ds.Operations().Writes(); n != 16 {
+		t.Errorf("Transaction made %d writes, want 16", n)
+	}
+}
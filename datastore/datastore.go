@@ -1,193 +1,357 @@
-package datastore
-
-import (
-	"appengine_internal"
-	pb "appengine_internal/datastore"
-	"fmt"
-)
-
-type entityDictEntity struct {
-	Key *pb.Reference
-	Obj *pb.EntityProto
-}
-
-type entityDict struct {
-	dict          map[string]entityDictEntity
-	isTransaction bool
-}
-
-func newEntityDict(t bool) *entityDict {
-	return &entityDict{
-		dict:          make(map[string]entityDictEntity),
-		isTransaction: t,
-	}
-}
-
-func (this *entityDict) Put(key *pb.Reference, obj *pb.EntityProto) {
-	this.dict[getDictKey(key)] = entityDictEntity{key, obj}
-}
-
-func (this *entityDict) Delete(key *pb.Reference) {
-	k := getDictKey(key)
-	if this.isTransaction {
-		this.dict[k] = entityDictEntity{key, nil}
-	} else {
-		delete(this.dict, k)
-	}
-}
-
-func (this *entityDict) Get(key *pb.Reference) *pb.EntityProto {
-	return this.dict[getDictKey(key)].Obj
-}
-
-func (this *entityDict) Entities() []entityDictEntity {
-	entities := make([]entityDictEntity, 0)
-	for _, e := range this.dict {
-		entities = append(entities, e)
-	}
-	return entities
-}
-
-func getDictKey(key *pb.Reference) string {
-	return key.String()
-}
-
-type InMemoryDatastore struct {
-	entities    *entityDict
-	idCounter   int64
-	thCounter   uint64 // counter for transaction handles
-	transaction *pb.Transaction
-	tEntities   map[uint64]*entityDict
-}
-
-func New() *InMemoryDatastore {
-	return &InMemoryDatastore{
-		entities:  newEntityDict(false),
-		idCounter: int64(1),
-		tEntities: make(map[uint64]*entityDict),
-	}
-}
-
-func (this *InMemoryDatastore) Call(method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
-	switch method {
-	case "Put":
-		req := in.(*pb.PutRequest)
-		res := out.(*pb.PutResponse)
-		return this.PutMulti(req, res)
-	case "Get":
-		req := in.(*pb.GetRequest)
-		res := out.(*pb.GetResponse)
-		return this.GetMulti(req, res)
-	case "Delete":
-		req := in.(*pb.DeleteRequest)
-		res := out.(*pb.DeleteResponse)
-		return this.DeleteMulti(req, res)
-	case "AllocateIds":
-		req := in.(*pb.AllocateIdsRequest)
-		res := out.(*pb.AllocateIdsResponse)
-		return this.AllocateIDs(req, res)
-	case "BeginTransaction":
-		req := in.(*pb.BeginTransactionRequest)
-		t := out.(*pb.Transaction)
-		return this.BeginTransaction(req, t)
-	case "Rollback":
-		t := in.(*pb.Transaction)
-		return this.Rollback(t)
-	case "Commit":
-		t := in.(*pb.Transaction)
-		res := out.(*pb.CommitResponse)
-		return this.Commit(t, res)
-	case "RunQuery":
-		q := in.(*pb.Query)
-		res := out.(*pb.QueryResult)
-		return this.RunQuery(q, res)
-	case "Next":
-		req := in.(*pb.NextRequest)
-		res := out.(*pb.QueryResult)
-		return this.Next(req, res)
-	default:
-		return fmt.Errorf("aeunit datastore: Unknown method %s", method)
-	}
-}
-
-func (this *InMemoryDatastore) Close() error {
-	return nil
-}
-
-func (this *InMemoryDatastore) PutMulti(req *pb.PutRequest, res *pb.PutResponse) error {
-	// TODO (siniec): fix incomplete keys
-	keys := make([]*pb.Reference, len(req.Entity))
-	for i, entity := range req.Entity {
-		keys[i] = entity.Key
-		dict := this.getDict(req.Transaction)
-		dict.Put(entity.Key, entity)
-	}
-	res.Key = keys
-	return nil
-}
-
-func (this *InMemoryDatastore) GetMulti(req *pb.GetRequest, res *pb.GetResponse) error {
-	entities := make([]*pb.GetResponse_Entity, len(req.Key))
-	for i, key := range req.Key {
-		dict := this.getDict(nil) // pass nil: get only reads from the "non transactional" entity store
-		entity := dict.Get(key)
-		entities[i] = &pb.GetResponse_Entity{
-			Entity: entity,
-			Key:    key,
-		}
-	}
-	res.Entity = entities
-	return nil
-}
-
-func (this *InMemoryDatastore) DeleteMulti(req *pb.DeleteRequest, res *pb.DeleteResponse) error {
-	for _, key := range req.Key {
-		dict := this.getDict(req.Transaction)
-		dict.Delete(key)
-	}
-	return nil
-}
-
-func (this *InMemoryDatastore) AllocateIDs(req *pb.AllocateIdsRequest, res *pb.AllocateIdsResponse) error {
-	count := req.GetSize()
-	low := this.idCounter
-	this.idCounter += count
-	high := this.idCounter - 1 // datastore expects the returned range to be inclusive in both ends
-	res.Start = &low
-	res.End = &high
-	return nil
-}
-
-func (this *InMemoryDatastore) BeginTransaction(req *pb.BeginTransactionRequest, t *pb.Transaction) error {
-	handle := this.thCounter
-	t.Handle = &handle
-	this.thCounter += 1
-	this.tEntities[handle] = newEntityDict(true)
-	return nil
-}
-
-func (this *InMemoryDatastore) Rollback(t *pb.Transaction) error {
-	delete(this.tEntities, t.GetHandle())
-	return nil
-}
-
-func (this *InMemoryDatastore) Commit(t *pb.Transaction, res *pb.CommitResponse) error {
-	dict := this.getDict(t)
-	for _, entity := range dict.Entities() {
-		if entity.Obj != nil {
-			this.entities.Put(entity.Key, entity.Obj)
-		} else {
-			this.entities.Delete(entity.Key)
-		}
-	}
-	return nil
-}
-
-// getDict returns the entityDict for either the given transaction or the default dict
-func (this *InMemoryDatastore) getDict(t *pb.Transaction) *entityDict {
-	if t == nil {
-		return this.entities
-	} else {
-		return this.tEntities[t.GetHandle()]
-	}
-}
+package datastore
+
+import (
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+type entityDictEntity struct {
+	Key *pb.Reference
+	Obj *pb.EntityProto
+}
+
+type entityDict struct {
+	dict          map[string]entityDictEntity
+	isTransaction bool
+	began         time.Time // when the transaction began
+}
+
+func newEntityDict(t bool) *entityDict {
+	return &entityDict{
+		dict:          make(map[string]entityDictEntity),
+		isTransaction: t,
+	}
+}
+
+func (this *entityDict) Put(key *pb.Reference, obj *pb.EntityProto) {
+	this.dict[getDictKey(key)] = entityDictEntity{key, obj}
+}
+
+func (this *entityDict) Delete(key *pb.Reference) {
+	k := getDictKey(key)
+	if this.isTransaction {
+		this.dict[k] = entityDictEntity{key, nil}
+	} else {
+		delete(this.dict, k)
+	}
+}
+
+func (this *entityDict) Get(key *pb.Reference) *pb.EntityProto {
+	return this.dict[getDictKey(key)].Obj
+}
+
+// Entities returns the entities ordered by namespace and key
+func (this *entityDict) Entities() []entityDictEntity {
+	keys := make([]string, 0, len(this.dict))
+	for k := range this.dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entities := make([]entityDictEntity, len(keys))
+	for i, k := range keys {
+		entities[i] = this.dict[k]
+	}
+	return entities
+}
+
+// getDictKey returns the canonical encoding of the key, see encodeKey
+func getDictKey(key *pb.Reference) string {
+	return string(encodeKey(key))
+}
+
+type InMemoryDatastore struct {
+	entities       *entityStore
+	idCounter      int64
+	thCounter      uint64 // counter for transaction handles
+	transaction    *pb.Transaction
+	tEntities      map[uint64]*entityDict      // transactions in progress
+	tFinished      map[uint64]transactionState // transactions that were committed, rolled back or expired
+	tFinishedOrder []finishedTransaction       // the finished transactions, in the order they finished
+	tTimeout       time.Duration               // after which transactions expire
+	tEnd           func(handle uint64, committed bool)
+	now            func() time.Time
+	sleep          func(time.Duration) // waits for the latency of faults
+	faults         []*faultHook
+	rand           *rand.Rand // decides whether faults with a probability are injected
+	ops            Operations // billable operations, see Operations
+	path           string     // file the datastore is saved to on Close, if any
+	appID          string     // app of the keys that are accepted, any app if empty
+}
+
+func New() *InMemoryDatastore {
+	return &InMemoryDatastore{
+		entities:  newEntityStore(),
+		idCounter: int64(1),
+		tEntities: make(map[uint64]*entityDict),
+		tFinished: make(map[uint64]transactionState),
+		tTimeout:  DefaultTransactionTimeout,
+		now:       time.Now,
+		sleep:     time.Sleep,
+		rand:      rand.New(rand.NewSource(1)),
+	}
+}
+
+func (this *InMemoryDatastore) Call(method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if err := this.injectFault(method, in, opts); err != nil {
+		// A commit that fails ends the transaction, like in production
+		if t, ok := in.(*pb.Transaction); ok && method == "Commit" {
+			if _, active := this.tEntities[t.GetHandle()]; active {
+				this.finishTransaction(t.GetHandle(), transactionRolledBack)
+			}
+		}
+		return err
+	}
+	switch method {
+	case "Put":
+		req := in.(*pb.PutRequest)
+		res := out.(*pb.PutResponse)
+		return this.PutMulti(req, res)
+	case "Get":
+		req := in.(*pb.GetRequest)
+		res := out.(*pb.GetResponse)
+		return this.GetMulti(req, res)
+	case "Delete":
+		req := in.(*pb.DeleteRequest)
+		res := out.(*pb.DeleteResponse)
+		return this.DeleteMulti(req, res)
+	case "AllocateIds":
+		req := in.(*pb.AllocateIdsRequest)
+		res := out.(*pb.AllocateIdsResponse)
+		return this.AllocateIDs(req, res)
+	case "BeginTransaction":
+		req := in.(*pb.BeginTransactionRequest)
+		t := out.(*pb.Transaction)
+		return this.BeginTransaction(req, t)
+	case "Rollback":
+		t := in.(*pb.Transaction)
+		return this.Rollback(t)
+	case "Commit":
+		t := in.(*pb.Transaction)
+		res := out.(*pb.CommitResponse)
+		return this.Commit(t, res)
+	case "RunQuery":
+		q := in.(*pb.Query)
+		res := out.(*pb.QueryResult)
+		return this.RunQuery(q, res)
+	case "Next":
+		req := in.(*pb.NextRequest)
+		res := out.(*pb.QueryResult)
+		return this.Next(req, res)
+	default:
+		return fmt.Errorf("aeunit datastore: Unknown method %s", method)
+	}
+}
+
+// Close saves the datastore to its file, if it was created with NewFile
+func (this *InMemoryDatastore) Close() error {
+	if this.path == "" {
+		return nil
+	}
+	return this.save(this.path)
+}
+
+func (this *InMemoryDatastore) PutMulti(req *pb.PutRequest, res *pb.PutResponse) error {
+	keys := make([]*pb.Reference, len(req.Entity))
+	for i, entity := range req.Entity {
+		keys[i] = entity.Key
+	}
+	if err := this.checkPutRequest(req, keys); err != nil {
+		return err
+	}
+	dict, err := this.getDict(req.Transaction)
+	if err != nil {
+		return err
+	}
+	cost := newCost()
+	for i, entity := range req.Entity {
+		entity = cloneEntity(entity)
+		if el := entity.Key.Path.Element[len(entity.Key.Path.Element)-1]; el.GetId() == 0 && el.GetName() == "" {
+			// The key is incomplete: allocate an ID, like AllocateIDs does
+			id := this.idCounter
+			this.idCounter++
+			el.Id = &id
+		}
+		keys[i] = proto.Clone(entity.Key).(*pb.Reference)
+		if req.Transaction == nil {
+			this.addCost(cost, this.writeCost(dict.Get(entity.Key), entity))
+		}
+		dict.Put(entity.Key, entity)
+	}
+	res.Key = keys
+	res.Cost = cost
+	return nil
+}
+
+func (this *InMemoryDatastore) GetMulti(req *pb.GetRequest, res *pb.GetResponse) error {
+	if err := this.checkGetRequest(req); err != nil {
+		return err
+	}
+	if _, err := this.getDict(req.Transaction); err != nil {
+		return err
+	}
+	this.ops.Reads += int64(len(req.Key))
+	entities := make([]*pb.GetResponse_Entity, len(req.Key))
+	for i, key := range req.Key {
+		dict, _ := this.getDict(nil) // pass nil: get only reads from the "non transactional" entity store
+		entity := cloneEntity(dict.Get(key))
+		entities[i] = &pb.GetResponse_Entity{
+			Entity: entity,
+			Key:    key,
+		}
+	}
+	res.Entity = entities
+	return nil
+}
+
+func (this *InMemoryDatastore) DeleteMulti(req *pb.DeleteRequest, res *pb.DeleteResponse) error {
+	if err := this.checkDeleteRequest(req); err != nil {
+		return err
+	}
+	dict, err := this.getDict(req.Transaction)
+	if err != nil {
+		return err
+	}
+	cost := newCost()
+	for _, key := range req.Key {
+		if req.Transaction == nil {
+			this.addCost(cost, this.writeCost(dict.Get(key), nil))
+		}
+		dict.Delete(key)
+	}
+	res.Cost = cost
+	return nil
+}
+
+func (this *InMemoryDatastore) AllocateIDs(req *pb.AllocateIdsRequest, res *pb.AllocateIdsResponse) error {
+	count := req.GetSize()
+	low := this.idCounter
+	this.idCounter += count
+	high := this.idCounter - 1 // datastore expects the returned range to be inclusive in both ends
+	res.Start = &low
+	res.End = &high
+	this.ops.SmallOps++
+	return nil
+}
+
+func (this *InMemoryDatastore) BeginTransaction(req *pb.BeginTransactionRequest, t *pb.Transaction) error {
+	this.expireTransactions()
+	handle := this.thCounter
+	t.Handle = &handle
+	this.thCounter += 1
+	dict := newEntityDict(true)
+	dict.began = this.now()
+	this.tEntities[handle] = dict
+	return nil
+}
+
+func (this *InMemoryDatastore) Rollback(t *pb.Transaction) error {
+	if _, err := this.getDict(t); err != nil {
+		return err
+	}
+	this.finishTransaction(t.GetHandle(), transactionRolledBack)
+	return nil
+}
+
+func (this *InMemoryDatastore) Commit(t *pb.Transaction, res *pb.CommitResponse) error {
+	dict, err := this.getDict(t)
+	if err != nil {
+		return err
+	}
+	cost := newCost()
+	var puts, deletes int32
+	for _, entity := range dict.Entities() {
+		this.addCost(cost, this.writeCost(this.entities.Get(entity.Key), entity.Obj))
+		if entity.Obj != nil {
+			this.entities.Put(entity.Key, entity.Obj)
+			puts++
+		} else {
+			this.entities.Delete(entity.Key)
+			deletes++
+		}
+	}
+	cost.Commitcost = &pb.Cost_CommitCost{RequestedEntityPuts: &puts, RequestedEntityDeletes: &deletes}
+	res.Cost = cost
+	this.finishTransaction(t.GetHandle(), transactionCommitted)
+	return nil
+}
+
+// load puts an entity that was created outside of the datastore, such as one read from a file. Like a put, it
+// returns an error if the entity's key is invalid or the entity exceeds the limits of the datastore, so that only
+// entities that can be saved again are loaded. IDs allocated afterwards will not collide with the int IDs in the
+// entity's key.
+func (this *InMemoryDatastore) load(e *pb.EntityProto) error {
+	appID := e.GetKey().GetApp() // entities of any app can be loaded
+	if err := this.checkKey(e.GetKey(), &appID, false); err != nil {
+		return err
+	}
+	if err := this.checkEntity(e); err != nil {
+		return err
+	}
+	this.entities.Put(e.Key, e)
+	for _, el := range e.Key.Path.Element {
+		if el.GetId() >= this.idCounter {
+			this.idCounter = el.GetId() + 1
+		}
+	}
+	return nil
+}
+
+// Snapshot is the state of an InMemoryDatastore at a point in time
+type Snapshot struct {
+	entities  *entityStore
+	idCounter int64
+}
+
+// Snapshot takes a snapshot of the entities (in all namespaces) and the ID counter of the datastore.
+// Taking a snapshot is cheap: the entities are only copied the next time the datastore is written to.
+// Changes made in uncommitted transactions are not part of the snapshot.
+func (this *InMemoryDatastore) Snapshot() *Snapshot {
+	return &Snapshot{
+		entities:  this.entities.share(),
+		idCounter: this.idCounter,
+	}
+}
+
+// Restore sets the state of the datastore to that of the snapshot. A snapshot can be restored any number of times.
+// Transactions that are in progress are discarded.
+func (this *InMemoryDatastore) Restore(s *Snapshot) {
+	this.entities = s.entities.share()
+	this.idCounter = s.idCounter
+	for handle := range this.tEntities {
+		this.finishTransaction(handle, transactionRolledBack)
+	}
+}
+
+// AddIndex adds a composite index, like the ones defined in index.yaml. Queries that filter on several properties,
+// or that filter and sort on different properties, are served from a matching composite index if there is one.
+// Without one, they are served from the built-in index of a single property and the other filters are applied
+// to its entries.
+func (this *InMemoryDatastore) AddIndex(def *pb.Index) {
+	this.entities.AddIndex(def)
+}
+
+// cloneEntity returns a deep copy of the entity. Entities are copied when they are put and when they are read, so
+// that changes made by the caller to its protos don't change the stored entities, like with the real RPCs.
+func cloneEntity(e *pb.EntityProto) *pb.EntityProto {
+	if e == nil {
+		return nil
+	}
+	return proto.Clone(e).(*pb.EntityProto)
+}
+
+// getDict returns the entityDict for either the given transaction or the default store
+func (this *InMemoryDatastore) getDict(t *pb.Transaction) (entityMap, error) {
+	if t == nil {
+		return this.entities, nil
+	}
+	dict, err := this.activeTransaction(t.GetHandle())
+	if err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
@@ -1,532 +1,837 @@
-package datastore
-
-import (
-	"appengine"
-	"appengine/datastore"
-	"appengine_internal"
-	pb "appengine_internal/base"
-	"errors"
-	"fmt"
-	"reflect"
-	"strconv"
-	"testing"
-)
-
-type Thing struct {
-	IntProp  int
-	StrProp  string
-	BoolProp bool
-	DblProp  float64
-}
-
-func (this Thing) String() string {
-	s := ""
-	switch {
-	case this.IntProp != 0:
-		s += fmt.Sprintf("IntProp: %d. ", this.IntProp)
-	case this.StrProp != "":
-		s += fmt.Sprintf("StrProp: %s. ", this.StrProp)
-	case this.DblProp != 0.0:
-		s += fmt.Sprintf("DblProp: %v. ", this.DblProp)
-	}
-	s += fmt.Sprintf("BoolProp: %v", this.BoolProp)
-	return s
-}
-
-func thing(seq int) Thing {
-	return Thing{
-		IntProp:  seq,
-		StrProp:  "Thing" + strconv.Itoa(seq),
-		BoolProp: seq%2 == 0,
-		DblProp:  float64(seq) + 0.5,
-	}
-}
-
-func newContext() appengine.Context {
-	return &testContext{
-		ds: New(),
-	}
-}
-
-func TestDatastorePutGet(t *testing.T) {
-	c := newContext()
-	key1 := datastore.NewKey(c, "Kind1", "", 1, nil)
-	key2 := datastore.NewKey(c, "Kind2", "", 1, nil)
-	key3 := datastore.NewKey(c, "Kind3", "name", 0, nil)
-
-	type T struct {
-		Name         string
-		PutKeys      []*datastore.Key
-		Puts         []Thing
-		PutErr       error
-		GetKeys      []*datastore.Key
-		Gets         []Thing
-		GetErr       error
-		ExpectedGets []Thing
-	}
-	tests := []T{
-		T{"Empty key slice", []*datastore.Key{}, []Thing{}, nil, []*datastore.Key{}, []Thing{}, nil, nil},
-		T{
-			"Multiple kinds, string/int IDs",
-			[]*datastore.Key{key1, key2, key3},
-			[]Thing{thing(1), thing(2), thing(3)},
-			nil,
-			nil, // same as put keys
-			[]Thing{Thing{}, Thing{}, Thing{}},
-			nil,
-			nil, // expect the same as what we put
-		},
-		T{
-			"NoSuchEntity",
-			[]*datastore.Key{key1},
-			[]Thing{thing(1)},
-			nil,
-			[]*datastore.Key{key1, key2},
-			[]Thing{Thing{}, Thing{}},
-			appengine.MultiError{nil, datastore.ErrNoSuchEntity},
-			[]Thing{thing(1), Thing{}},
-		},
-		T{
-			"Same key properties, different parent",
-			[]*datastore.Key{datastore.NewKey(c, "Kind1", "", 1, key1), datastore.NewKey(c, "Kind1", "", 1, key2)},
-			[]Thing{thing(1), thing(2)},
-			nil,
-			nil, // same as put keys
-			[]Thing{Thing{}, Thing{}},
-			nil,
-			[]Thing{thing(1), thing(2)},
-		},
-	}
-
-	for i, test := range tests {
-		ctx := newContext()
-
-		keys, err := datastore.PutMulti(ctx, test.PutKeys, test.Puts)
-		if test.PutErr != nil {
-			if !reflect.DeepEqual(test.PutErr, err) {
-				t.Errorf("Test %d, %s: Expected put error. Got %v", i, test.Name, err)
-				continue
-			}
-		} else {
-			if err != nil {
-				t.Errorf("Test %d, %s: Put returned error: %v", i, test.Name, err)
-				continue
-			}
-		}
-
-		for i, key := range keys {
-			if !key.Equal(test.PutKeys[i]) {
-				t.Errorf("Test %d, %s: Put returned wrong key at index %d. Expected %v, was %v", i, test.Name, test.PutKeys[i], key)
-			}
-		}
-
-		getKeys := test.GetKeys
-		if getKeys == nil {
-			getKeys = test.PutKeys
-		}
-		err = datastore.GetMulti(ctx, getKeys, test.Gets)
-		if test.GetErr != nil {
-			if !reflect.DeepEqual(test.GetErr, err) {
-				t.Errorf("Test %d, %s: Expected get error. Got %v", i, test.Name, err)
-				continue
-			}
-		} else {
-			if err != nil {
-				t.Errorf("Test %d, %s: Get returned error: %v", i, test.Name, err)
-				continue
-			}
-		}
-
-		expectedGets := test.ExpectedGets
-		if expectedGets == nil {
-			expectedGets = test.Puts
-		}
-
-		if len(expectedGets) != len(test.Gets) {
-			t.Errorf("Test %d, %s: Wrong number of objects returned. Expected %d. Got %d", i, test.Name, len(test.ExpectedGets), len(test.Gets))
-		} else {
-			for j := range test.ExpectedGets {
-				if !reflect.DeepEqual(test.ExpectedGets[j], test.Gets[j]) {
-					t.Errorf("Test %d, %s: Object on index %d was not as expected", i, test.Name, j)
-				}
-			}
-		}
-	}
-}
-
-func TestDatastoreDelete(t *testing.T) {
-	c := newContext()
-
-	key1 := datastore.NewKey(c, "Kind1", "", 1, nil)
-	key2 := datastore.NewKey(c, "Kind2", "", 1, nil)
-	key3 := datastore.NewKey(c, "Kind3", "name", 0, nil)
-
-	thing1 := thing(1)
-	thing2 := thing(2)
-	thing3 := thing(3)
-
-	var err error
-	_, err = datastore.Put(c, key1, &thing1)
-	PanicIfErr(err)
-	_, err = datastore.Put(c, key2, &thing2)
-	PanicIfErr(err)
-	_, err = datastore.Put(c, key3, &thing3)
-	PanicIfErr(err)
-
-	// Delete one entity
-	err = datastore.Delete(c, key2)
-	if err != nil {
-		t.Errorf("Error returned when deleting entity: %v", err)
-		t.FailNow()
-	}
-
-	// Check that it is gone
-	err = datastore.Get(c, key2, &Thing{})
-	if err != datastore.ErrNoSuchEntity {
-		t.Errorf("Expected ErrNoSuchEntity after deleting entity. Was %v", err)
-	}
-
-	// Delete again, should return no error, even though the entity doesn't exist anymore
-	err = datastore.Delete(c, key2)
-	if err != nil {
-		t.Errorf("Error returned when deleting entity not in datastore: %v", err)
-		t.FailNow()
-	}
-
-	// Ensure that the two other objects are still present and unchanged
-	var obj Thing
-
-	obj = Thing{}
-	if err = datastore.Get(c, key1, &obj); err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			t.Errorf("datastore.Delete deleted more entities than we wanted")
-		} else {
-			t.Errorf("Error when getting entity: %v", err)
-		}
-		t.FailNow()
-	} else {
-		if !reflect.DeepEqual(obj, thing1) {
-			t.Errorf("datastore.Delete changed an unrelated entity")
-		}
-	}
-
-	obj = Thing{}
-	if err = datastore.Get(c, key3, &obj); err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			t.Errorf("datastore.Delete deleted more entities than we wanted")
-		} else {
-			t.Errorf("Error when getting entity: %v", err)
-		}
-		t.FailNow()
-	} else {
-		if !reflect.DeepEqual(obj, thing3) {
-			t.Errorf("datastore.Delete changed an unrelated entity")
-		}
-	}
-}
-
-func TestDatastoreAllocateIDs(t *testing.T) {
-	// AllocatedIDs should start at 1 and increment the IDs sequentially,
-	// regardless of Kind or Parent
-
-	c := newContext()
-
-	low, high, err := datastore.AllocateIDs(c, "Kind", nil, 5)
-	if err != nil {
-		t.Errorf("Error returned :%v", err)
-	}
-	if low != 1 {
-		t.Errorf("Expected low to be %d. Was %d", 1, low)
-	}
-	if high != 6 {
-		t.Errorf("Expected high to be %d. Was %d", 6, high)
-	}
-
-	low, high, err = datastore.AllocateIDs(c, "Kind2", nil, 10)
-	if err != nil {
-		t.Errorf("Error returned :%v", err)
-	}
-	if low != 6 {
-		t.Errorf("Expected low to be %d. Was %d", 6, low)
-	}
-	if high != 16 {
-		t.Errorf("Expected high to be %d. Was %d", 16, high)
-	}
-}
-
-func TestDatastoreTransactionRevert(t *testing.T) {
-
-	var c appengine.Context
-	var err error
-	var o Thing
-	var obj Thing
-
-	c = newContext()
-	key := datastore.NewKey(c, "Kind", "", 1, nil)
-
-	// Rollback: put is reverted
-	c = newContext()
-	obj = thing(1)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if _, err := datastore.Put(c, key, &obj); err != nil {
-			t.Errorf("Put returned error: %v", err)
-		}
-		return errors.New("Test error")
-	}, nil)
-	err = datastore.Get(c, key, &obj)
-	if err != datastore.ErrNoSuchEntity {
-		if err == nil {
-			t.Errorf("Put was not reverted. Object was saved even though transaction was rolled back")
-		} else {
-			t.Errorf("Unexpected error returned for get after put: %v", err)
-		}
-	}
-
-	// Rollback: delete is reverted
-	c = newContext()
-	obj = thing(1)
-	_, err = datastore.Put(c, key, &obj)
-	PanicIfErr(err)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if err := datastore.Delete(c, key); err != nil {
-			t.Errorf("Delete returned error: %v", err)
-		}
-		return errors.New("Test error")
-	}, nil)
-	o = Thing{}
-	err = datastore.Get(c, key, &o)
-	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			t.Errorf("Delete was not reverted. Object was deleted even though transaction was rolled back")
-		} else {
-			t.Errorf("Unexpected error returned for get after delete: %v", err)
-		}
-	} else {
-		if !reflect.DeepEqual(o, obj) {
-			t.Errorf("Delete was rolled back, but the object was changed in datastore")
-		}
-	}
-}
-
-func TestDatastoreTransactionCommit(t *testing.T) {
-	var c appengine.Context
-	var err error
-	var o Thing
-	var obj Thing
-
-	c = newContext()
-	key := datastore.NewKey(c, "Kind", "", 1, nil)
-
-	// Commit: put is applied
-	c = newContext()
-	obj = thing(1)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if _, err := datastore.Put(c, key, &obj); err != nil {
-			t.Errorf("Put returned error: %v", err)
-		}
-		return nil
-	}, nil)
-	o = Thing{}
-	err = datastore.Get(c, key, &o)
-	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			t.Errorf("Put was not applied. Object was not saved")
-		} else {
-			t.Errorf("Unexpected error returned for get after put: %v", err)
-		}
-	} else {
-		if !reflect.DeepEqual(o, obj) {
-			t.Errorf("Put was applied, but, but the object saved was not as expected")
-		}
-	}
-
-	// Commit: delete is applied
-	c = newContext()
-	obj = thing(1)
-	_, err = datastore.Put(c, key, &obj)
-	PanicIfErr(err)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if err := datastore.Delete(c, key); err != nil {
-			t.Errorf("Delete returned error: %v", err)
-		}
-		return nil
-	}, nil)
-	err = datastore.Get(c, key, &obj)
-	if err != datastore.ErrNoSuchEntity {
-		if err == nil {
-			t.Errorf("Delete was not applied. Object was not deleted")
-		} else {
-			t.Errorf("Unexpected error returned for get after delete: %v", err)
-		}
-	}
-
-	// Commit: delete after put on same key results in deletion of key
-	c = newContext()
-	obj = thing(1)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if _, err := datastore.Put(c, key, &obj); err != nil {
-			t.Errorf("Put returned error: %v", err)
-		}
-		if err := datastore.Delete(c, key); err != nil {
-			t.Errorf("Delete returned error: %v", err)
-		}
-		return nil
-	}, nil)
-	err = datastore.Get(c, key, &obj)
-	if err != datastore.ErrNoSuchEntity {
-		if err == nil {
-			t.Errorf("Delete was not applied after put. Object was not deleted")
-		} else {
-			t.Errorf("Unexpected error returned for get after delete: %v", err)
-		}
-	}
-
-	// Commit: put after delete on same key results in updated entity for that key
-	c = newContext()
-	obj = thing(1)
-	_, err = datastore.Put(c, key, &obj)
-	PanicIfErr(err)
-	override := thing(2)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if err := datastore.Delete(c, key); err != nil {
-			t.Errorf("Delete returned error: %v", err)
-		}
-
-		if _, err := datastore.Put(c, key, &override); err != nil {
-			t.Errorf("Put returned error: %v", err)
-		}
-		return nil
-	}, nil)
-	o = Thing{}
-	err = datastore.Get(c, key, &o)
-	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			t.Errorf("Put was not applied. Object was deleted instead of being overwritten")
-		} else {
-			t.Errorf("Unexpected error returned for get after put: %v", err)
-		}
-	} else {
-		if !reflect.DeepEqual(o, override) {
-			if reflect.DeepEqual(o, obj) {
-				t.Errorf("Neither Delete nor Put was applied. Object is as before transaction finished")
-			} else {
-				t.Errorf("Updated object not as expected")
-			}
-		}
-	}
-}
-
-//"isolation"
-func TestDatastoreTransactionIsolation(t *testing.T) {
-	var c appengine.Context
-	var err error
-	var obj Thing
-
-	c = newContext()
-	key := datastore.NewKey(c, "Kind", "", 1, nil)
-
-	// In transaction: entity put inside transaction is not returned by get inside transaction
-	c = newContext()
-	obj = thing(1)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if _, err := datastore.Put(c, key, &obj); err != nil {
-			t.Errorf("Put returned error: %v", err)
-		}
-		err := datastore.Get(c, key, &obj)
-		if err != datastore.ErrNoSuchEntity {
-			if err == nil {
-				t.Errorf("Get after Put inside transaction returned the entity that was put")
-			} else {
-				t.Errorf("Unexpected error returned for get: %v", err)
-			}
-		}
-		return nil
-	}, nil)
-
-	// In transaction: entity deleted inside transaction is still gettable inside transaction
-	c = newContext()
-	obj = thing(1)
-	_, err = datastore.Put(c, key, &obj)
-	PanicIfErr(err)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		if err := datastore.Delete(c, key); err != nil {
-			t.Errorf("Delete returned error: %v", err)
-		}
-		o := Thing{}
-		err := datastore.Get(c, key, &o)
-		if err != nil {
-			if err == datastore.ErrNoSuchEntity {
-				t.Errorf("Get after Delete inside transaction did not return the entity that was deleted")
-			} else {
-				t.Errorf("Unexpected error returned for get: %v", err)
-			}
-		} else {
-			if !reflect.DeepEqual(o, obj) {
-				t.Errorf("Get after Delete inside transaction returned object, but it was not as expected")
-			}
-		}
-		return nil
-	}, nil)
-
-	// In transaction: getting entity updated inside transaction returns the old version of the entity
-	c = newContext()
-	obj = thing(1)
-	_, err = datastore.Put(c, key, &obj)
-	PanicIfErr(err)
-	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
-		o := thing(2)
-		if _, err := datastore.Put(c, key, &o); err != nil {
-			t.Errorf("Put returned error: %v", err)
-		}
-		o2 := Thing{}
-		err := datastore.Get(c, key, &o2)
-		if err != nil {
-			t.Errorf("Unexpected error returned for get: %v", err)
-		} else {
-			if !reflect.DeepEqual(o2, obj) {
-				if reflect.DeepEqual(o2, o) {
-					t.Errorf("Get of entity already put inside transaction returned the updated entity. Should return the old")
-				} else {
-					t.Errorf("Get of entity already put inside transaction returned unexpected entity")
-				}
-			}
-		}
-		return nil
-	}, nil)
-}
-
-type testContext struct {
-	ds *InMemoryDatastore
-}
-
-func (this *testContext) Debugf(s string, v ...interface{}) {
-	fmt.Printf(s, v...)
-	fmt.Println()
-}
-func (this *testContext) Infof(s string, v ...interface{})     { this.Debugf(s, v...) }
-func (this *testContext) Warningf(s string, v ...interface{})  { this.Debugf(s, v...) }
-func (this *testContext) Errorf(s string, v ...interface{})    { this.Debugf(s, v...) }
-func (this *testContext) Criticalf(s string, v ...interface{}) { this.Debugf(s, v...) }
-func (this *testContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
-	switch {
-	case service == "__go__":
-		if method == "GetNamespace" || method == "GetDefaultNamespace" {
-			s := ""
-			outStr := out.(*pb.StringProto)
-			outStr.Value = &s
-		}
-		return nil
-	case service == "datastore_v3":
-		return this.ds.Call(method, in, out, opts)
-	default:
-		return fmt.Errorf("Unknown service: %s", service)
-	}
-}
-func (this *testContext) FullyQualifiedAppID() string { return "dev~aeunit" }
-func (this *testContext) Request() interface{}        { panic("Request() is not implemented") }
-
-func PanicIfErr(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
+package datastore
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine_internal"
+	pb "appengine_internal/base"
+	dspb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type Thing struct {
+	IntProp  int
+	StrProp  string
+	BoolProp bool
+	DblProp  float64
+}
+
+func (this Thing) String() string {
+	s := ""
+	switch {
+	case this.IntProp != 0:
+		s += fmt.Sprintf("IntProp: %d. ", this.IntProp)
+	case this.StrProp != "":
+		s += fmt.Sprintf("StrProp: %s. ", this.StrProp)
+	case this.DblProp != 0.0:
+		s += fmt.Sprintf("DblProp: %v. ", this.DblProp)
+	}
+	s += fmt.Sprintf("BoolProp: %v", this.BoolProp)
+	return s
+}
+
+func thing(seq int) Thing {
+	return Thing{
+		IntProp:  seq,
+		StrProp:  "Thing" + strconv.Itoa(seq),
+		BoolProp: seq%2 == 0,
+		DblProp:  float64(seq) + 0.5,
+	}
+}
+
+func newContext() appengine.Context {
+	return &testContext{
+		ds: New(),
+	}
+}
+
+func TestDatastorePutGet(t *testing.T) {
+	c := newContext()
+	key1 := datastore.NewKey(c, "Kind1", "", 1, nil)
+	key2 := datastore.NewKey(c, "Kind2", "", 1, nil)
+	key3 := datastore.NewKey(c, "Kind3", "name", 0, nil)
+
+	type T struct {
+		Name         string
+		PutKeys      []*datastore.Key
+		Puts         []Thing
+		PutErr       error
+		GetKeys      []*datastore.Key
+		Gets         []Thing
+		GetErr       error
+		ExpectedGets []Thing
+	}
+	tests := []T{
+		T{"Empty key slice", []*datastore.Key{}, []Thing{}, nil, []*datastore.Key{}, []Thing{}, nil, nil},
+		T{
+			"Multiple kinds, string/int IDs",
+			[]*datastore.Key{key1, key2, key3},
+			[]Thing{thing(1), thing(2), thing(3)},
+			nil,
+			nil, // same as put keys
+			[]Thing{Thing{}, Thing{}, Thing{}},
+			nil,
+			nil, // expect the same as what we put
+		},
+		T{
+			"NoSuchEntity",
+			[]*datastore.Key{key1},
+			[]Thing{thing(1)},
+			nil,
+			[]*datastore.Key{key1, key2},
+			[]Thing{Thing{}, Thing{}},
+			appengine.MultiError{nil, datastore.ErrNoSuchEntity},
+			[]Thing{thing(1), Thing{}},
+		},
+		T{
+			"Same key properties, different parent",
+			[]*datastore.Key{datastore.NewKey(c, "Kind1", "", 1, key1), datastore.NewKey(c, "Kind1", "", 1, key2)},
+			[]Thing{thing(1), thing(2)},
+			nil,
+			nil, // same as put keys
+			[]Thing{Thing{}, Thing{}},
+			nil,
+			[]Thing{thing(1), thing(2)},
+		},
+	}
+
+	for i, test := range tests {
+		ctx := newContext()
+
+		keys, err := datastore.PutMulti(ctx, test.PutKeys, test.Puts)
+		if test.PutErr != nil {
+			if !reflect.DeepEqual(test.PutErr, err) {
+				t.Errorf("Test %d, %s: Expected put error. Got %v", i, test.Name, err)
+				continue
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Test %d, %s: Put returned error: %v", i, test.Name, err)
+				continue
+			}
+		}
+
+		for i, key := range keys {
+			if !key.Equal(test.PutKeys[i]) {
+				t.Errorf("Test %d, %s: Put returned wrong key at index %d. Expected %v, was %v", i, test.Name, test.PutKeys[i], key)
+			}
+		}
+
+		getKeys := test.GetKeys
+		if getKeys == nil {
+			getKeys = test.PutKeys
+		}
+		err = datastore.GetMulti(ctx, getKeys, test.Gets)
+		if test.GetErr != nil {
+			if !reflect.DeepEqual(test.GetErr, err) {
+				t.Errorf("Test %d, %s: Expected get error. Got %v", i, test.Name, err)
+				continue
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Test %d, %s: Get returned error: %v", i, test.Name, err)
+				continue
+			}
+		}
+
+		expectedGets := test.ExpectedGets
+		if expectedGets == nil {
+			expectedGets = test.Puts
+		}
+
+		if len(expectedGets) != len(test.Gets) {
+			t.Errorf("Test %d, %s: Wrong number of objects returned. Expected %d. Got %d", i, test.Name, len(test.ExpectedGets), len(test.Gets))
+		} else {
+			for j := range test.ExpectedGets {
+				if !reflect.DeepEqual(test.ExpectedGets[j], test.Gets[j]) {
+					t.Errorf("Test %d, %s: Object on index %d was not as expected", i, test.Name, j)
+				}
+			}
+		}
+	}
+}
+
+func TestDatastoreDelete(t *testing.T) {
+	c := newContext()
+
+	key1 := datastore.NewKey(c, "Kind1", "", 1, nil)
+	key2 := datastore.NewKey(c, "Kind2", "", 1, nil)
+	key3 := datastore.NewKey(c, "Kind3", "name", 0, nil)
+
+	thing1 := thing(1)
+	thing2 := thing(2)
+	thing3 := thing(3)
+
+	var err error
+	_, err = datastore.Put(c, key1, &thing1)
+	PanicIfErr(err)
+	_, err = datastore.Put(c, key2, &thing2)
+	PanicIfErr(err)
+	_, err = datastore.Put(c, key3, &thing3)
+	PanicIfErr(err)
+
+	// Delete one entity
+	err = datastore.Delete(c, key2)
+	if err != nil {
+		t.Errorf("Error returned when deleting entity: %v", err)
+		t.FailNow()
+	}
+
+	// Check that it is gone
+	err = datastore.Get(c, key2, &Thing{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Errorf("Expected ErrNoSuchEntity after deleting entity. Was %v", err)
+	}
+
+	// Delete again, should return no error, even though the entity doesn't exist anymore
+	err = datastore.Delete(c, key2)
+	if err != nil {
+		t.Errorf("Error returned when deleting entity not in datastore: %v", err)
+		t.FailNow()
+	}
+
+	// Ensure that the two other objects are still present and unchanged
+	var obj Thing
+
+	obj = Thing{}
+	if err = datastore.Get(c, key1, &obj); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			t.Errorf("datastore.Delete deleted more entities than we wanted")
+		} else {
+			t.Errorf("Error when getting entity: %v", err)
+		}
+		t.FailNow()
+	} else {
+		if !reflect.DeepEqual(obj, thing1) {
+			t.Errorf("datastore.Delete changed an unrelated entity")
+		}
+	}
+
+	obj = Thing{}
+	if err = datastore.Get(c, key3, &obj); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			t.Errorf("datastore.Delete deleted more entities than we wanted")
+		} else {
+			t.Errorf("Error when getting entity: %v", err)
+		}
+		t.FailNow()
+	} else {
+		if !reflect.DeepEqual(obj, thing3) {
+			t.Errorf("datastore.Delete changed an unrelated entity")
+		}
+	}
+}
+
+func TestDatastorePutIncompleteKey(t *testing.T) {
+	c := newContext()
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+
+	thing1 := thing(1)
+	thing2 := thing(2)
+	key1, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Kind", nil), &thing1)
+	PanicIfErr(err)
+	key2, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Kind", parent), &thing2)
+	PanicIfErr(err)
+
+	if key1.Incomplete() || key2.Incomplete() {
+		t.Errorf("Put returned incomplete keys %v and %v", key1, key2)
+		t.FailNow()
+	}
+	if key1.IntID() == key2.IntID() {
+		t.Errorf("Put returned the same ID %d for two incomplete keys", key1.IntID())
+	}
+	if !key2.Parent().Equal(parent) {
+		t.Errorf("Put returned key %v, want a child of %v", key2, parent)
+	}
+	for key, want := range map[*datastore.Key]Thing{key1: thing1, key2: thing2} {
+		var obj Thing
+		if err = datastore.Get(c, key, &obj); err != nil {
+			t.Errorf("Get of %v returned error: %v", key, err)
+		} else if !reflect.DeepEqual(obj, want) {
+			t.Errorf("Get of %v returned %v, want %v", key, obj, want)
+		}
+	}
+
+	// IDs allocated afterwards don't collide with the assigned IDs
+	low, _, err := datastore.AllocateIDs(c, "Kind", nil, 1)
+	PanicIfErr(err)
+	if low == key1.IntID() || low == key2.IntID() {
+		t.Errorf("AllocateIDs returned ID %d, which was assigned by Put", low)
+	}
+}
+
+func TestDatastoreAllocateIDs(t *testing.T) {
+	// AllocatedIDs should start at 1 and increment the IDs sequentially,
+	// regardless of Kind or Parent
+
+	c := newContext()
+
+	low, high, err := datastore.AllocateIDs(c, "Kind", nil, 5)
+	if err != nil {
+		t.Errorf("Error returned :%v", err)
+	}
+	if low != 1 {
+		t.Errorf("Expected low to be %d. Was %d", 1, low)
+	}
+	if high != 6 {
+		t.Errorf("Expected high to be %d. Was %d", 6, high)
+	}
+
+	low, high, err = datastore.AllocateIDs(c, "Kind2", nil, 10)
+	if err != nil {
+		t.Errorf("Error returned :%v", err)
+	}
+	if low != 6 {
+		t.Errorf("Expected low to be %d. Was %d", 6, low)
+	}
+	if high != 16 {
+		t.Errorf("Expected high to be %d. Was %d", 16, high)
+	}
+}
+
+func TestDatastoreTransactionRevert(t *testing.T) {
+
+	var c appengine.Context
+	var err error
+	var o Thing
+	var obj Thing
+
+	c = newContext()
+	key := datastore.NewKey(c, "Kind", "", 1, nil)
+
+	// Rollback: put is reverted
+	c = newContext()
+	obj = thing(1)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, key, &obj); err != nil {
+			t.Errorf("Put returned error: %v", err)
+		}
+		return errors.New("Test error")
+	}, nil)
+	err = datastore.Get(c, key, &obj)
+	if err != datastore.ErrNoSuchEntity {
+		if err == nil {
+			t.Errorf("Put was not reverted. Object was saved even though transaction was rolled back")
+		} else {
+			t.Errorf("Unexpected error returned for get after put: %v", err)
+		}
+	}
+
+	// Rollback: delete is reverted
+	c = newContext()
+	obj = thing(1)
+	_, err = datastore.Put(c, key, &obj)
+	PanicIfErr(err)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Delete(c, key); err != nil {
+			t.Errorf("Delete returned error: %v", err)
+		}
+		return errors.New("Test error")
+	}, nil)
+	o = Thing{}
+	err = datastore.Get(c, key, &o)
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			t.Errorf("Delete was not reverted. Object was deleted even though transaction was rolled back")
+		} else {
+			t.Errorf("Unexpected error returned for get after delete: %v", err)
+		}
+	} else {
+		if !reflect.DeepEqual(o, obj) {
+			t.Errorf("Delete was rolled back, but the object was changed in datastore")
+		}
+	}
+}
+
+func TestDatastoreTransactionCommit(t *testing.T) {
+	var c appengine.Context
+	var err error
+	var o Thing
+	var obj Thing
+
+	c = newContext()
+	key := datastore.NewKey(c, "Kind", "", 1, nil)
+
+	// Commit: put is applied
+	c = newContext()
+	obj = thing(1)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, key, &obj); err != nil {
+			t.Errorf("Put returned error: %v", err)
+		}
+		return nil
+	}, nil)
+	o = Thing{}
+	err = datastore.Get(c, key, &o)
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			t.Errorf("Put was not applied. Object was not saved")
+		} else {
+			t.Errorf("Unexpected error returned for get after put: %v", err)
+		}
+	} else {
+		if !reflect.DeepEqual(o, obj) {
+			t.Errorf("Put was applied, but, but the object saved was not as expected")
+		}
+	}
+
+	// Commit: delete is applied
+	c = newContext()
+	obj = thing(1)
+	_, err = datastore.Put(c, key, &obj)
+	PanicIfErr(err)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Delete(c, key); err != nil {
+			t.Errorf("Delete returned error: %v", err)
+		}
+		return nil
+	}, nil)
+	err = datastore.Get(c, key, &obj)
+	if err != datastore.ErrNoSuchEntity {
+		if err == nil {
+			t.Errorf("Delete was not applied. Object was not deleted")
+		} else {
+			t.Errorf("Unexpected error returned for get after delete: %v", err)
+		}
+	}
+
+	// Commit: delete after put on same key results in deletion of key
+	c = newContext()
+	obj = thing(1)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, key, &obj); err != nil {
+			t.Errorf("Put returned error: %v", err)
+		}
+		if err := datastore.Delete(c, key); err != nil {
+			t.Errorf("Delete returned error: %v", err)
+		}
+		return nil
+	}, nil)
+	err = datastore.Get(c, key, &obj)
+	if err != datastore.ErrNoSuchEntity {
+		if err == nil {
+			t.Errorf("Delete was not applied after put. Object was not deleted")
+		} else {
+			t.Errorf("Unexpected error returned for get after delete: %v", err)
+		}
+	}
+
+	// Commit: put after delete on same key results in updated entity for that key
+	c = newContext()
+	obj = thing(1)
+	_, err = datastore.Put(c, key, &obj)
+	PanicIfErr(err)
+	override := thing(2)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Delete(c, key); err != nil {
+			t.Errorf("Delete returned error: %v", err)
+		}
+
+		if _, err := datastore.Put(c, key, &override); err != nil {
+			t.Errorf("Put returned error: %v", err)
+		}
+		return nil
+	}, nil)
+	o = Thing{}
+	err = datastore.Get(c, key, &o)
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			t.Errorf("Put was not applied. Object was deleted instead of being overwritten")
+		} else {
+			t.Errorf("Unexpected error returned for get after put: %v", err)
+		}
+	} else {
+		if !reflect.DeepEqual(o, override) {
+			if reflect.DeepEqual(o, obj) {
+				t.Errorf("Neither Delete nor Put was applied. Object is as before transaction finished")
+			} else {
+				t.Errorf("Updated object not as expected")
+			}
+		}
+	}
+}
+
+//"isolation"
+func TestDatastoreTransactionIsolation(t *testing.T) {
+	var c appengine.Context
+	var err error
+	var obj Thing
+
+	c = newContext()
+	key := datastore.NewKey(c, "Kind", "", 1, nil)
+
+	// In transaction: entity put inside transaction is not returned by get inside transaction
+	c = newContext()
+	obj = thing(1)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if _, err := datastore.Put(c, key, &obj); err != nil {
+			t.Errorf("Put returned error: %v", err)
+		}
+		err := datastore.Get(c, key, &obj)
+		if err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				t.Errorf("Get after Put inside transaction returned the entity that was put")
+			} else {
+				t.Errorf("Unexpected error returned for get: %v", err)
+			}
+		}
+		return nil
+	}, nil)
+
+	// In transaction: entity deleted inside transaction is still gettable inside transaction
+	c = newContext()
+	obj = thing(1)
+	_, err = datastore.Put(c, key, &obj)
+	PanicIfErr(err)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		if err := datastore.Delete(c, key); err != nil {
+			t.Errorf("Delete returned error: %v", err)
+		}
+		o := Thing{}
+		err := datastore.Get(c, key, &o)
+		if err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				t.Errorf("Get after Delete inside transaction did not return the entity that was deleted")
+			} else {
+				t.Errorf("Unexpected error returned for get: %v", err)
+			}
+		} else {
+			if !reflect.DeepEqual(o, obj) {
+				t.Errorf("Get after Delete inside transaction returned object, but it was not as expected")
+			}
+		}
+		return nil
+	}, nil)
+
+	// In transaction: getting entity updated inside transaction returns the old version of the entity
+	c = newContext()
+	obj = thing(1)
+	_, err = datastore.Put(c, key, &obj)
+	PanicIfErr(err)
+	err = datastore.RunInTransaction(c, func(c appengine.Context) error {
+		o := thing(2)
+		if _, err := datastore.Put(c, key, &o); err != nil {
+			t.Errorf("Put returned error: %v", err)
+		}
+		o2 := Thing{}
+		err := datastore.Get(c, key, &o2)
+		if err != nil {
+			t.Errorf("Unexpected error returned for get: %v", err)
+		} else {
+			if !reflect.DeepEqual(o2, obj) {
+				if reflect.DeepEqual(o2, o) {
+					t.Errorf("Get of entity already put inside transaction returned the updated entity. Should return the old")
+				} else {
+					t.Errorf("Get of entity already put inside transaction returned unexpected entity")
+				}
+			}
+		}
+		return nil
+	}, nil)
+}
+
+func TestDatastoreSnapshotRestore(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+
+	key1 := datastore.NewKey(c, "Kind", "", 1, nil)
+	key2 := datastore.NewKey(c, "Kind", "", 2, nil)
+	thing1 := thing(1)
+	thing2 := thing(2)
+	_, err := datastore.Put(c, key1, &thing1)
+	PanicIfErr(err)
+	_, _, err = datastore.AllocateIDs(c, "Kind", nil, 5)
+	PanicIfErr(err)
+
+	snapshot := ds.Snapshot()
+
+	for i := 0; i < 2; i++ {
+		// Change the state of the datastore after the snapshot was taken
+		override := thing(3)
+		_, err = datastore.Put(c, key1, &override)
+		PanicIfErr(err)
+		_, err = datastore.Put(c, key2, &thing2)
+		PanicIfErr(err)
+		_, _, err = datastore.AllocateIDs(c, "Kind", nil, 5)
+		PanicIfErr(err)
+
+		ds.Restore(snapshot)
+
+		obj := Thing{}
+		if err = datastore.Get(c, key1, &obj); err != nil {
+			t.Errorf("Restore %d: Get returned error: %v", i, err)
+		} else if !reflect.DeepEqual(obj, thing1) {
+			t.Errorf("Restore %d: Entity was not restored. Got %v, want %v", i, obj, thing1)
+		}
+		if err = datastore.Get(c, key2, &obj); err != datastore.ErrNoSuchEntity {
+			t.Errorf("Restore %d: Entity put after the snapshot was taken was not removed. Get returned %v", i, err)
+		}
+		low, _, err := datastore.AllocateIDs(c, "Kind", nil, 1)
+		PanicIfErr(err)
+		if low != 6 {
+			t.Errorf("Restore %d: ID counter was not restored. AllocateIDs returned %d, want %d", i, low, 6)
+		}
+	}
+
+	// Indexes added after a snapshot was restored don't change the indexes of other snapshots
+	index := func(name string) *dspb.Index {
+		return &dspb.Index{
+			EntityType: proto.String("Indexed"),
+			Ancestor:   proto.Bool(false),
+			Property:   []*dspb.Index_Property{&dspb.Index_Property{Name: proto.String(name)}},
+		}
+	}
+	for _, name := range []string{"P1", "P2", "P3"} {
+		ds.AddIndex(index(name))
+	}
+	three := ds.Snapshot()
+	ds.AddIndex(index("P4"))
+	four := ds.Snapshot()
+	ds.Restore(three)
+	ds.AddIndex(index("P5"))
+	ds.Restore(four)
+	defs := ds.entities.composite["Indexed"]
+	if len(defs) != 4 || defs[3].GetProperty()[0].GetName() != "P4" {
+		t.Errorf("Indexes of a snapshot were changed by an index added after restoring another snapshot: %v", defs)
+	}
+
+	// Changes made in a transaction that is in progress are not part of the snapshot
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if _, err := datastore.Put(tc, key2, &thing2); err != nil {
+			return err
+		}
+		snapshot = ds.Snapshot()
+		return nil
+	}, nil)
+	PanicIfErr(err)
+	ds.Restore(snapshot)
+	if err = datastore.Get(c, key2, &Thing{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Snapshot taken during a transaction contained the transaction's changes. Get returned %v", err)
+	}
+}
+
+func TestDatastoreUnknownTransaction(t *testing.T) {
+	ds := New()
+	tx := &dspb.Transaction{App: proto.String("dev~aeunit"), Handle: proto.Uint64(42)}
+	key := keyToProto("dev~aeunit", datastore.NewKey(newContext(), "Kind", "", 1, nil))
+	calls := map[string]func() error{
+		"Put": func() error {
+			return ds.PutMulti(&dspb.PutRequest{Entity: []*dspb.EntityProto{&dspb.EntityProto{Key: key}}, Transaction: tx}, &dspb.PutResponse{})
+		},
+		"Get": func() error {
+			return ds.GetMulti(&dspb.GetRequest{Key: []*dspb.Reference{key}, Transaction: tx}, &dspb.GetResponse{})
+		},
+		"Delete": func() error {
+			return ds.DeleteMulti(&dspb.DeleteRequest{Key: []*dspb.Reference{key}, Transaction: tx}, &dspb.DeleteResponse{})
+		},
+		"Commit":   func() error { return ds.Commit(tx, &dspb.CommitResponse{}) },
+		"Rollback": func() error { return ds.Rollback(tx) },
+	}
+	for method, call := range calls {
+		err := call()
+		if apiErr, ok := err.(*appengine_internal.APIError); !ok || apiErr.Code != int32(dspb.Error_BAD_REQUEST) {
+			t.Errorf("%s with unknown transaction returned %v, want a BAD_REQUEST error", method, err)
+		}
+	}
+}
+
+func TestDatastoreTransactionLifecycle(t *testing.T) {
+	ds := New()
+	key := keyToProto("dev~aeunit", datastore.NewKey(newContext(), "Kind", "", 1, nil))
+	begin := func() *dspb.Transaction {
+		tx := &dspb.Transaction{}
+		PanicIfErr(ds.BeginTransaction(&dspb.BeginTransactionRequest{}, tx))
+		return tx
+	}
+	put := func(tx *dspb.Transaction) error {
+		return ds.PutMulti(&dspb.PutRequest{Entity: []*dspb.EntityProto{&dspb.EntityProto{Key: key}}, Transaction: tx}, &dspb.PutResponse{})
+	}
+	isBadRequest := func(err error) bool {
+		apiErr, ok := err.(*appengine_internal.APIError)
+		return ok && apiErr.Code == int32(dspb.Error_BAD_REQUEST)
+	}
+
+	// Committed transactions are cleaned up and can't be used again
+	tx := begin()
+	PanicIfErr(put(tx))
+	PanicIfErr(ds.Commit(tx, &dspb.CommitResponse{}))
+	if n := len(ds.tEntities); n != 0 {
+		t.Errorf("%d transactions were in progress after commit, want 0", n)
+	}
+	if err := put(tx); !isBadRequest(err) {
+		t.Errorf("Put in committed transaction returned %v, want a BAD_REQUEST error", err)
+	}
+	if err := ds.Commit(tx, &dspb.CommitResponse{}); !isBadRequest(err) {
+		t.Errorf("Second commit returned %v, want a BAD_REQUEST error", err)
+	}
+	if err := ds.Rollback(tx); !isBadRequest(err) {
+		t.Errorf("Rollback of committed transaction returned %v, want a BAD_REQUEST error", err)
+	}
+
+	// Rolled back transactions can't be used again
+	tx = begin()
+	PanicIfErr(ds.Rollback(tx))
+	if err := ds.Commit(tx, &dspb.CommitResponse{}); !isBadRequest(err) {
+		t.Errorf("Commit of rolled back transaction returned %v, want a BAD_REQUEST error", err)
+	}
+
+	// Transactions expire after the timeout
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	ds.SetClock(func() time.Time { return now })
+	ds.SetTransactionTimeout(10 * time.Second)
+	tx = begin()
+	now = now.Add(9 * time.Second)
+	PanicIfErr(put(tx))
+	now = now.Add(time.Second)
+	if err := ds.Commit(tx, &dspb.CommitResponse{}); !isBadRequest(err) {
+		t.Errorf("Commit of expired transaction returned %v, want a BAD_REQUEST error", err)
+	}
+	if n := len(ds.tEntities); n != 0 {
+		t.Errorf("%d transactions were in progress after the transaction expired, want 0", n)
+	}
+
+	// Transactions that are never used again expire when another transaction begins
+	var ended []uint64
+	ds.OnTransactionEnd(func(handle uint64, committed bool) {
+		if !committed {
+			ended = append(ended, handle)
+		}
+	})
+	tx = begin()
+	now = now.Add(10 * time.Second)
+	PanicIfErr(ds.Rollback(begin()))
+	if len(ended) != 2 || ended[0] != tx.GetHandle() {
+		t.Errorf("Transactions %v ended after beginning a transaction, want the abandoned transaction %d first", ended, tx.GetHandle())
+	}
+	ds.OnTransactionEnd(nil)
+
+	// Without a timeout, transactions don't expire
+	ds.SetTransactionTimeout(0)
+	tx = begin()
+	now = now.Add(time.Hour)
+	PanicIfErr(ds.Commit(tx, &dspb.CommitResponse{}))
+
+	// The states of finished transactions are forgotten after a while
+	now = now.Add(finishedTransactionRetention + time.Second)
+	PanicIfErr(ds.Rollback(begin()))
+	if n := len(ds.tFinished); n != 1 {
+		t.Errorf("%d finished transactions were kept, want 1", n)
+	}
+	if err := ds.Commit(tx, &dspb.CommitResponse{}); !isBadRequest(err) {
+		t.Errorf("Commit of forgotten transaction returned %v, want a BAD_REQUEST error", err)
+	}
+}
+
+func TestDatastoreEntitiesOrder(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+
+	parent := datastore.NewKey(c, "Parent", "", 2, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Parent", "b", 0, nil),
+		datastore.NewKey(c, "Child", "", 1, parent),
+		datastore.NewKey(c, "Parent", "", 10, nil),
+		parent,
+		datastore.NewKey(c, "Child", "a", 0, nil),
+	}
+	// Keys in the order they are stored in
+	want := []*datastore.Key{keys[4], keys[3], keys[1], keys[2], keys[0]}
+	_, err := datastore.PutMulti(c, keys, make([]Thing, len(keys)))
+	PanicIfErr(err)
+
+	for i := 0; i < 3; i++ {
+		entities := ds.entities.Entities()
+		if len(entities) != len(want) {
+			t.Fatalf("Entities returned %d entities, want %d", len(entities), len(want))
+		}
+		for j, e := range entities {
+			if compareProtoRef(e.Key, keyToProto("", want[j])) != 0 {
+				t.Errorf("Entities returned %v at index %d, want %v", e.Key, j, want[j])
+			}
+		}
+	}
+}
+
+func TestDatastoreIsolation(t *testing.T) {
+	ds := New()
+	entity := &dspb.EntityProto{
+		Key: keyToProto("dev~aeunit", datastore.NewKey(newContext(), "Kind", "", 1, nil)),
+		Property: []*dspb.Property{
+			&dspb.Property{
+				Name:     proto.String("Prop"),
+				Value:    &dspb.PropertyValue{StringValue: proto.String("stored")},
+				Multiple: proto.Bool(false),
+			},
+		},
+	}
+	value := func(e *dspb.EntityProto) string {
+		return e.GetProperty()[0].GetValue().GetStringValue()
+	}
+	get := func() *dspb.EntityProto {
+		res := &dspb.GetResponse{}
+		PanicIfErr(ds.GetMulti(&dspb.GetRequest{Key: []*dspb.Reference{entity.Key}}, res))
+		return res.Entity[0].Entity
+	}
+	PanicIfErr(ds.PutMulti(&dspb.PutRequest{Entity: []*dspb.EntityProto{entity}}, &dspb.PutResponse{}))
+
+	// Changing the put entity
+	entity.Property[0].Value.StringValue = proto.String("changed after put")
+	if v := value(get()); v != "stored" {
+		t.Errorf("Changing the put entity changed the stored entity. Got %q, want %q", v, "stored")
+	}
+
+	// Changing an entity that was read
+	got := get()
+	got.Property[0].Value.StringValue = proto.String("changed after get")
+	if v := value(get()); v != "stored" {
+		t.Errorf("Changing the entity returned by Get changed the stored entity. Got %q, want %q", v, "stored")
+	}
+	res := &dspb.QueryResult{}
+	PanicIfErr(ds.RunQuery(&dspb.Query{App: proto.String("dev~aeunit"), Kind: proto.String("Kind")}, res))
+	res.Result[0].Property[0].Value.StringValue = proto.String("changed after query")
+	if v := value(get()); v != "stored" {
+		t.Errorf("Changing the entity returned by RunQuery changed the stored entity. Got %q, want %q", v, "stored")
+	}
+}
+
+type testContext struct {
+	ds *InMemoryDatastore
+}
+
+func (this *testContext) Debugf(s string, v ...interface{}) {
+	fmt.Printf(s, v...)
+	fmt.Println()
+}
+func (this *testContext) Infof(s string, v ...interface{})     { this.Debugf(s, v...) }
+func (this *testContext) Warningf(s string, v ...interface{})  { this.Debugf(s, v...) }
+func (this *testContext) Errorf(s string, v ...interface{})    { this.Debugf(s, v...) }
+func (this *testContext) Criticalf(s string, v ...interface{}) { this.Debugf(s, v...) }
+func (this *testContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	switch {
+	case service == "__go__":
+		if method == "GetNamespace" || method == "GetDefaultNamespace" {
+			s := ""
+			outStr := out.(*pb.StringProto)
+			outStr.Value = &s
+		}
+		return nil
+	case service == "datastore_v3":
+		return this.ds.Call(method, in, out, opts)
+	default:
+		return fmt.Errorf("Unknown service: %s", service)
+	}
+}
+func (this *testContext) FullyQualifiedAppID() string { return "dev~aeunit" }
+func (this *testContext) Request() interface{}        { panic("Request() is not implemented") }
+
+func PanicIfErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Errors returned by the production datastore, for use in faults
+var (
+	ErrTimeout               error = apiError(pb.Error_TIMEOUT, "The datastore operation timed out, or the data was temporarily unavailable.")
+	ErrConcurrentTransaction error = apiError(pb.Error_CONCURRENT_TRANSACTION, "too much contention on these datastore entities. please try again.")
+	ErrInternal              error = apiError(pb.Error_INTERNAL_ERROR, "internal error.")
+	ErrOverQuota             error = &appengine_internal.CallError{Detail: "The API call required more quota than is available.", Code: 4}
+)
+
+// apiError returns an application error of the datastore service, like the ones returned by production
+func apiError(code pb.Error_ErrorCode, format string, v ...interface{}) error {
+	return &appengine_internal.APIError{
+		Service: "datastore_v3",
+		Detail:  fmt.Sprintf(format, v...),
+		Code:    int32(code),
+	}
+}
+
+// Fault describes an error and/or latency to inject into the datastore calls it matches
+type Fault struct {
+	Method string // datastore method, such as "Get", "Put" or "Commit". All methods if empty.
+	Kind   string // only calls on entities, keys or queries of the kind, if not empty
+	Key    string // only calls on the key, encoded with datastore.Key.Encode, if not empty
+
+	Nth         int     // only the Nth (starting at 1) matching call, if not 0
+	Probability float64 // the probability of injecting the fault into a matching call. Always if 0.
+
+	Err     error         // returned instead of making the call. Nil to only add latency.
+	Latency time.Duration // added to the call. A call fails with a timeout if the latency exceeds its deadline.
+}
+
+type faultHook struct {
+	Fault
+	key   string // dict key of Key
+	calls int    // number of matching calls so far
+}
+
+// InjectFault adds a fault to the datastore. Faults are checked in the order they were added, and the first one
+// that injects an error into a call wins. Calls with faults don't change the datastore.
+func (this *InMemoryDatastore) InjectFault(f Fault) error {
+	hook := &faultHook{Fault: f}
+	if f.Key != "" {
+		key, err := decodeKey(f.Key)
+		if err != nil {
+			return err
+		}
+		hook.key = getDictKey(key)
+	}
+	this.faults = append(this.faults, hook)
+	return nil
+}
+
+// ClearFaults removes all faults from the datastore
+func (this *InMemoryDatastore) ClearFaults() {
+	this.faults = nil
+}
+
+// SetFaultSeed seeds the random numbers that decide whether faults with a probability are injected. The seed
+// is 1 by default, so that tests are repeatable.
+func (this *InMemoryDatastore) SetFaultSeed(seed int64) {
+	this.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetSleep sets the function that waits for the latency of faults. The default is time.Sleep, so latency is real
+// time. NewContext sets it to advance the clock of the context instead, so tests don't wait.
+func (this *InMemoryDatastore) SetSleep(sleep func(time.Duration)) {
+	this.sleep = sleep
+}
+
+// injectFault adds the latency of the faults matching the call, and returns the error of the first one with
+// an error
+func (this *InMemoryDatastore) injectFault(method string, in appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if len(this.faults) == 0 {
+		return nil
+	}
+	keys, kind := this.callKeys(in)
+	var latency time.Duration
+	var err error
+	for _, f := range this.faults {
+		if !f.matches(method, keys, kind) {
+			continue
+		}
+		f.calls++
+		if f.Nth != 0 && f.calls != f.Nth {
+			continue
+		}
+		if f.Probability != 0 && this.rand.Float64() >= f.Probability {
+			continue
+		}
+		latency += f.Latency
+		if f.Err != nil {
+			err = f.Err
+			break
+		}
+	}
+	if latency > 0 {
+		if opts != nil && opts.Timeout > 0 && latency >= opts.Timeout {
+			this.sleep(opts.Timeout)
+			return &appengine_internal.CallError{Detail: "Deadline exceeded", Code: 12, Timeout: true}
+		}
+		this.sleep(latency)
+	}
+	return err
+}
+
+func (this *faultHook) matches(method string, keys []*pb.Reference, kind string) bool {
+	if this.Method != "" && this.Method != method {
+		return false
+	}
+	if this.Kind != "" {
+		ok := kind == this.Kind
+		for _, key := range keys {
+			ok = ok || keyKind(key) == this.Kind
+		}
+		if !ok {
+			return false
+		}
+	}
+	if this.key != "" {
+		ok := false
+		for _, key := range keys {
+			ok = ok || getDictKey(key) == this.key
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// callKeys returns the keys and the kind a call is on. A commit is on the keys written in the transaction.
+func (this *InMemoryDatastore) callKeys(in appengine_internal.ProtoMessage) ([]*pb.Reference, string) {
+	var keys []*pb.Reference
+	switch req := in.(type) {
+	case *pb.PutRequest:
+		for _, e := range req.Entity {
+			keys = append(keys, e.Key)
+		}
+	case *pb.GetRequest:
+		keys = req.Key
+	case *pb.DeleteRequest:
+		keys = req.Key
+	case *pb.AllocateIdsRequest:
+		keys = []*pb.Reference{req.ModelKey}
+	case *pb.Transaction:
+		if dict, ok := this.tEntities[req.GetHandle()]; ok {
+			for _, e := range dict.Entities() {
+				keys = append(keys, e.Key)
+			}
+		}
+	case *pb.Query:
+		if req.Ancestor != nil {
+			keys = []*pb.Reference{req.Ancestor}
+		}
+		return keys, req.GetKind()
+	}
+	valid := make([]*pb.Reference, 0, len(keys))
+	for _, key := range keys {
+		if len(key.GetPath().GetElement()) > 0 {
+			valid = append(valid, key)
+		}
+	}
+	return valid, ""
+}
+
+// decodeKey decodes a key encoded with datastore.Key.Encode
+func decodeKey(encoded string) (*pb.Reference, error) {
+	// Encode strips the padding
+	if m := len(encoded) % 4; m != 0 {
+		encoded += strings.Repeat("=", 4-m)
+	}
+	b, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	key := &pb.Reference{}
+	if err := proto.Unmarshal(b, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+	"testing"
+	"time"
+)
+
+func TestDatastoreFaults(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+	keyA := datastore.NewKey(c, "A", "", 1, nil)
+	keyB := datastore.NewKey(c, "B", "", 1, nil)
+	obj := thing(1)
+	_, err := datastore.PutMulti(c, []*datastore.Key{keyA, keyB}, []Thing{obj, obj})
+	PanicIfErr(err)
+
+	// The Nth call
+	PanicIfErr(ds.InjectFault(Fault{Method: "Get", Nth: 2, Err: ErrTimeout}))
+	for i := 1; i <= 3; i++ {
+		err = datastore.Get(c, keyA, &Thing{})
+		if i == 2 && err != ErrTimeout {
+			t.Errorf("Get %d returned %v, want %v", i, err, ErrTimeout)
+		} else if i != 2 && err != nil {
+			t.Errorf("Get %d returned error %v", i, err)
+		}
+	}
+	ds.ClearFaults()
+
+	// Kinds and keys
+	PanicIfErr(ds.InjectFault(Fault{Kind: "A", Err: ErrInternal}))
+	if _, err = datastore.Put(c, keyA, &obj); err != ErrInternal {
+		t.Errorf("Put of kind A returned %v, want %v", err, ErrInternal)
+	}
+	if _, err = datastore.Put(c, keyB, &obj); err != nil {
+		t.Errorf("Put of kind B returned error %v", err)
+	}
+	if _, err = datastore.NewQuery("A").GetAll(c, &[]Thing{}); err != ErrInternal {
+		t.Errorf("Query on kind A returned %v, want %v", err, ErrInternal)
+	}
+	ds.ClearFaults()
+	PanicIfErr(ds.InjectFault(Fault{Key: keyB.Encode(), Err: ErrOverQuota}))
+	if err = datastore.Get(c, keyA, &Thing{}); err != nil {
+		t.Errorf("Get of other key returned error %v", err)
+	}
+	if err = datastore.Get(c, keyB, &Thing{}); !appengine.IsOverQuota(err) {
+		t.Errorf("Get of key returned %v, want an over quota error", err)
+	}
+	ds.ClearFaults()
+
+	// Retried transactions
+	PanicIfErr(ds.InjectFault(Fault{Method: "Commit", Kind: "A", Nth: 1, Err: ErrConcurrentTransaction}))
+	attempts := 0
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		attempts++
+		_, err := datastore.Put(tc, keyA, &obj)
+		return err
+	}, nil)
+	if err != nil || attempts != 2 {
+		t.Errorf("RunInTransaction returned %v after %d attempts, want success after 2 attempts", err, attempts)
+	}
+	if n := len(ds.tEntities); n != 0 {
+		t.Errorf("%d transactions were in progress after a failed commit, want 0", n)
+	}
+	ds.ClearFaults()
+
+	// Probability
+	PanicIfErr(ds.InjectFault(Fault{Method: "Get", Probability: 0.5, Err: ErrTimeout}))
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if datastore.Get(c, keyA, &Thing{}) == ErrTimeout {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 {
+		t.Errorf("%d of 200 calls with a fault with probability 0.5 failed", failed)
+	}
+	ds.ClearFaults()
+
+	// Latency
+	PanicIfErr(ds.InjectFault(Fault{Method: "Get", Latency: 20 * time.Millisecond}))
+	start := time.Now()
+	if err = datastore.Get(c, keyA, &Thing{}); err != nil {
+		t.Errorf("Get with latency returned error %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Get with latency took %v, want at least %v", d, 20*time.Millisecond)
+	}
+	req := &pb.GetRequest{Key: []*pb.Reference{keyToProto("dev~aeunit", keyA)}}
+	err = ds.Call("Get", req, &pb.GetResponse{}, &appengine_internal.CallOptions{Timeout: time.Millisecond})
+	if callErr, ok := err.(*appengine_internal.CallError); !ok || !callErr.IsTimeout() {
+		t.Errorf("Get with latency over its deadline returned %v, want a timeout", err)
+	}
+	var slept time.Duration
+	ds.SetSleep(func(d time.Duration) { slept += d })
+	PanicIfErr(datastore.Get(c, keyA, &Thing{}))
+	if slept != 20*time.Millisecond {
+		t.Errorf("Get with latency slept %v with the sleep function, want %v", slept, 20*time.Millisecond)
+	}
+	ds.ClearFaults()
+
+	// Invalid keys
+	if err = ds.InjectFault(Fault{Key: "not a key"}); err == nil {
+		t.Errorf("InjectFault with an invalid key did not return an error")
+	}
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"bufio"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewFile returns an InMemoryDatastore that is backed by a file. The entities in the file are loaded, if the
+// file exists, and the datastore is saved to the file when it is closed.
+//
+// The file starts with the ID counter as a varint, so IDs that were allocated are not allocated again. It is
+// followed by a stream of EntityProtos, each prefixed by its length as a varint.
+func NewFile(path string) (*InMemoryDatastore, error) {
+	ds := New()
+	ds.path = path
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ds, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := ds.readEntities(bufio.NewReader(file)); err != nil {
+		return nil, fmt.Errorf("aeunit datastore: could not load %s: %v", path, err)
+	}
+	return ds, nil
+}
+
+// save writes all entities to the file at path. The file is replaced atomically, so a failed save does not
+// corrupt an existing file.
+func (this *InMemoryDatastore) save(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = this.writeEntities(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("aeunit datastore: could not save %s: %v", path, err)
+	}
+	return nil
+}
+
+func (this *InMemoryDatastore) writeEntities(w io.Writer) error {
+	if _, err := w.Write(proto.EncodeVarint(uint64(this.idCounter))); err != nil {
+		return err
+	}
+	for _, e := range this.entities.Entities() {
+		b, err := proto.Marshal(e.Obj)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(proto.EncodeVarint(uint64(len(b)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *InMemoryDatastore) readEntities(r *bufio.Reader) error {
+	idCounter, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if int64(idCounter) > this.idCounter {
+		this.idCounter = int64(idCounter)
+	}
+	for {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Entities can't be larger than the maximum size, so a larger length means the file is corrupt
+		if n > maxEntitySize {
+			return fmt.Errorf("entity of %d bytes is larger than the maximum of %d bytes", n, maxEntitySize)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		e := &pb.EntityProto{}
+		if err := proto.Unmarshal(b, e); err != nil {
+			return err
+		}
+		if err := this.load(e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"appengine/datastore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDatastoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aeunit")
+	PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "datastore.db")
+
+	// The file does not exist yet: start with an empty datastore
+	ds, err := NewFile(path)
+	if err != nil {
+		t.Errorf("NewFile returned error for a file that does not exist: %v", err)
+		t.FailNow()
+	}
+	c := &testContext{ds: ds}
+	parent := datastore.NewKey(c, "Parent", "name", 0, nil)
+	keys := []*datastore.Key{datastore.NewKey(c, "Kind", "", 1, nil), datastore.NewKey(c, "Kind", "", 2, parent)}
+	objs := []Thing{thing(1), thing(2)}
+	_, err = datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+	if err = ds.Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+		t.FailNow()
+	}
+
+	// The entities are loaded from the file
+	ds, err = NewFile(path)
+	if err != nil {
+		t.Errorf("NewFile returned error: %v", err)
+		t.FailNow()
+	}
+	c = &testContext{ds: ds}
+	got := make([]Thing, len(keys))
+	if err = datastore.GetMulti(c, keys, got); err != nil {
+		t.Errorf("GetMulti returned error: %v", err)
+	} else if !reflect.DeepEqual(got, objs) {
+		t.Errorf("Entities loaded from file were not as expected. Got %v, want %v", got, objs)
+	}
+	if e := expect(c, datastore.NewQuery("Kind").Ancestor(parent), objs[1:]); e != "" {
+		t.Errorf("Ancestor query on entities loaded from file: %s", e)
+	}
+	low, _, err := datastore.AllocateIDs(c, "Kind", nil, 1)
+	PanicIfErr(err)
+	if low <= 2 {
+		t.Errorf("AllocateIDs returned ID %d, which is used by an entity loaded from file", low)
+	}
+
+	// Deletes are saved too
+	PanicIfErr(datastore.Delete(c, keys[0]))
+	PanicIfErr(ds.Close())
+	ds, err = NewFile(path)
+	PanicIfErr(err)
+	c = &testContext{ds: ds}
+	if err = datastore.Get(c, keys[0], &Thing{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Deleted entity was loaded from file. Get returned %v", err)
+	}
+
+	// IDs that were allocated are not allocated again, even if no entity uses them
+	high := low
+	PanicIfErr(ds.Close())
+	ds, err = NewFile(path)
+	PanicIfErr(err)
+	c = &testContext{ds: ds}
+	if low, _, err = datastore.AllocateIDs(c, "Kind", nil, 1); err != nil || low <= high {
+		t.Errorf("AllocateIDs returned ID %d, %v, which was allocated before the datastore was saved", low, err)
+	}
+
+	// A corrupt file is reported
+	corrupt := [][]byte{
+		{1, 10, 1, 2},
+		{1, 0xff, 0xff, 0xff, 0xff, 0x0f}, // a length larger than any entity
+	}
+	for _, b := range corrupt {
+		PanicIfErr(ioutil.WriteFile(path, b, 0644))
+		if _, err = NewFile(path); err == nil {
+			t.Errorf("NewFile did not return an error for corrupt file %v", b)
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Fixture is a human readable representation of datastore entities. Fixtures can be loaded into and dumped from an
+// InMemoryDatastore, and read and written as JSON. The yamlfixture package reads and writes them as YAML:
+//
+//	# people.yaml
+//	- kind: Person
+//	  key: [Company, acme, Person, 1]
+//	  properties:
+//	  - {name: Name, type: string, value: Alice}
+//	  - {name: Tags, type: string, values: [a, b]}
+//	  - {name: Employer, type: key, value: [Company, acme]}
+//	  - {name: Born, type: time, value: "1990-01-02T15:04:05Z"}
+//	  - {name: Home, type: geo, value: {lat: 59.9, lng: 10.7}}
+//	  - {name: Owner, type: user, value: {email: alice@example.com, auth_domain: example.com}}
+//	  - {name: Bio, type: text, value: "A long text", noindex: true}
+type Fixture []FixtureEntity
+
+// FixtureEntity is an entity in a Fixture. The key is the path of the entity: kinds followed by int or string IDs,
+// starting with the root entity.
+type FixtureEntity struct {
+	Kind       string            `json:"kind" yaml:"kind"`
+	Namespace  string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Key        []interface{}     `json:"key" yaml:"key"`
+	Properties []FixtureProperty `json:"properties,omitempty" yaml:"properties,omitempty"`
+}
+
+// FixtureProperty is a property of a FixtureEntity. A property has either a Value or, if it is a list, Values.
+// Type is one of the Fixture* type constants.
+type FixtureProperty struct {
+	Name    string        `json:"name" yaml:"name"`
+	Type    string        `json:"type" yaml:"type"`
+	Value   interface{}   `json:"value,omitempty" yaml:"value,omitempty"`
+	Values  []interface{} `json:"values,omitempty" yaml:"values,omitempty"`
+	NoIndex bool          `json:"noindex,omitempty" yaml:"noindex,omitempty"`
+}
+
+// Property types in fixtures
+const (
+	FixtureNull       = "null"
+	FixtureInt        = "int"
+	FixtureBool       = "bool"
+	FixtureString     = "string"
+	FixtureFloat      = "float"
+	FixtureKey        = "key"        // a key path, like the key of the FixtureEntity
+	FixtureTime       = "time"       // an RFC 3339 timestamp
+	FixtureGeo        = "geo"        // an object with "lat" and "lng"
+	FixtureUser       = "user"       // an object with "email", "auth_domain", and optionally "nickname", "federated_identity" and "federated_provider"
+	FixtureText       = "text"       // a string that is never indexed
+	FixtureBlob       = "blob"       // base64 encoded bytes that are never indexed
+	FixtureByteString = "bytestring" // base64 encoded bytes
+	FixtureBlobKey    = "blobkey"
+)
+
+// ReadFixtureJSON reads a fixture in JSON format
+func ReadFixtureJSON(r io.Reader) (Fixture, error) {
+	var f Fixture
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("aeunit datastore: could not read fixture: %v", err)
+	}
+	return f, nil
+}
+
+// WriteJSON writes the fixture in JSON format
+func (this Fixture) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// LoadFixture puts the entities of the fixture in the datastore. Keys get the given app ID.
+// IDs allocated after loading the fixture will not collide with int IDs in the fixture.
+func (this *InMemoryDatastore) LoadFixture(f Fixture, appID string) error {
+	entities := make([]*pb.EntityProto, len(f))
+	for i, fe := range f {
+		e, err := fe.toProto(appID)
+		if err != nil {
+			return fmt.Errorf("aeunit datastore: invalid fixture entity %d: %v", i, err)
+		}
+		entities[i] = e
+	}
+	for i, e := range entities {
+		if err := this.load(e); err != nil {
+			return fmt.Errorf("aeunit datastore: invalid fixture entity %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// DumpFixture returns all entities in the datastore as a fixture, ordered by namespace and key
+func (this *InMemoryDatastore) DumpFixture() (Fixture, error) {
+	entities := this.entities.Entities()
+	f := make(Fixture, len(entities))
+	for i, e := range entities {
+		f[i] = newFixtureEntity(e.Obj)
+	}
+	return f, nil
+}
+
+// LoadFixtureFile loads a JSON fixture file into the datastore. Use the yamlfixture package for YAML files.
+func (this *InMemoryDatastore) LoadFixtureFile(path, appID string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	f, err := ReadFixtureJSON(file)
+	if err != nil {
+		return err
+	}
+	return this.LoadFixture(f, appID)
+}
+
+// DumpFixtureFile writes all entities in the datastore to a JSON fixture file
+func (this *InMemoryDatastore) DumpFixtureFile(path string) error {
+	f, err := this.DumpFixture()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.WriteJSON(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (this FixtureEntity) toProto(appID string) (*pb.EntityProto, error) {
+	path, err := fixturePath(this.Key)
+	if err != nil {
+		return nil, err
+	}
+	el := path.Element
+	if this.Kind != "" && this.Kind != el[len(el)-1].GetType() {
+		return nil, fmt.Errorf("kind %s does not match the kind of the key %s", this.Kind, el[len(el)-1].GetType())
+	}
+	key := &pb.Reference{App: &appID, Path: path}
+	if this.Namespace != "" {
+		ns := this.Namespace
+		key.NameSpace = &ns
+	}
+	e := &pb.EntityProto{Key: key, EntityGroup: &pb.Path{}}
+	if len(el) > 1 {
+		e.EntityGroup = &pb.Path{Element: el[:1]}
+	}
+	for _, fp := range this.Properties {
+		props, err := fp.toProto(appID, this.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %v", fp.Name, err)
+		}
+		if fp.NoIndex || fp.Type == FixtureText || fp.Type == FixtureBlob {
+			e.RawProperty = append(e.RawProperty, props...)
+		} else {
+			e.Property = append(e.Property, props...)
+		}
+	}
+	return e, nil
+}
+
+func (this FixtureProperty) toProto(appID, namespace string) ([]*pb.Property, error) {
+	multiple := this.Values != nil
+	values := this.Values
+	if !multiple {
+		values = []interface{}{this.Value}
+	}
+	props := make([]*pb.Property, len(values))
+	for i, v := range values {
+		value, meaning, err := fixtureValue(this.Type, v, appID, namespace)
+		if err != nil {
+			return nil, err
+		}
+		name := this.Name
+		m := multiple
+		props[i] = &pb.Property{Name: &name, Value: value, Multiple: &m}
+		if meaning != pb.Property_NO_MEANING {
+			props[i].Meaning = meaning.Enum()
+		}
+	}
+	return props, nil
+}
+
+// fixtureValue converts a value read from a fixture to a property value and meaning
+func fixtureValue(typ string, v interface{}, appID, namespace string) (*pb.PropertyValue, pb.Property_Meaning, error) {
+	value := &pb.PropertyValue{}
+	meaning := pb.Property_NO_MEANING
+	var err error
+	switch typ {
+	case FixtureNull:
+		if v != nil {
+			err = fmt.Errorf("null property with value %v", v)
+		}
+	case FixtureInt:
+		var i int64
+		i, err = fixtureInt(v)
+		value.Int64Value = &i
+	case FixtureBool:
+		b, ok := v.(bool)
+		if !ok {
+			err = fmt.Errorf("invalid bool %v", v)
+		}
+		value.BooleanValue = &b
+	case FixtureString, FixtureText, FixtureBlobKey:
+		s, ok := v.(string)
+		if !ok {
+			err = fmt.Errorf("invalid string %v", v)
+		}
+		value.StringValue = &s
+		switch typ {
+		case FixtureText:
+			meaning = pb.Property_TEXT
+		case FixtureBlobKey:
+			meaning = pb.Property_BLOBKEY
+		}
+	case FixtureBlob, FixtureByteString:
+		s, _ := v.(string)
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+			err = fmt.Errorf("invalid base64 %v", v)
+		}
+		str := string(b)
+		value.StringValue = &str
+		meaning = pb.Property_BLOB
+		if typ == FixtureByteString {
+			meaning = pb.Property_BYTESTRING
+		}
+	case FixtureFloat:
+		var f float64
+		f, err = fixtureFloat(v)
+		value.DoubleValue = &f
+	case FixtureTime:
+		s, _ := v.(string)
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			err = fmt.Errorf("invalid time %v", v)
+		}
+		usec := t.UnixNano() / 1e3
+		value.Int64Value = &usec
+		meaning = pb.Property_GD_WHEN
+	case FixtureGeo:
+		var lat, lng float64
+		lat, lng, err = fixtureGeo(v)
+		// Latitude maps to X, longitude to Y
+		value.Pointvalue = &pb.PropertyValue_PointValue{X: &lat, Y: &lng}
+		meaning = pb.Property_GEORSS_POINT
+	case FixtureUser:
+		value.Uservalue, err = fixtureUser(v)
+	case FixtureKey:
+		path, ok := v.([]interface{})
+		if !ok {
+			err = fmt.Errorf("invalid key %v", v)
+			break
+		}
+		var p *pb.Path
+		if p, err = fixturePath(path); err != nil {
+			break
+		}
+		ref := &pb.PropertyValue_ReferenceValue{App: &appID}
+		if namespace != "" {
+			ref.NameSpace = &namespace
+		}
+		for _, el := range p.Element {
+			ref.Pathelement = append(ref.Pathelement, &pb.PropertyValue_ReferenceValue_PathElement{
+				Type: el.Type,
+				Id:   el.Id,
+				Name: el.Name,
+			})
+		}
+		value.Referencevalue = ref
+	default:
+		err = fmt.Errorf("unknown type %s", typ)
+	}
+	return value, meaning, err
+}
+
+// fixturePath converts a key path read from a fixture to a pb.Path
+func fixturePath(path []interface{}) (*pb.Path, error) {
+	if len(path) == 0 || len(path)%2 != 0 {
+		return nil, fmt.Errorf("key %v is not a list of kinds and IDs", path)
+	}
+	p := &pb.Path{}
+	for i := 0; i < len(path); i += 2 {
+		kind, ok := path[i].(string)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("key %v has invalid kind %v", path, path[i])
+		}
+		el := &pb.Path_Element{Type: &kind}
+		if name, ok := path[i+1].(string); ok && name != "" {
+			el.Name = &name
+		} else if id, err := fixtureInt(path[i+1]); err == nil && id != 0 {
+			el.Id = &id
+		} else {
+			return nil, fmt.Errorf("key %v has invalid ID %v", path, path[i+1])
+		}
+		p.Element = append(p.Element, el)
+	}
+	return p, nil
+}
+
+func fixtureInt(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Int64()
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("invalid int %v", v)
+}
+
+func fixtureFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	}
+	return 0, fmt.Errorf("invalid float %v", v)
+}
+
+// fixtureObject returns the fields of an object read from a fixture. YAML objects have keys of any type.
+func fixtureObject(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			s, ok := k.(string)
+			if !ok {
+				return nil, false
+			}
+			obj[s] = v
+		}
+		return obj, true
+	}
+	return nil, false
+}
+
+func fixtureGeo(v interface{}) (float64, float64, error) {
+	m, ok := fixtureObject(v)
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid geo point %v", v)
+	}
+	x, err := fixtureFloat(m["lat"])
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := fixtureFloat(m["lng"])
+	return x, y, err
+}
+
+func fixtureUser(v interface{}) (*pb.PropertyValue_UserValue, error) {
+	m, ok := fixtureObject(v)
+	if !ok {
+		return nil, fmt.Errorf("invalid user %v", v)
+	}
+	u := &pb.PropertyValue_UserValue{}
+	fields := []struct {
+		name     string
+		value    **string
+		required bool
+	}{
+		{"email", &u.Email, true},
+		{"auth_domain", &u.AuthDomain, true},
+		{"nickname", &u.Nickname, false},
+		{"federated_identity", &u.FederatedIdentity, false},
+		{"federated_provider", &u.FederatedProvider, false},
+	}
+	for _, field := range fields {
+		fv, ok := m[field.name]
+		if !ok {
+			if field.required {
+				return nil, fmt.Errorf("user %v has no %s", v, field.name)
+			}
+			continue
+		}
+		s, ok := fv.(string)
+		if !ok {
+			return nil, fmt.Errorf("user %v has invalid %s %v", v, field.name, fv)
+		}
+		*field.value = &s
+	}
+	return u, nil
+}
+
+func newFixtureEntity(e *pb.EntityProto) FixtureEntity {
+	el := e.GetKey().GetPath().GetElement()
+	fe := FixtureEntity{
+		Kind:      el[len(el)-1].GetType(),
+		Namespace: e.GetKey().GetNameSpace(),
+	}
+	for _, pe := range el {
+		fe.Key = append(fe.Key, pe.GetType(), pathElemID(pe.GetName(), pe.GetId()))
+	}
+	// Values of list properties are grouped together in one FixtureProperty
+	index := make(map[string]int)
+	add := func(props []*pb.Property, noIndex bool) {
+		for _, p := range props {
+			typ, v := newFixtureValue(p.GetValue(), p.GetMeaning())
+			if !p.GetMultiple() {
+				fe.Properties = append(fe.Properties, FixtureProperty{Name: p.GetName(), Type: typ, Value: v, NoIndex: noIndex})
+			} else if i, ok := index[p.GetName()]; ok {
+				fe.Properties[i].Values = append(fe.Properties[i].Values, v)
+			} else {
+				index[p.GetName()] = len(fe.Properties)
+				fe.Properties = append(fe.Properties, FixtureProperty{Name: p.GetName(), Type: typ, Values: []interface{}{v}, NoIndex: noIndex})
+			}
+		}
+	}
+	add(e.GetProperty(), false)
+	add(e.GetRawProperty(), true)
+	return fe
+}
+
+// newFixtureValue converts a property value and meaning to a fixture type and value
+func newFixtureValue(v *pb.PropertyValue, meaning pb.Property_Meaning) (string, interface{}) {
+	switch {
+	case v.Int64Value != nil:
+		if meaning == pb.Property_GD_WHEN {
+			t := time.Unix(0, v.GetInt64Value()*1e3).UTC()
+			return FixtureTime, t.Format(time.RFC3339Nano)
+		}
+		return FixtureInt, v.GetInt64Value()
+	case v.BooleanValue != nil:
+		return FixtureBool, v.GetBooleanValue()
+	case v.StringValue != nil:
+		switch meaning {
+		case pb.Property_TEXT:
+			return FixtureText, v.GetStringValue()
+		case pb.Property_BLOBKEY:
+			return FixtureBlobKey, v.GetStringValue()
+		case pb.Property_BLOB:
+			return FixtureBlob, base64.StdEncoding.EncodeToString([]byte(v.GetStringValue()))
+		case pb.Property_BYTESTRING:
+			return FixtureByteString, base64.StdEncoding.EncodeToString([]byte(v.GetStringValue()))
+		}
+		return FixtureString, v.GetStringValue()
+	case v.DoubleValue != nil:
+		return FixtureFloat, v.GetDoubleValue()
+	case v.Pointvalue != nil:
+		return FixtureGeo, map[string]interface{}{"lat": v.Pointvalue.GetX(), "lng": v.Pointvalue.GetY()}
+	case v.Referencevalue != nil:
+		path := make([]interface{}, 0)
+		for _, pe := range v.Referencevalue.GetPathelement() {
+			path = append(path, pe.GetType(), pathElemID(pe.GetName(), pe.GetId()))
+		}
+		return FixtureKey, path
+	case v.Uservalue != nil:
+		u := v.Uservalue
+		user := map[string]interface{}{"email": u.GetEmail(), "auth_domain": u.GetAuthDomain()}
+		if u.Nickname != nil {
+			user["nickname"] = u.GetNickname()
+		}
+		if u.FederatedIdentity != nil {
+			user["federated_identity"] = u.GetFederatedIdentity()
+		}
+		if u.FederatedProvider != nil {
+			user["federated_provider"] = u.GetFederatedProvider()
+		}
+		return FixtureUser, user
+	}
+	return FixtureNull, nil
+}
+
+func pathElemID(name string, id int64) interface{} {
+	if name != "" {
+		return name
+	}
+	return id
+}
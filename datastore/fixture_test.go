@@ -0,0 +1,201 @@
+package datastore
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFixtureJSON = `[
+	{"kind": "Company", "key": ["Company", "acme"], "properties": [
+		{"name": "Name", "type": "string", "value": "Acme"},
+		{"name": "Owner", "type": "user", "value": {"email": "alice@example.com", "auth_domain": "example.com"}}
+	]},
+	{"kind": "Person", "key": ["Company", "acme", "Person", 1], "properties": [
+		{"name": "Name", "type": "string", "value": "Alice"},
+		{"name": "Age", "type": "int", "value": 30},
+		{"name": "Height", "type": "float", "value": 1.7},
+		{"name": "Admin", "type": "bool", "value": true},
+		{"name": "Tags", "type": "string", "values": ["a", "b"]},
+		{"name": "Employer", "type": "key", "value": ["Company", "acme"]},
+		{"name": "Born", "type": "time", "value": "1990-01-02T15:04:05Z"},
+		{"name": "Home", "type": "geo", "value": {"lat": 59.9, "lng": 10.7}},
+		{"name": "Bio", "type": "text", "value": "A long text"},
+		{"name": "Avatar", "type": "blob", "value": "AQID"}
+	]}
+]`
+
+type fixturePerson struct {
+	Name     string
+	Age      int
+	Height   float64
+	Admin    bool
+	Tags     []string
+	Employer *datastore.Key
+	Born     time.Time
+	Home     appengine.GeoPoint
+	Bio      string `datastore:",noindex"`
+	Avatar   []byte
+}
+
+func TestDatastoreLoadFixture(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+
+	f, err := ReadFixtureJSON(strings.NewReader(testFixtureJSON))
+	if err != nil {
+		t.Errorf("ReadFixtureJSON returned error: %v", err)
+		t.FailNow()
+	}
+	if err = ds.LoadFixture(f, c.FullyQualifiedAppID()); err != nil {
+		t.Errorf("LoadFixture returned error: %v", err)
+		t.FailNow()
+	}
+
+	company := datastore.NewKey(c, "Company", "acme", 0, nil)
+	want := fixturePerson{
+		Name:     "Alice",
+		Age:      30,
+		Height:   1.7,
+		Admin:    true,
+		Tags:     []string{"a", "b"},
+		Employer: company,
+		Born:     time.Date(1990, 1, 2, 15, 4, 5, 0, time.UTC),
+		Home:     appengine.GeoPoint{Lat: 59.9, Lng: 10.7},
+		Bio:      "A long text",
+		Avatar:   []byte{1, 2, 3},
+	}
+	var got fixturePerson
+	if err = datastore.Get(c, datastore.NewKey(c, "Person", "", 1, company), &got); err != nil {
+		t.Errorf("Get returned error: %v", err)
+		t.FailNow()
+	}
+	got.Born = got.Born.UTC()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Loaded entity was not as expected.\nGot  %+v\nWant %+v", got, want)
+	}
+
+	// Loaded entities are returned by queries
+	var people []fixturePerson
+	if _, err = datastore.NewQuery("Person").Ancestor(company).Filter("Tags=", "b").GetAll(c, &people); err != nil {
+		t.Errorf("GetAll returned error: %v", err)
+	} else if len(people) != 1 {
+		t.Errorf("Query returned %d entities. Want 1", len(people))
+	}
+
+	// IDs allocated after loading a fixture don't collide with the fixture's IDs
+	low, _, err := datastore.AllocateIDs(c, "Person", nil, 1)
+	PanicIfErr(err)
+	if low <= 1 {
+		t.Errorf("AllocateIDs returned ID %d, which is used by the fixture", low)
+	}
+}
+
+func TestDatastoreDumpFixture(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+	f, err := ReadFixtureJSON(strings.NewReader(testFixtureJSON))
+	PanicIfErr(err)
+	PanicIfErr(ds.LoadFixture(f, c.FullyQualifiedAppID()))
+
+	dump, err := ds.DumpFixture()
+	if err != nil {
+		t.Errorf("DumpFixture returned error: %v", err)
+		t.FailNow()
+	}
+	if len(dump) != 2 || dump[0].Kind != "Company" || dump[1].Kind != "Person" {
+		t.Errorf("DumpFixture returned unexpected entities: %v", dump)
+		t.FailNow()
+	}
+	for _, p := range dump[0].Properties {
+		want := map[string]interface{}{"email": "alice@example.com", "auth_domain": "example.com"}
+		if p.Name == "Owner" && (p.Type != FixtureUser || !reflect.DeepEqual(p.Value, want)) {
+			t.Errorf("User property was dumped as %s %v. Want %s %v", p.Type, p.Value, FixtureUser, want)
+		}
+	}
+
+	// A dump can be written, and loaded into a datastore with the same state
+	var buf bytes.Buffer
+	PanicIfErr(dump.WriteJSON(&buf))
+	loaded, err := ReadFixtureJSON(&buf)
+	if err != nil {
+		t.Errorf("Reading a dumped fixture returned error: %v", err)
+		t.FailNow()
+	}
+	ds2 := New()
+	if err = ds2.LoadFixture(loaded, c.FullyQualifiedAppID()); err != nil {
+		t.Errorf("Loading a dumped fixture returned error: %v", err)
+		t.FailNow()
+	}
+	for _, de := range ds.entities.Entities() {
+		if e := ds2.entities.Get(de.Key); !reflect.DeepEqual(e, de.Obj) {
+			t.Errorf("Entity %v changed after dumping and loading it.\nGot  %v\nWant %v", de.Key, e, de.Obj)
+		}
+	}
+
+	// A dump can also be loaded without writing it
+	ds3 := New()
+	if err = ds3.LoadFixture(dump, c.FullyQualifiedAppID()); err != nil {
+		t.Errorf("Loading a dump returned error: %v", err)
+	}
+}
+
+func TestDatastoreLoadFixtureGo(t *testing.T) {
+	// Fixtures built in Go may use any integer type for floats
+	f := Fixture{{Key: []interface{}{"Point", int64(1)}, Properties: []FixtureProperty{
+		{Name: "X", Type: FixtureFloat, Value: int64(2)},
+		{Name: "Y", Type: FixtureFloat, Value: uint64(3)},
+	}}}
+	ds := New()
+	if err := ds.LoadFixture(f, "dev~aeunit"); err != nil {
+		t.Errorf("LoadFixture returned error: %v", err)
+		t.FailNow()
+	}
+	dump, err := ds.DumpFixture()
+	PanicIfErr(err)
+	if x, y := dump[0].Properties[0].Value, dump[0].Properties[1].Value; x != 2.0 || y != 3.0 {
+		t.Errorf("Loaded floats were %v and %v. Want 2 and 3", x, y)
+	}
+}
+
+func TestDatastoreLoadFixtureInvalid(t *testing.T) {
+	tests := []string{
+		`[{"kind": "Person", "key": ["Person"]}]`,
+		`[{"kind": "Person", "key": ["Company", 1]}]`,
+		`[{"key": ["Person", 1], "properties": [{"name": "P", "type": "int", "value": "one"}]}]`,
+		`[{"key": ["Person", 1], "properties": [{"name": "P", "type": "unknown", "value": 1}]}]`,
+		`[{"key": ["Person", 1], "properties": [{"name": "P", "type": "time", "value": "yesterday"}]}]`,
+		`[{"key": ["Person", 1], "properties": [{"name": "P", "type": "user", "value": {"email": "alice@example.com"}}]}]`,
+	}
+	for _, test := range tests {
+		f, err := ReadFixtureJSON(strings.NewReader(test))
+		PanicIfErr(err)
+		if err = New().LoadFixture(f, "dev~aeunit"); err == nil {
+			t.Errorf("LoadFixture(%s) did not return an error", test)
+		}
+	}
+
+	// Entities that could not be put are not loaded either
+	invalid := []Fixture{
+		{{Key: []interface{}{"__Person__", int64(1)}}},
+		{{Key: []interface{}{"Person", int64(1)}, Properties: []FixtureProperty{
+			{Name: "Bio", Type: FixtureText, Value: strings.Repeat("a", maxEntitySize)},
+		}}},
+		{{Key: []interface{}{"Person", int64(1)}, Properties: []FixtureProperty{
+			{Name: "Name", Type: FixtureString, Value: strings.Repeat("a", maxIndexedStringLength+1)},
+		}}},
+	}
+	for _, f := range invalid {
+		ds := New()
+		if err := ds.LoadFixture(f, "dev~aeunit"); err == nil {
+			t.Errorf("LoadFixture of entity with key %v did not return an error", f[0].Key)
+		}
+		if n := len(ds.entities.Entities()); n != 0 {
+			t.Errorf("LoadFixture of invalid entity loaded %d entities, want 0", n)
+		}
+	}
+}
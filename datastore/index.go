@@ -0,0 +1,377 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Property values are encoded to bytes that sort in the same order as the values. Values of different types are
+// ordered by type, like in the production datastore: null, integers (and times), booleans, strings (and byte
+// strings), doubles, geo points, users and keys.
+const (
+	valueTagNull byte = iota + 1
+	valueTagInt
+	valueTagBool
+	valueTagString
+	valueTagDouble
+	valueTagPoint
+	valueTagUser
+	valueTagReference
+)
+
+// encodeValue appends the encoding of the property value to b. The encoding is prefix free, so encodings can be
+// concatenated and still sort in the right order.
+func encodeValue(b []byte, v *pb.PropertyValue) []byte {
+	switch {
+	case v == nil:
+		return append(b, valueTagNull)
+	case v.Int64Value != nil:
+		return encodeInt(append(b, valueTagInt), v.GetInt64Value())
+	case v.BooleanValue != nil:
+		if v.GetBooleanValue() {
+			return append(b, valueTagBool, 1)
+		}
+		return append(b, valueTagBool, 0)
+	case v.StringValue != nil:
+		return encodeString(append(b, valueTagString), v.GetStringValue())
+	case v.DoubleValue != nil:
+		return encodeDouble(append(b, valueTagDouble), v.GetDoubleValue())
+	case v.Pointvalue != nil:
+		b = encodeDouble(append(b, valueTagPoint), v.Pointvalue.GetX())
+		return encodeDouble(b, v.Pointvalue.GetY())
+	case v.Uservalue != nil:
+		b = encodeString(append(b, valueTagUser), v.Uservalue.GetEmail())
+		return encodeString(b, v.Uservalue.GetAuthDomain())
+	case v.Referencevalue != nil:
+		b = append(b, valueTagReference)
+		for _, el := range v.Referencevalue.GetPathelement() {
+			b = encodePathElem(b, el.GetType(), el.GetName(), el.GetId())
+		}
+		return append(b, 0)
+	}
+	return append(b, valueTagNull)
+}
+
+func encodeInt(b []byte, i int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i)^(1<<63))
+	return append(b, buf[:]...)
+}
+
+func encodeDouble(b []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], bits)
+	return append(b, buf[:]...)
+}
+
+// encodeString escapes 0x00 as 0x00 0xFF and terminates the string with 0x00 0x01
+func encodeString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			b = append(b, 0, 0xFF)
+		} else {
+			b = append(b, s[i])
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// encodePathElem appends the encoding of a key path element. Elements are ordered like in compareProtoRefPathElem:
+// by kind, then numeric IDs before names. A path is terminated by a 0 byte, so shorter paths sort first.
+func encodePathElem(b []byte, kind, name string, id int64) []byte {
+	b = encodeString(append(b, 1), kind)
+	if name != "" {
+		return encodeString(append(b, 2), name)
+	}
+	return encodeInt(append(b, 1), id)
+}
+
+// encodeKey returns the canonical encoding of a key: its namespace, its path and its app ID. Keys in the same
+// namespace sort like in compareProtoRef, and the encodings of a key and its descendants start with
+// encodeAncestor of the key.
+func encodeKey(key *pb.Reference) []byte {
+	b := append(encodeAncestor(key), 0)
+	return encodeString(b, key.GetApp())
+}
+
+// encodeAncestor returns the beginning of the encodings of the key and its descendants
+func encodeAncestor(key *pb.Reference) []byte {
+	b := encodeString(nil, key.GetNameSpace())
+	for _, el := range key.GetPath().GetElement() {
+		b = encodePathElem(b, el.GetType(), el.GetName(), el.GetId())
+	}
+	return b
+}
+
+// invert inverts the encoded bytes, which reverses the order of prefix free encodings
+func invert(b []byte) []byte {
+	for i := range b {
+		b[i] = ^b[i]
+	}
+	return b
+}
+
+// prefixEnd returns the smallest byte string that is greater than all byte strings starting with prefix,
+// or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+type indexProperty struct {
+	name string
+	desc bool
+}
+
+type indexEntry struct {
+	value   []byte // the encoded property values of the entity, or its encoded key in an index without properties
+	key     *pb.Reference
+	dictKey string
+}
+
+// indexChunkSize is the maximum number of entries in a chunk of an index
+const indexChunkSize = 512
+
+// index is a list of entries ordered by the encoded values of its properties, then by key. An entity has an
+// entry for every combination of its values for the properties, and no entries if it lacks one of them.
+// An index without properties has one entry for every entity, with the encoded key as value.
+//
+// The entries are stored in ordered chunks of at most indexChunkSize entries, so that adding and removing an entry
+// only moves the entries of one chunk.
+type index struct {
+	props  []indexProperty
+	chunks [][]indexEntry
+}
+
+func newIndex(props []indexProperty) *index {
+	return &index{props: props}
+}
+
+// newCompositeIndex returns an index with the properties of the composite index definition
+func newCompositeIndex(def *pb.Index) *index {
+	props := make([]indexProperty, len(def.GetProperty()))
+	for i, p := range def.GetProperty() {
+		props[i] = indexProperty{p.GetName(), p.GetDirection() == pb.Index_Property_DESCENDING}
+	}
+	return newIndex(props)
+}
+
+func (this *index) clone() *index {
+	chunks := make([][]indexEntry, len(this.chunks))
+	for i, c := range this.chunks {
+		chunks[i] = append(make([]indexEntry, 0, len(c)), c...)
+	}
+	return &index{
+		props:  this.props,
+		chunks: chunks,
+	}
+}
+
+func (this *index) entriesFor(e *pb.EntityProto, dictKey string) []indexEntry {
+	if len(this.props) == 0 {
+		return []indexEntry{indexEntry{[]byte(dictKey), e.GetKey(), dictKey}}
+	}
+	values := [][]byte{nil}
+	for _, p := range this.props {
+		var next [][]byte
+		for _, v := range indexedValues(e, p.name) {
+			enc := encodeValue(nil, v)
+			if p.desc {
+				invert(enc)
+			}
+			for _, prefix := range values {
+				next = append(next, append(append([]byte{}, prefix...), enc...))
+			}
+		}
+		values = next
+	}
+	entries := make([]indexEntry, len(values))
+	for i, v := range values {
+		entries[i] = indexEntry{v, e.GetKey(), dictKey}
+	}
+	return entries
+}
+
+func (this *index) Add(e *pb.EntityProto, dictKey string) {
+	for _, entry := range this.entriesFor(e, dictKey) {
+		if len(this.chunks) == 0 {
+			this.chunks = [][]indexEntry{[]indexEntry{entry}}
+			continue
+		}
+		c, i := this.position(func(other indexEntry) bool {
+			return compareIndexEntries(other, entry) >= 0
+		})
+		if c == len(this.chunks) {
+			c, i = c-1, len(this.chunks[c-1])
+		}
+		chunk := append(this.chunks[c], indexEntry{})
+		copy(chunk[i+1:], chunk[i:])
+		chunk[i] = entry
+		this.chunks[c] = chunk
+		if len(chunk) > indexChunkSize {
+			half := len(chunk) / 2
+			this.chunks = append(this.chunks, nil)
+			copy(this.chunks[c+2:], this.chunks[c+1:])
+			this.chunks[c] = chunk[:half:half]
+			this.chunks[c+1] = append([]indexEntry{}, chunk[half:]...)
+		}
+	}
+}
+
+func (this *index) Remove(e *pb.EntityProto, dictKey string) {
+	for _, entry := range this.entriesFor(e, dictKey) {
+		c, i := this.position(func(other indexEntry) bool {
+			return compareIndexEntries(other, entry) >= 0
+		})
+		if c == len(this.chunks) {
+			continue
+		}
+		chunk := this.chunks[c]
+		if chunk[i].dictKey != dictKey || !bytes.Equal(chunk[i].value, entry.value) {
+			continue
+		}
+		if len(chunk) == 1 {
+			this.chunks = append(this.chunks[:c], this.chunks[c+1:]...)
+		} else {
+			this.chunks[c] = append(chunk[:i], chunk[i+1:]...)
+		}
+	}
+}
+
+// position returns the chunk and the index in the chunk of the first entry for which f is true, or
+// len(this.chunks) if there is none. f must be false for the entries before the first entry it is true for.
+func (this *index) position(f func(indexEntry) bool) (int, int) {
+	c := sort.Search(len(this.chunks), func(c int) bool {
+		chunk := this.chunks[c]
+		return f(chunk[len(chunk)-1])
+	})
+	if c == len(this.chunks) {
+		return c, 0
+	}
+	chunk := this.chunks[c]
+	return c, sort.Search(len(chunk), func(i int) bool { return f(chunk[i]) })
+}
+
+// Len returns the number of entries in the index
+func (this *index) Len() int {
+	n := 0
+	for _, c := range this.chunks {
+		n += len(c)
+	}
+	return n
+}
+
+// Range returns the entries with values from lo (inclusive) to hi (exclusive). A nil hi means no upper bound.
+func (this *index) Range(lo, hi []byte) []indexEntry {
+	entries := make([]indexEntry, 0)
+	this.Scan(lo, hi, false, func(entry indexEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+// Scan calls f for the entries of Range(lo, hi), in order, until f returns false. In reverse, the entries are
+// visited in reverse order of their values, but entries with the same value are still visited in order of key,
+// like the results of a descending sort order.
+func (this *index) Scan(lo, hi []byte, reverse bool, f func(indexEntry) bool) {
+	if !reverse {
+		c, i := this.position(func(entry indexEntry) bool {
+			return bytes.Compare(entry.value, lo) >= 0
+		})
+		for ; c < len(this.chunks); c, i = c+1, 0 {
+			for _, entry := range this.chunks[c][i:] {
+				if hi != nil && bytes.Compare(entry.value, hi) >= 0 {
+					return
+				}
+				if !f(entry) {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	c, i := len(this.chunks), 0
+	if hi != nil {
+		c, i = this.position(func(entry indexEntry) bool {
+			return bytes.Compare(entry.value, hi) >= 0
+		})
+	}
+	// The entries with the same value are collected backwards, and visited once an entry with a smaller value
+	// is reached
+	var same []indexEntry
+	visit := func() bool {
+		for j := len(same) - 1; j >= 0; j-- {
+			if !f(same[j]) {
+				return false
+			}
+		}
+		same = same[:0]
+		return true
+	}
+	for {
+		if i == 0 {
+			if c == 0 {
+				break
+			}
+			c, i = c-1, len(this.chunks[c-1])
+		}
+		i--
+		entry := this.chunks[c][i]
+		if bytes.Compare(entry.value, lo) < 0 {
+			break
+		}
+		if len(same) > 0 && !bytes.Equal(same[0].value, entry.value) && !visit() {
+			return
+		}
+		same = append(same, entry)
+	}
+	visit()
+}
+
+func compareIndexEntries(a, b indexEntry) int {
+	if d := bytes.Compare(a.value, b.value); d != 0 {
+		return d
+	}
+	switch {
+	case a.dictKey < b.dictKey:
+		return -1
+	case a.dictKey > b.dictKey:
+		return 1
+	}
+	return 0
+}
+
+// byDictKey sorts entries by the encoded keys of their entities
+type byDictKey []indexEntry
+
+func (this byDictKey) Len() int           { return len(this) }
+func (this byDictKey) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
+func (this byDictKey) Less(i, j int) bool { return this[i].dictKey < this[j].dictKey }
+
+// indexedValues returns the values of the indexed property with the given name
+func indexedValues(e *pb.EntityProto, name string) []*pb.PropertyValue {
+	var values []*pb.PropertyValue
+	for _, p := range e.GetProperty() {
+		if p.GetName() == name {
+			values = append(values, p.GetValue())
+		}
+	}
+	return values
+}
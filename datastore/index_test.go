@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"appengine/datastore"
+	pb "appengine_internal/datastore"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"math"
+	"testing"
+)
+
+func TestEncodeValue(t *testing.T) {
+	// Values in ascending order
+	values := []*pb.PropertyValue{
+		nil,
+		&pb.PropertyValue{Int64Value: proto.Int64(math.MinInt64)},
+		&pb.PropertyValue{Int64Value: proto.Int64(-1)},
+		&pb.PropertyValue{Int64Value: proto.Int64(0)},
+		&pb.PropertyValue{Int64Value: proto.Int64(1)},
+		&pb.PropertyValue{Int64Value: proto.Int64(math.MaxInt64)},
+		&pb.PropertyValue{BooleanValue: proto.Bool(false)},
+		&pb.PropertyValue{BooleanValue: proto.Bool(true)},
+		&pb.PropertyValue{StringValue: proto.String("")},
+		&pb.PropertyValue{StringValue: proto.String("\x00")},
+		&pb.PropertyValue{StringValue: proto.String("\x00\x00")},
+		&pb.PropertyValue{StringValue: proto.String("\x01")},
+		&pb.PropertyValue{StringValue: proto.String("a")},
+		&pb.PropertyValue{StringValue: proto.String("a\x00")},
+		&pb.PropertyValue{StringValue: proto.String("ab")},
+		&pb.PropertyValue{StringValue: proto.String("b")},
+		&pb.PropertyValue{StringValue: proto.String("\xff")},
+		&pb.PropertyValue{DoubleValue: proto.Float64(math.Inf(-1))},
+		&pb.PropertyValue{DoubleValue: proto.Float64(-1.5)},
+		&pb.PropertyValue{DoubleValue: proto.Float64(0)},
+		&pb.PropertyValue{DoubleValue: proto.Float64(0.5)},
+		&pb.PropertyValue{DoubleValue: proto.Float64(math.Inf(1))},
+		&pb.PropertyValue{Referencevalue: &pb.PropertyValue_ReferenceValue{
+			Pathelement: []*pb.PropertyValue_ReferenceValue_PathElement{
+				&pb.PropertyValue_ReferenceValue_PathElement{Type: proto.String("A"), Id: proto.Int64(1)},
+			},
+		}},
+		&pb.PropertyValue{Referencevalue: &pb.PropertyValue_ReferenceValue{
+			Pathelement: []*pb.PropertyValue_ReferenceValue_PathElement{
+				&pb.PropertyValue_ReferenceValue_PathElement{Type: proto.String("A"), Id: proto.Int64(1)},
+				&pb.PropertyValue_ReferenceValue_PathElement{Type: proto.String("B"), Id: proto.Int64(1)},
+			},
+		}},
+		&pb.PropertyValue{Referencevalue: &pb.PropertyValue_ReferenceValue{
+			Pathelement: []*pb.PropertyValue_ReferenceValue_PathElement{
+				&pb.PropertyValue_ReferenceValue_PathElement{Type: proto.String("A"), Name: proto.String("a")},
+			},
+		}},
+	}
+	for i := range values {
+		for j := range values {
+			a, b := encodeValue(nil, values[i]), encodeValue(nil, values[j])
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if d := bytes.Compare(a, b); d != want {
+				t.Errorf("Encoding of %v compared to encoding of %v was %d, want %d", values[i], values[j], d, want)
+			}
+			// Inverted encodings sort in reverse order
+			if d := bytes.Compare(invert(a), invert(b)); d != -want {
+				t.Errorf("Inverted encoding of %v compared to inverted encoding of %v was %d, want %d", values[i], values[j], d, -want)
+			}
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	entity := func(id int64, values ...int64) *pb.EntityProto {
+		e := &pb.EntityProto{
+			Key: &pb.Reference{
+				App:  proto.String("dev~aeunit"),
+				Path: &pb.Path{Element: []*pb.Path_Element{&pb.Path_Element{Type: proto.String("Kind"), Id: proto.Int64(id)}}},
+			},
+		}
+		for _, v := range values {
+			e.Property = append(e.Property, &pb.Property{
+				Name:     proto.String("Prop"),
+				Value:    &pb.PropertyValue{Int64Value: proto.Int64(v)},
+				Multiple: proto.Bool(len(values) > 1),
+			})
+		}
+		return e
+	}
+	idx := newIndex([]indexProperty{indexProperty{name: "Prop", desc: true}})
+	// Enough entries to be split over several chunks
+	n := int64(2000)
+	for id := n; id > 0; id-- {
+		idx.Add(entity(id, id%10, id%10+100), getDictKey(entity(id).Key))
+	}
+	idx.Add(entity(n+1), getDictKey(entity(n+1).Key)) // no values: not indexed
+	if l := idx.Len(); l != int(2*n) {
+		t.Errorf("Index had %d entries, want %d", l, 2*n)
+	}
+	for i, c := range idx.chunks {
+		if len(c) > indexChunkSize {
+			t.Errorf("Chunk %d had %d entries, want at most %d", i, len(c), indexChunkSize)
+		}
+	}
+	entries := idx.Range(nil, nil)
+	for i := 1; i < len(entries); i++ {
+		if compareIndexEntries(entries[i-1], entries[i]) >= 0 {
+			t.Errorf("Entries %d and %d were not in order", i-1, i)
+		}
+	}
+
+	// Descending: the entries for value 5 come after the entries for 6
+	enc := invert(encodeValue(nil, &pb.PropertyValue{Int64Value: proto.Int64(5)}))
+	if got := idx.Range(enc, prefixEnd(enc)); len(got) != int(n/10) {
+		t.Errorf("Range for value 5 returned %d entries, want %d", len(got), n/10)
+	} else if after := idx.Range(prefixEnd(enc), nil); len(after) != int(5*n/10) {
+		t.Errorf("Range after value 5 returned %d entries, want %d", len(after), 5*n/10)
+	}
+
+	// In reverse, values are visited from largest to smallest, and entries with the same value by key
+	var reversed []indexEntry
+	idx.Scan(nil, nil, true, func(entry indexEntry) bool {
+		reversed = append(reversed, entry)
+		return len(reversed) < int(n/10)+1
+	})
+	if len(reversed) != int(n/10)+1 {
+		t.Errorf("Reverse scan visited %d entries after being stopped, want %d", len(reversed), n/10+1)
+	}
+	for i := 1; i < len(reversed); i++ {
+		d := bytes.Compare(reversed[i-1].value, reversed[i].value)
+		if d < 0 || (d == 0 && reversed[i-1].dictKey >= reversed[i].dictKey) {
+			t.Errorf("Reversed entries %d and %d were not in order", i-1, i)
+		}
+	}
+
+	for id := int64(1); id <= n; id += 2 {
+		idx.Remove(entity(id, id%10, id%10+100), getDictKey(entity(id).Key))
+	}
+	if l := idx.Len(); l != int(n) {
+		t.Errorf("Index had %d entries after removing half the entities, want %d", l, n)
+	}
+	for _, entry := range idx.Range(nil, nil) {
+		if entry.key.GetPath().GetElement()[0].GetId()%2 != 0 {
+			t.Errorf("Entry for removed entity %v was still in the index", entry.key)
+			break
+		}
+	}
+}
+
+func TestEncodeKey(t *testing.T) {
+	c := newContext()
+	g1 := datastore.NewKey(c, "Kind", "", 1, nil)
+	g1c1 := datastore.NewKey(c, "Child", "a", 0, g1)
+	g1c1gc := datastore.NewKey(c, "Kind", "", 5, g1c1)
+	// Keys in ascending order
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "A", "", 1, nil),
+		datastore.NewKey(c, "A", "", 2, nil),
+		datastore.NewKey(c, "A", "\x00", 0, nil),
+		datastore.NewKey(c, "A", "a", 0, nil),
+		datastore.NewKey(c, "AA", "", 1, nil),
+		g1,
+		g1c1,
+		g1c1gc,
+		datastore.NewKey(c, "Kind", "", 1, g1c1gc),
+		datastore.NewKey(c, "Kind", "", 2, g1c1),
+		datastore.NewKey(c, "Kind", "", 2, g1),
+		datastore.NewKey(c, "Kind", "", 2, nil),
+	}
+	for i := range keys {
+		for j := range keys {
+			r1, r2 := keyToProto("", keys[i]), keyToProto("", keys[j])
+			want := compareProtoRef(r1, r2)
+			if d := bytes.Compare(encodeKey(r1), encodeKey(r2)); d != want {
+				t.Errorf("Encoding of %v compared to encoding of %v was %d, want %d", keys[i], keys[j], d, want)
+			}
+		}
+	}
+
+	// The encodings of descendants start with the encoded ancestor
+	prefix := encodeAncestor(keyToProto("", g1c1))
+	for _, k := range keys {
+		isDescendant := k.Equal(g1c1) || k.Parent() != nil && (k.Parent().Equal(g1c1) || k.Parent().Parent() != nil && k.Parent().Parent().Equal(g1c1))
+		if hasPrefix := bytes.HasPrefix(encodeKey(keyToProto("", k)), prefix); hasPrefix != isDescendant {
+			t.Errorf("Encoding of %v started with the encoding of ancestor %v: %v, want %v", k, g1c1, hasPrefix, isDescendant)
+		}
+	}
+}
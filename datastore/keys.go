@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"strings"
+)
+
+// SetAppID makes the datastore reject keys of other apps than appID, like production does. By default keys of
+// any app are accepted, as long as all keys in a request are of the same app.
+func (this *InMemoryDatastore) SetAppID(appID string) {
+	this.appID = appID
+}
+
+// checkKey returns a BAD_REQUEST error if the key is invalid. Only the last path element may be incomplete, and
+// only if allowIncomplete is true. appID is the app of the request, and is set to the key's app if it is empty.
+func (this *InMemoryDatastore) checkKey(key *pb.Reference, appID *string, allowIncomplete bool) error {
+	el := key.GetPath().GetElement()
+	if len(el) == 0 {
+		return apiError(pb.Error_BAD_REQUEST, "key's path cannot be empty")
+	}
+	if *appID == "" {
+		*appID = this.appID
+	}
+	if *appID == "" {
+		*appID = key.GetApp()
+	}
+	if key.GetApp() != *appID {
+		return apiError(pb.Error_BAD_REQUEST, "app %q cannot access app %q's data", *appID, key.GetApp())
+	}
+	for i, e := range el {
+		if e.GetType() == "" {
+			return apiError(pb.Error_BAD_REQUEST, "the key kind cannot be empty")
+		}
+		if strings.HasPrefix(e.GetType(), "__") {
+			return apiError(pb.Error_BAD_REQUEST, "illegal key.path.element.type: %s", e.GetType())
+		}
+		if e.Id != nil && e.Name != nil {
+			return apiError(pb.Error_BAD_REQUEST, "each key path element should have id or name but not both: %v", key)
+		}
+		if e.GetId() == 0 && e.GetName() == "" && (i < len(el)-1 || !allowIncomplete) {
+			return apiError(pb.Error_BAD_REQUEST, "missing key id/name")
+		}
+	}
+	return nil
+}
+
+// checkKeys checks all keys of a request, see checkKey
+func (this *InMemoryDatastore) checkKeys(keys []*pb.Reference, allowIncomplete bool) error {
+	appID := ""
+	for _, key := range keys {
+		if err := this.checkKey(key, &appID, allowIncomplete); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"testing"
+)
+
+func TestDatastoreKeyValidation(t *testing.T) {
+	el := func(kind, name string, id int64) *pb.Path_Element {
+		e := &pb.Path_Element{Type: proto.String(kind)}
+		if name != "" {
+			e.Name = proto.String(name)
+		}
+		if id != 0 {
+			e.Id = proto.Int64(id)
+		}
+		return e
+	}
+	key := func(app string, path ...*pb.Path_Element) *pb.Reference {
+		return &pb.Reference{App: proto.String(app), Path: &pb.Path{Element: path}}
+	}
+	valid := key("dev~aeunit", el("Kind", "", 1))
+	incomplete := key("dev~aeunit", el("Kind", "", 0))
+
+	isBadRequest := func(err error) bool {
+		apiErr, ok := err.(*appengine_internal.APIError)
+		return ok && apiErr.Code == int32(pb.Error_BAD_REQUEST)
+	}
+	put := func(ds *InMemoryDatastore, keys ...*pb.Reference) error {
+		req := &pb.PutRequest{}
+		for _, k := range keys {
+			req.Entity = append(req.Entity, &pb.EntityProto{Key: k, EntityGroup: &pb.Path{}})
+		}
+		return ds.PutMulti(req, &pb.PutResponse{})
+	}
+	get := func(ds *InMemoryDatastore, keys ...*pb.Reference) error {
+		return ds.GetMulti(&pb.GetRequest{Key: keys}, &pb.GetResponse{})
+	}
+	del := func(ds *InMemoryDatastore, keys ...*pb.Reference) error {
+		return ds.DeleteMulti(&pb.DeleteRequest{Key: keys}, &pb.DeleteResponse{})
+	}
+
+	tests := []struct {
+		name     string
+		keys     []*pb.Reference
+		putOK    bool
+		getDelOK bool
+	}{
+		{"Valid key", []*pb.Reference{valid}, true, true},
+		{"Incomplete key", []*pb.Reference{incomplete}, true, false},
+		{"Empty path", []*pb.Reference{key("dev~aeunit")}, false, false},
+		{"Empty kind", []*pb.Reference{key("dev~aeunit", el("", "", 1))}, false, false},
+		{"Reserved kind", []*pb.Reference{key("dev~aeunit", el("__Stat_Total__", "", 1))}, false, false},
+		{"Reserved kind of parent", []*pb.Reference{key("dev~aeunit", el("__Stat_Total__", "", 1), el("Kind", "", 1))}, false, false},
+		{"Both name and ID", []*pb.Reference{key("dev~aeunit", &pb.Path_Element{Type: proto.String("Kind"), Id: proto.Int64(1), Name: proto.String("a")})}, false, false},
+		{"Incomplete parent", []*pb.Reference{key("dev~aeunit", el("Parent", "", 0), el("Kind", "", 1))}, false, false},
+		{"Mismatched apps", []*pb.Reference{valid, key("s~other", el("Kind", "", 1))}, false, false},
+	}
+	for _, test := range tests {
+		ds := New()
+		if err := put(ds, test.keys...); test.putOK && err != nil {
+			t.Errorf("%s: Put returned error %v", test.name, err)
+		} else if !test.putOK && !isBadRequest(err) {
+			t.Errorf("%s: Put returned %v, want a BAD_REQUEST error", test.name, err)
+		}
+		for method, call := range map[string]func(*InMemoryDatastore, ...*pb.Reference) error{"Get": get, "Delete": del} {
+			if err := call(ds, test.keys...); test.getDelOK && err != nil {
+				t.Errorf("%s: %s returned error %v", test.name, method, err)
+			} else if !test.getDelOK && !isBadRequest(err) {
+				t.Errorf("%s: %s returned %v, want a BAD_REQUEST error", test.name, method, err)
+			}
+		}
+	}
+
+	// The app ID of the datastore
+	ds := New()
+	ds.SetAppID("s~other")
+	if err := put(ds, valid); !isBadRequest(err) {
+		t.Errorf("Put of key of another app returned %v, want a BAD_REQUEST error", err)
+	}
+	if err := put(ds, key("s~other", el("Kind", "", 1))); err != nil {
+		t.Errorf("Put of key of the datastore's app returned error %v", err)
+	}
+}
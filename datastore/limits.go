@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Limits of the production datastore
+const (
+	maxEntitySize          = 1 << 20 // bytes, of the serialized entity
+	maxIndexedStringLength = 1500    // bytes
+	maxIndexEntries        = 20000   // per entity
+	maxWriteBatchSize      = 500     // entities or keys in a put or delete
+	maxGetBatchSize        = 1000    // keys in a get
+)
+
+// checkPutRequest checks a put of entities with the given keys. Like the checks of gets and deletes, it returns the
+// error of the first problem production finds: with the number of keys, then with the keys, then with the entities.
+func (this *InMemoryDatastore) checkPutRequest(req *pb.PutRequest, keys []*pb.Reference) error {
+	if len(req.Entity) > maxWriteBatchSize {
+		return apiError(pb.Error_BAD_REQUEST, "cannot write more than %d entities in a single call", maxWriteBatchSize)
+	}
+	if err := this.checkKeys(keys, true); err != nil {
+		return err
+	}
+	for _, e := range req.Entity {
+		if err := this.checkEntity(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEntity returns a BAD_REQUEST error if the entity exceeds the size, indexed string length or index entry limits
+func (this *InMemoryDatastore) checkEntity(e *pb.EntityProto) error {
+	if proto.Size(e) > maxEntitySize {
+		return apiError(pb.Error_BAD_REQUEST, "entity is too big")
+	}
+	for _, p := range e.Property {
+		if v := p.GetValue(); v.StringValue != nil && len(v.GetStringValue()) > maxIndexedStringLength {
+			return apiError(pb.Error_BAD_REQUEST, "Property %s is too long. Maximum length is %d.", p.GetName(), maxIndexedStringLength)
+		}
+	}
+	if n := this.indexEntryCount(e); n > maxIndexEntries {
+		return apiError(pb.Error_BAD_REQUEST, "Too many indexed properties")
+	}
+	return nil
+}
+
+func (this *InMemoryDatastore) checkGetRequest(req *pb.GetRequest) error {
+	if len(req.Key) > maxGetBatchSize {
+		return apiError(pb.Error_BAD_REQUEST, "cannot get more than %d keys in a single call", maxGetBatchSize)
+	}
+	return this.checkKeys(req.Key, false)
+}
+
+func (this *InMemoryDatastore) checkDeleteRequest(req *pb.DeleteRequest) error {
+	if len(req.Key) > maxWriteBatchSize {
+		return apiError(pb.Error_BAD_REQUEST, "cannot write more than %d entities in a single call", maxWriteBatchSize)
+	}
+	return this.checkKeys(req.Key, false)
+}
+
+// indexEntryCount returns the number of index entries of the entity: one for every indexed value in both the
+// ascending and descending built-in indexes, and the entries of the composite indexes of its kind
+func (this *InMemoryDatastore) indexEntryCount(e *pb.EntityProto) int {
+	n := 2 * len(e.Property)
+	for _, def := range this.entities.composite[entityProtoKind(e)] {
+		// An entry for every combination of the values of the index' properties
+		entries := 1
+		for _, p := range def.GetProperty() {
+			entries *= len(indexedValues(e, p.GetName()))
+			if entries > maxIndexEntries {
+				break
+			}
+		}
+		n += entries
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"strings"
+	"testing"
+)
+
+func TestDatastoreLimits(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+
+	isBadRequest := func(err error) bool {
+		apiErr, ok := err.(*appengine_internal.APIError)
+		return ok && apiErr.Service == "datastore_v3" && apiErr.Code == int32(pb.Error_BAD_REQUEST)
+	}
+
+	type Doc struct {
+		Title string
+		Body  string `datastore:",noindex"`
+		Tags  []int64
+	}
+	key := datastore.NewKey(c, "Doc", "", 1, nil)
+
+	tests := []struct {
+		name string
+		doc  Doc
+		ok   bool
+	}{
+		{"Indexed string of 1500 bytes", Doc{Title: strings.Repeat("a", 1500)}, true},
+		{"Indexed string over 1500 bytes", Doc{Title: strings.Repeat("a", 1501)}, false},
+		{"Unindexed string over 1500 bytes", Doc{Body: strings.Repeat("a", 1501)}, true},
+		{"Entity over 1MiB", Doc{Body: strings.Repeat("a", 1<<20)}, false},
+		// Every indexed value has an entry in the ascending and the descending built-in index
+		{"20000 index entries", Doc{Tags: make([]int64, 9999)}, true},
+		{"Over 20000 index entries", Doc{Tags: make([]int64, 10000)}, false},
+	}
+	for _, test := range tests {
+		_, err := datastore.Put(c, key, &test.doc)
+		if test.ok && err != nil {
+			t.Errorf("%s: Put returned error %v", test.name, err)
+		} else if !test.ok && !isBadRequest(err) {
+			t.Errorf("%s: Put returned %v, want a BAD_REQUEST error", test.name, err)
+		}
+	}
+
+	// Entries of composite indexes count towards the limit
+	PanicIfErr(datastore.Delete(c, key))
+	ds.AddIndex(&pb.Index{
+		EntityType: proto.String("Doc"),
+		Ancestor:   proto.Bool(false),
+		Property: []*pb.Index_Property{
+			&pb.Index_Property{Name: proto.String("Tags")},
+			&pb.Index_Property{Name: proto.String("Tags"), Direction: pb.Index_Property_DESCENDING.Enum()},
+		},
+	})
+	if _, err := datastore.Put(c, key, &Doc{Tags: make([]int64, 150)}); !isBadRequest(err) {
+		t.Errorf("Exploding index: Put returned %v, want a BAD_REQUEST error", err)
+	}
+
+	// Batch sizes
+	keys, objs := keysAndObjs(c, "Kind", 501)
+	if _, err := datastore.PutMulti(c, keys, objs); !isBadRequest(err) {
+		t.Errorf("PutMulti of 501 entities returned %v, want a BAD_REQUEST error", err)
+	}
+	if err := datastore.DeleteMulti(c, keys); !isBadRequest(err) {
+		t.Errorf("DeleteMulti of 501 keys returned %v, want a BAD_REQUEST error", err)
+	}
+	_, err := datastore.PutMulti(c, keys[:500], objs[:500])
+	PanicIfErr(err)
+	keys, _ = keysAndObjs(c, "Kind", 1001)
+	if err := datastore.GetMulti(c, keys, make([]Thing, len(keys))); !isBadRequest(err) {
+		t.Errorf("GetMulti of 1001 keys returned %v, want a BAD_REQUEST error", err)
+	}
+	if err := datastore.GetMulti(c, keys[:1000], make([]Thing, 1000)); err != nil {
+		if _, ok := err.(appengine.MultiError); !ok {
+			t.Errorf("GetMulti of 1000 keys returned error %v", err)
+		}
+	}
+
+	// The number of keys is checked before the keys, and the keys before the entities, in every request
+	badKey := &pb.Reference{App: proto.String(c.FullyQualifiedAppID()), Path: &pb.Path{}}
+	tooManyKeys := make([]*pb.Reference, 1001)
+	tooManyEntities := make([]*pb.EntityProto, 501)
+	for i := range tooManyKeys {
+		tooManyKeys[i] = badKey
+	}
+	for i := range tooManyEntities {
+		tooManyEntities[i] = &pb.EntityProto{Key: badKey, EntityGroup: &pb.Path{}}
+	}
+	tooBig := &pb.EntityProto{Key: badKey, EntityGroup: &pb.Path{}, RawProperty: []*pb.Property{
+		&pb.Property{Name: proto.String("Body"), Value: &pb.PropertyValue{StringValue: proto.String(strings.Repeat("a", 1<<20))}, Multiple: proto.Bool(false)},
+	}}
+	checks := []struct {
+		name, want string
+		err        error
+	}{
+		{"Put", "cannot write more than", ds.PutMulti(&pb.PutRequest{Entity: tooManyEntities}, &pb.PutResponse{})},
+		{"Get", "cannot get more than", ds.GetMulti(&pb.GetRequest{Key: tooManyKeys}, &pb.GetResponse{})},
+		{"Delete", "cannot write more than", ds.DeleteMulti(&pb.DeleteRequest{Key: tooManyKeys[:501]}, &pb.DeleteResponse{})},
+		{"Put of a large entity", "path cannot be empty", ds.PutMulti(&pb.PutRequest{Entity: []*pb.EntityProto{tooBig}}, &pb.PutResponse{})},
+	}
+	for _, check := range checks {
+		if apiErr, ok := check.err.(*appengine_internal.APIError); !ok || !strings.Contains(apiErr.Detail, check.want) {
+			t.Errorf("%s with an invalid key returned %v, want an error with %q", check.name, check.err, check.want)
+		}
+	}
+}
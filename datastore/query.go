@@ -1,327 +1,700 @@
-package datastore
-
-import (
-	pb "appengine_internal/datastore"
-	"fmt"
-	"sort"
-)
-
-func (this *InMemoryDatastore) RunQuery(q *pb.Query, res *pb.QueryResult) error {
-
-	if err := nonsupported(q); err != "" {
-		return fmt.Errorf("aeunit datastore: internal error. Not implemented logic for %s", err)
-	}
-
-	kind := q.GetKind()
-	es := make([]*pb.EntityProto, 0)
-	for _, de := range this.entities.Entities() {
-		if entityProtoKind(de.Obj) == kind {
-			es = append(es, de.Obj)
-		}
-	}
-	s := newSortableEntities(es, q.GetOrder())
-	s.Filter(q.GetFilter())
-	s.Ancestor(q.Ancestor)
-	s.SortableBy(q.GetOrder())
-	sort.Sort(s)
-	s.CursorOffset(q.CompiledCursor)
-	s.Offset(q.Offset)
-	s.Limit(q.Limit)
-	res.Result = s.protos
-
-	// RunQuery returns all results, always
-	f := false
-	res.MoreResults = &f
-
-	// We need to calculate the cursor before we limit the result
-	res.CompiledCursor = &pb.CompiledCursor{}
-	if s.cursor != nil {
-		res.CompiledCursor.Position = &pb.CompiledCursor_Position{
-			Key: s.cursor.GetKey(),
-		}
-	}
-
-	return nil
-}
-
-func (this *InMemoryDatastore) Next(req *pb.NextRequest, res *pb.QueryResult) error {
-	panic("aeunit datastore: Next is not implemented. RunQuery returns all results")
-	return nil
-}
-
-type sortableEntities struct {
-	cursor *pb.EntityProto
-	protos []*pb.EntityProto
-	compFn comparer
-}
-
-type comparer func(a, b *pb.EntityProto) int
-
-func newSortableEntities(p []*pb.EntityProto, order []*pb.Query_Order) *sortableEntities {
-	return &sortableEntities{
-		protos: p,
-		compFn: getCompFn(order),
-	}
-}
-
-func getProperty(e *pb.EntityProto, name string) []*pb.Property {
-	props := e.GetProperty()
-	if len(props) == 0 {
-		props = e.GetRawProperty()
-	}
-	var ps []*pb.Property
-	for _, prop := range props {
-		if prop.GetName() == name {
-			ps = append(ps, prop)
-		}
-	}
-	return ps
-}
-
-func getPropValue(e *pb.EntityProto, name string) *pb.PropertyValue {
-	props := getProperty(e, name)
-	if len(props) == 0 {
-		return nil
-	} else {
-		return props[0].GetValue()
-	}
-}
-
-func getPropValues(e *pb.EntityProto, name string) []*pb.PropertyValue {
-	props := getProperty(e, name)
-	var values []*pb.PropertyValue
-	for _, p := range props {
-		values = append(values, p.GetValue())
-	}
-	return values
-}
-
-func getCompFn(order []*pb.Query_Order) comparer {
-	if order == nil {
-		return func(a, b *pb.EntityProto) int {
-			return compareProtoRef(a.GetKey(), b.GetKey())
-		}
-	} else {
-		if len(order) > 1 {
-			panic("aeunit datastore: Ordering on multiple fields is not supported")
-		}
-		return func(a, b *pb.EntityProto) int {
-			pn := order[0].GetProperty()
-			asc := order[0].GetDirection() == pb.Query_Order_ASCENDING
-			p1 := getPropValue(a, pn)
-			p2 := getPropValue(b, pn)
-			d, valid := comparePropertyValue(p1, p2)
-			if !valid {
-				panic("aeunit datastore: internal error. Invalid entity. Didn't have required property for comparing")
-			}
-			if !asc {
-				d = d * -1
-			}
-			return d
-		}
-	}
-}
-
-func (this *sortableEntities) Len() int { return len(this.protos) }
-
-func (this *sortableEntities) Swap(i, j int) {
-	this.protos[i], this.protos[j] = this.protos[j], this.protos[i]
-}
-func (this *sortableEntities) Less(i, j int) bool {
-	return -1 == this.compFn(this.protos[i], this.protos[j])
-}
-
-func (this *sortableEntities) Limit(l *int32) {
-	if l != nil {
-		lim := *l
-		if int32(len(this.protos)) > lim {
-			this.protos = this.protos[:lim]
-		}
-	}
-	n := len(this.protos)
-	if n > 0 {
-		this.cursor = this.protos[n-1]
-	}
-}
-
-func (this *sortableEntities) Offset(o *int32) {
-	if o != nil {
-		off := *o
-		if off > 0 && int32(len(this.protos)) >= off {
-			if i := off - 1; i >= 0 {
-				this.cursor = this.protos[i]
-			}
-			this.protos = this.protos[off:]
-		}
-	}
-}
-
-func (this *sortableEntities) CursorOffset(c *pb.CompiledCursor) {
-	if c != nil && c.Position != nil && c.Position.Key != nil {
-		for i, ep := range this.protos {
-			if compareProtoRef(ep.Key, c.Position.Key) == 0 {
-				this.cursor = this.protos[i]
-				// the provided cursor is non inclusive, so we skip over the element with that key
-				this.protos = this.protos[i+1:]
-			}
-		}
-	}
-}
-
-func (this *sortableEntities) SortableBy(order []*pb.Query_Order) {
-	if len(order) == 0 {
-		return
-	}
-	sortable := make([]*pb.EntityProto, 0, len(this.protos))
-	for _, ep := range this.protos {
-		hasAllProps := true
-		for _, o := range order {
-			props := getProperty(ep, o.GetProperty())
-			hasAllProps = hasAllProps && len(props) > 0
-			if !hasAllProps {
-				break
-			}
-		}
-		if hasAllProps {
-			sortable = append(sortable, ep)
-		}
-	}
-	this.protos = sortable
-}
-
-func anyValueMatches(values []*pb.PropertyValue, filters []*pb.Query_Filter, matchOnAllFilters bool) bool {
-	if len(values) == 0 {
-		return false
-	}
-	for _, filter := range filters {
-		var ok bool
-		want := filter.GetProperty()[0].GetValue()
-		for _, val := range values {
-			d, valid := comparePropertyValue(val, want)
-			if !valid {
-				if matchOnAllFilters {
-					return false
-				} else {
-					continue
-				}
-			}
-			switch filter.GetOp() {
-			case pb.Query_Filter_EQUAL:
-				ok = d == 0
-			case pb.Query_Filter_LESS_THAN:
-				ok = d < 0
-			case pb.Query_Filter_GREATER_THAN:
-				ok = d > 0
-			case pb.Query_Filter_LESS_THAN_OR_EQUAL:
-				ok = d <= 0
-			case pb.Query_Filter_GREATER_THAN_OR_EQUAL:
-				ok = d >= 0
-			default:
-				panic("aeunit datastore: Unsupported query filter operation: " + filter.GetOp().String())
-			}
-			if ok {
-				// We found a match. No need to search through the rest of the values for a match
-				break
-			}
-		}
-		if ok && !matchOnAllFilters {
-			// if we only need to match on one (any) filter and we already did, return true now
-			return true
-		}
-		if !ok && matchOnAllFilters {
-			// if we need to match on all filters, and this filter did not have a match, the match has failed
-			return false
-		}
-	}
-	return matchOnAllFilters
-}
-
-func (this *sortableEntities) Filter(filters []*pb.Query_Filter) {
-	if len(filters) == 0 {
-		return
-	}
-
-	any := make(map[string]bool)
-	filtersPerProp := make(map[string][]*pb.Query_Filter)
-	for _, filter := range filters {
-		propName := filter.GetProperty()[0].GetName()
-		filtersPerProp[propName] = append(filtersPerProp[propName], filter)
-	}
-	for propName, filters := range filtersPerProp {
-		i := 0
-		allEq := true
-		for _, filter := range filters {
-			if filter.GetOp() != pb.Query_Filter_EQUAL {
-				allEq = false
-				break
-			} else {
-				i++
-			}
-		}
-		if i >= 2 && allEq {
-			any[propName] = true
-		}
-	}
-
-	filtered := make([]*pb.EntityProto, 0, len(this.protos))
-	for _, entity := range this.protos {
-		ok := true
-		for propName, filters := range filtersPerProp {
-			props := getProperty(entity, propName)
-			multi := len(props) > 0 && props[0].GetMultiple()
-			any := multi && any[propName]
-			values := getPropValues(entity, propName)
-			if ok = anyValueMatches(values, filters, !any); !ok {
-				break
-			}
-		}
-		if ok {
-			filtered = append(filtered, entity)
-		}
-	}
-	this.protos = filtered
-}
-
-func (this *sortableEntities) Ancestor(ref *pb.Reference) {
-	if ref == nil {
-		return
-	}
-	filtered := make([]*pb.EntityProto, 0, len(this.protos))
-	for _, ep := range this.protos {
-		if ep.EntityGroup == nil {
-			continue
-		}
-		match := true
-		for i, el := range ref.Path.Element {
-			if len(ep.Key.Path.Element) <= i {
-				match = false
-				break
-			} else {
-				match = 0 == compareProtoRefPathElem(el, ep.Key.Path.Element[i])
-				if !match {
-					break
-				}
-			}
-		}
-		if match {
-			filtered = append(filtered, ep)
-		}
-	}
-	this.protos = filtered
-}
-
-func entityProtoKind(e *pb.EntityProto) string {
-	return e.GetKey().GetPath().GetElement()[0].GetType()
-}
-
-func nonsupported(q *pb.Query) string {
-	switch {
-	case q.EndCompiledCursor != nil:
-		return "End()"
-	case len(q.PropertyName) > 0:
-		return "Project()"
-	case len(q.GroupByPropertyName) > 0, q.Distinct != nil:
-		return "Distinct()"
-	}
-	return ""
-}
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"sort"
+)
+
+func (this *InMemoryDatastore) RunQuery(q *pb.Query, res *pb.QueryResult) error {
+
+	if err := nonsupported(q); err != "" {
+		return apiError(pb.Error_INTERNAL_ERROR, "aeunit datastore: Not implemented logic for %s", err)
+	}
+	if err := checkQuery(q); err != nil {
+		return err
+	}
+
+	if q.Ancestor != nil {
+		appID := q.GetApp()
+		if err := this.checkKey(q.Ancestor, &appID, false); err != nil {
+			return err
+		}
+	}
+
+	s := newSortableEntities(q)
+	scan, ordered := this.candidates(q)
+	// Entities that are read in the order of the query are only read up to the last one the query returns
+	want := -1
+	if ordered && q.Limit != nil {
+		want = int(q.GetLimit())
+		if q.GetOffset() > 0 {
+			want += int(q.GetOffset())
+		}
+	}
+	if want != 0 {
+		scan(func(e *pb.EntityProto) bool {
+			if s.matches(e) && (!ordered || s.afterCursor(e, q.CompiledCursor)) {
+				s.protos = append(s.protos, e)
+			}
+			return want < 0 || len(s.protos) < want
+		})
+	}
+	if !ordered {
+		sort.Sort(s)
+	}
+	s.CursorOffset(q.CompiledCursor)
+	skipped := s.Offset(q.Offset)
+	s.Limit(q.Limit)
+	// A read for the query, and a read or a small op for every result. Skipped results are small ops.
+	this.ops.Reads++
+	if q.GetKeysOnly() {
+		this.ops.SmallOps += int64(len(s.protos))
+	} else {
+		this.ops.Reads += int64(len(s.protos))
+	}
+	this.ops.SmallOps += int64(skipped)
+	res.Result = make([]*pb.EntityProto, len(s.protos))
+	for i, e := range s.protos {
+		res.Result[i] = cloneEntity(e)
+	}
+
+	// RunQuery returns all results, always
+	f := false
+	res.MoreResults = &f
+	res.SkippedResults = &skipped
+
+	// The cursor points at the last entity that was returned or skipped over. If
+	// nothing was, it points at the position the query started from.
+	if q.GetCompile() {
+		res.CompiledCursor = &pb.CompiledCursor{Position: s.cursor}
+	}
+
+	return nil
+}
+
+// entityScan calls f for entities until f returns false
+type entityScan func(f func(*pb.EntityProto) bool)
+
+func noEntities(f func(*pb.EntityProto) bool) {}
+
+// scanIndex returns a scan of the entities of the index entries from lo to hi, without duplicates. An entity
+// is visited at its first entry.
+func scanIndex(ks *kindStore, idx *index, lo, hi []byte, reverse bool) entityScan {
+	return func(f func(*pb.EntityProto) bool) {
+		seen := make(map[string]bool)
+		idx.Scan(lo, hi, reverse, func(entry indexEntry) bool {
+			if seen[entry.dictKey] {
+				return true
+			}
+			seen[entry.dictKey] = true
+			return f(ks.entities[entry.dictKey].Obj)
+		})
+	}
+}
+
+// candidates returns a scan of the entities that may match the query, read from the indexes of the query's kind.
+// The filters of the query still have to be applied to them. If ordered is true, the entities are visited in the
+// order of the query. Scans in the order of the query start at the position of the query's cursor, so entities
+// with the same values as the position are visited, but the entities before them are not.
+func (this *InMemoryDatastore) candidates(q *pb.Query) (scan entityScan, ordered bool) {
+	// The encoded keys of an ancestor's descendants start with the encoded ancestor
+	var keyLo, keyHi []byte
+	if q.Ancestor != nil {
+		keyLo = encodeAncestor(q.Ancestor)
+		keyHi = prefixEnd(keyLo)
+	}
+	if q.Kind == nil {
+		// Kindless queries can only be ordered by key
+		stores := this.entities.Namespace(q.GetNameSpace())
+		return func(f func(*pb.EntityProto) bool) {
+			more := true
+			for _, ks := range stores {
+				scanIndex(ks, ks.byKey, keyLo, keyHi, false)(func(e *pb.EntityProto) bool {
+					more = f(e)
+					return more
+				})
+				if !more {
+					return
+				}
+			}
+		}, false
+	}
+	ks := this.entities.Kind(q.GetNameSpace(), q.GetKind())
+	if ks == nil {
+		return noEntities, true
+	}
+
+	filters := make(map[string][]*pb.Query_Filter)
+	var eqProps, ineqProps []string
+	for _, f := range q.GetFilter() {
+		name := f.GetProperty()[0].GetName()
+		if len(filters[name]) == 0 {
+			if f.GetOp() == pb.Query_Filter_EQUAL {
+				eqProps = append(eqProps, name)
+			} else {
+				ineqProps = append(ineqProps, name)
+			}
+		}
+		filters[name] = append(filters[name], f)
+	}
+	order := q.GetOrder()
+
+	// A composite index with the equality filters first, followed by the sort orders. An entity is visited at its
+	// smallest values for the sort orders, so it is only in the order of the query if none of them are filtered.
+	if q.Ancestor == nil {
+		for _, idx := range ks.composite {
+			if prefix, ok := compositePrefix(idx, eqProps, filters, order); ok {
+				ordered := true
+				for _, o := range order {
+					ordered = ordered && len(filters[o.GetProperty()]) == 0
+				}
+				lo := prefix
+				if ordered {
+					if start := cursorStart(q, idx.props[len(eqProps):]); start != nil {
+						lo = append(append([]byte{}, prefix...), start...)
+					}
+				}
+				return scanIndex(ks, idx, lo, prefixEnd(prefix), false), ordered
+			}
+		}
+	}
+
+	// The built-in index of the first sort order
+	if len(order) > 0 {
+		name := order[0].GetProperty()
+		idx := ks.builtin[name]
+		if idx == nil {
+			return noEntities, true
+		}
+		lo, hi := valueRange(filters[name])
+		desc := order[0].GetDirection() == pb.Query_Order_DESCENDING
+		// The index is in ascending order, so a descending scan starts at the end of the range
+		if start := cursorStart(q, []indexProperty{{name, false}}); start != nil {
+			if !desc && bytes.Compare(start, lo) > 0 {
+				lo = start
+			}
+			if end := prefixEnd(start); desc && end != nil && (hi == nil || bytes.Compare(end, hi) < 0) {
+				hi = end
+			}
+		}
+		return scanIndex(ks, idx, lo, hi, desc), len(order) == 1
+	}
+
+	// The key index, for the descendants of the ancestor
+	if q.Ancestor != nil {
+		return scanIndex(ks, ks.byKey, cursorKeyStart(q, keyLo), keyHi, false), true
+	}
+
+	// The built-in index of a filtered property
+	for _, name := range append(eqProps, ineqProps...) {
+		idx := ks.builtin[name]
+		if idx == nil {
+			return noEntities, true
+		}
+		lo, hi := valueRange(filters[name])
+		return scanIndex(ks, idx, lo, hi, false), false
+	}
+
+	return scanIndex(ks, ks.byKey, cursorKeyStart(q, nil), nil, false), true
+}
+
+// cursorStart returns the encoded values of the cursor position of the query for the properties of an index, or
+// nil if the query has no cursor. The entries of the entities at and after the position are not before them.
+// The values are encoded up to the first one that is not of the index's property.
+func cursorStart(q *pb.Query, props []indexProperty) []byte {
+	pos := q.GetCompiledCursor().GetPosition()
+	if pos == nil || pos.Key == nil {
+		return nil
+	}
+	var start []byte
+	for i, p := range props {
+		if i >= len(pos.Indexvalue) || pos.Indexvalue[i].GetProperty() != p.name {
+			break
+		}
+		enc := encodeValue(nil, pos.Indexvalue[i].GetValue())
+		if p.desc {
+			invert(enc)
+		}
+		start = append(start, enc...)
+	}
+	return start
+}
+
+// cursorKeyStart returns where a scan of the key index in key order starts: at the key of the query's cursor
+// position, if it is after lo
+func cursorKeyStart(q *pb.Query, lo []byte) []byte {
+	pos := q.GetCompiledCursor().GetPosition()
+	if pos == nil || pos.Key == nil {
+		return lo
+	}
+	if start := encodeKey(pos.Key); bytes.Compare(start, lo) > 0 {
+		return start
+	}
+	return lo
+}
+
+// compositePrefix returns the beginning of the entries of the composite index that match the equality filters
+// of a query, if the index can serve the query. The index must have a property for every equality filter,
+// followed by the sort orders of the query.
+func compositePrefix(idx *index, eqProps []string, filters map[string][]*pb.Query_Filter, order []*pb.Query_Order) ([]byte, bool) {
+	if len(idx.props) != len(eqProps)+len(order) {
+		return nil, false
+	}
+	if len(filters) != len(eqProps) {
+		// Inequality filters are applied to the entries, so they must be on the first sort order
+		for name := range filters {
+			if !isEqualityFilter(filters[name]) && (len(order) == 0 || order[0].GetProperty() != name) {
+				return nil, false
+			}
+		}
+	}
+	var prefix []byte
+	seen := make(map[string]bool)
+	for _, p := range idx.props[:len(eqProps)] {
+		fs := filters[p.name]
+		if !isEqualityFilter(fs) || len(fs) != 1 || seen[p.name] {
+			return nil, false
+		}
+		seen[p.name] = true
+		enc := encodeValue(nil, fs[0].GetProperty()[0].GetValue())
+		if p.desc {
+			invert(enc)
+		}
+		prefix = append(prefix, enc...)
+	}
+	for i, o := range order {
+		p := idx.props[len(eqProps)+i]
+		if p.name != o.GetProperty() || p.desc != (o.GetDirection() == pb.Query_Order_DESCENDING) {
+			return nil, false
+		}
+	}
+	return prefix, true
+}
+
+func isEqualityFilter(filters []*pb.Query_Filter) bool {
+	return len(filters) > 0 && filters[0].GetOp() == pb.Query_Filter_EQUAL
+}
+
+// indexFilters returns the filters on a property that limit the values of the entries of its built-in index that
+// can match: all of them, unless there are multiple equality filters, which match entities with any of the values
+func indexFilters(filters []*pb.Query_Filter) []*pb.Query_Filter {
+	eq := 0
+	for _, f := range filters {
+		if f.GetOp() == pb.Query_Filter_EQUAL {
+			eq++
+		}
+	}
+	if eq > 1 {
+		return nil
+	}
+	return filters
+}
+
+// valueRange returns the range of encoded values of the built-in index of a property that can match the
+// filters on it. Inequality filters only match values of the same type.
+func valueRange(filters []*pb.Query_Filter) (lo, hi []byte) {
+	lo = []byte{}
+	raise := func(b []byte) {
+		if bytes.Compare(b, lo) > 0 {
+			lo = b
+		}
+	}
+	lower := func(b []byte) {
+		if hi == nil || bytes.Compare(b, hi) < 0 {
+			hi = b
+		}
+	}
+	for _, f := range indexFilters(filters) {
+		enc := encodeValue(nil, f.GetProperty()[0].GetValue())
+		switch f.GetOp() {
+		case pb.Query_Filter_EQUAL:
+			raise(enc)
+			lower(prefixEnd(enc))
+		case pb.Query_Filter_GREATER_THAN:
+			raise(prefixEnd(enc))
+			lower([]byte{enc[0] + 1})
+		case pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+			raise(enc)
+			lower([]byte{enc[0] + 1})
+		case pb.Query_Filter_LESS_THAN:
+			raise([]byte{enc[0]})
+			lower(enc)
+		case pb.Query_Filter_LESS_THAN_OR_EQUAL:
+			raise([]byte{enc[0]})
+			lower(prefixEnd(enc))
+		}
+	}
+	return lo, hi
+}
+
+// Next always returns an error: RunQuery returns all results, so there are no cursors to continue from
+func (this *InMemoryDatastore) Next(req *pb.NextRequest, res *pb.QueryResult) error {
+	return apiError(pb.Error_BAD_REQUEST, "Cursor %d not found", req.GetCursor().GetCursor())
+}
+
+// sortableEntities holds the results of a query, and sorts them in the order of the query
+type sortableEntities struct {
+	cursor   *pb.CompiledCursor_Position
+	protos   []*pb.EntityProto
+	order    []*pb.Query_Order
+	filters  map[string][]*pb.Query_Filter // by property name
+	any      map[string]bool               // properties with multiple equality filters, of which any can match
+	ancestor *pb.Reference
+	sortKeys map[*pb.EntityProto][][]byte
+}
+
+func newSortableEntities(q *pb.Query) *sortableEntities {
+	s := &sortableEntities{
+		protos:   make([]*pb.EntityProto, 0),
+		order:    q.GetOrder(),
+		filters:  make(map[string][]*pb.Query_Filter),
+		any:      make(map[string]bool),
+		ancestor: q.Ancestor,
+		sortKeys: make(map[*pb.EntityProto][][]byte),
+	}
+	for _, filter := range q.GetFilter() {
+		propName := filter.GetProperty()[0].GetName()
+		s.filters[propName] = append(s.filters[propName], filter)
+	}
+	for propName, filters := range s.filters {
+		allEq := true
+		for _, filter := range filters {
+			allEq = allEq && filter.GetOp() == pb.Query_Filter_EQUAL
+		}
+		if len(filters) >= 2 && allEq {
+			s.any[propName] = true
+		}
+	}
+	return s
+}
+
+func getProperty(e *pb.EntityProto, name string) []*pb.Property {
+	props := e.GetProperty()
+	if len(props) == 0 {
+		props = e.GetRawProperty()
+	}
+	var ps []*pb.Property
+	for _, prop := range props {
+		if prop.GetName() == name {
+			ps = append(ps, prop)
+		}
+	}
+	return ps
+}
+
+func getPropValues(e *pb.EntityProto, name string) []*pb.PropertyValue {
+	props := getProperty(e, name)
+	var values []*pb.PropertyValue
+	for _, p := range props {
+		values = append(values, p.GetValue())
+	}
+	return values
+}
+
+// sortValue returns the value an entity is sorted by for the order, and its encoding. Like in the production
+// datastore, an entity with multiple values for the property is sorted by its smallest value in ascending orders
+// and by its largest value in descending orders. If the property is filtered, only the values that are in the
+// range of the filters count, like the entries of an index that are read for the query.
+func (this *sortableEntities) sortValue(e *pb.EntityProto, o *pb.Query_Order) (*pb.PropertyValue, []byte) {
+	filters := indexFilters(this.filters[o.GetProperty()])
+	var value *pb.PropertyValue
+	var enc []byte
+	for _, v := range getPropValues(e, o.GetProperty()) {
+		if !anyValueMatches([]*pb.PropertyValue{v}, filters, true) {
+			continue
+		}
+		b := encodeValue(nil, v)
+		d := bytes.Compare(b, enc)
+		if enc == nil || (d < 0 && o.GetDirection() == pb.Query_Order_ASCENDING) ||
+			(d > 0 && o.GetDirection() == pb.Query_Order_DESCENDING) {
+			value, enc = v, b
+		}
+	}
+	return value, enc
+}
+
+// getSortKeys returns the encoded sort values of an entity, one for every order. A sort value is nil if the
+// entity has no value for the order.
+func (this *sortableEntities) getSortKeys(e *pb.EntityProto) [][]byte {
+	keys, ok := this.sortKeys[e]
+	if !ok {
+		keys = make([][]byte, len(this.order))
+		for i, o := range this.order {
+			_, keys[i] = this.sortValue(e, o)
+		}
+		this.sortKeys[e] = keys
+	}
+	return keys
+}
+
+// compare compares two entities by the orders of the query, then by key
+func (this *sortableEntities) compare(a, b *pb.EntityProto) int {
+	ka, kb := this.getSortKeys(a), this.getSortKeys(b)
+	for i, o := range this.order {
+		d := bytes.Compare(ka[i], kb[i])
+		if o.GetDirection() == pb.Query_Order_DESCENDING {
+			d = -d
+		}
+		if d != 0 {
+			return d
+		}
+	}
+	return compareProtoRef(a.GetKey(), b.GetKey())
+}
+
+func (this *sortableEntities) Len() int { return len(this.protos) }
+
+func (this *sortableEntities) Swap(i, j int) {
+	this.protos[i], this.protos[j] = this.protos[j], this.protos[i]
+}
+func (this *sortableEntities) Less(i, j int) bool {
+	return this.compare(this.protos[i], this.protos[j]) < 0
+}
+
+func (this *sortableEntities) Limit(l *int32) {
+	if l != nil {
+		lim := *l
+		if int32(len(this.protos)) > lim {
+			this.protos = this.protos[:lim]
+		}
+	}
+	n := len(this.protos)
+	if n > 0 {
+		this.cursor = this.compileCursor(this.protos[n-1])
+	}
+}
+
+// Offset skips over the first o entities and returns the number of entities skipped
+func (this *sortableEntities) Offset(o *int32) int32 {
+	if o == nil || *o <= 0 {
+		return 0
+	}
+	off := *o
+	if n := int32(len(this.protos)); off > n {
+		off = n
+	}
+	if off > 0 {
+		this.cursor = this.compileCursor(this.protos[off-1])
+		this.protos = this.protos[off:]
+	}
+	return off
+}
+
+// CursorOffset skips over the entities positioned before the given cursor. The entities must be sorted.
+// The cursor's position is given by its index values and key, so the entity it was created from does not
+// need to still exist.
+func (this *sortableEntities) CursorOffset(c *pb.CompiledCursor) {
+	if c == nil || c.Position == nil || c.Position.Key == nil {
+		return
+	}
+	this.cursor = c.Position
+	i := sort.Search(len(this.protos), func(i int) bool {
+		return this.afterCursor(this.protos[i], c)
+	})
+	this.protos = this.protos[i:]
+}
+
+// afterCursor returns whether the entity is positioned after the cursor, or at it if the cursor is inclusive
+func (this *sortableEntities) afterCursor(e *pb.EntityProto, c *pb.CompiledCursor) bool {
+	if c == nil || c.Position == nil || c.Position.Key == nil {
+		return true
+	}
+	d := this.compareToPosition(e, c.Position)
+	return d > 0 || (d == 0 && c.Position.GetStartInclusive())
+}
+
+// compileCursor returns a cursor position pointing right after the given entity
+func (this *sortableEntities) compileCursor(e *pb.EntityProto) *pb.CompiledCursor_Position {
+	pos := &pb.CompiledCursor_Position{
+		Key: proto.Clone(e.GetKey()).(*pb.Reference),
+	}
+	for _, o := range this.order {
+		v, _ := this.sortValue(e, o)
+		pos.Indexvalue = append(pos.Indexvalue, &pb.CompiledCursor_Position_IndexValue{
+			Property: proto.String(o.GetProperty()),
+			Value:    proto.Clone(v).(*pb.PropertyValue),
+		})
+	}
+	f := false
+	pos.StartInclusive = &f
+	return pos
+}
+
+// compareToPosition compares an entity to a cursor position, using the same ordering as compare.
+// Returns -1 if the entity is positioned before the cursor, 0 if it is at the cursor and 1 if it is after.
+func (this *sortableEntities) compareToPosition(e *pb.EntityProto, pos *pb.CompiledCursor_Position) int {
+	keys := this.getSortKeys(e)
+	for i, o := range this.order {
+		if i >= len(pos.Indexvalue) {
+			break
+		}
+		d := bytes.Compare(keys[i], encodeValue(nil, pos.Indexvalue[i].GetValue()))
+		if o.GetDirection() == pb.Query_Order_DESCENDING {
+			d = -d
+		}
+		if d != 0 {
+			return d
+		}
+	}
+	return compareProtoRef(e.GetKey(), pos.Key)
+}
+
+func anyValueMatches(values []*pb.PropertyValue, filters []*pb.Query_Filter, matchOnAllFilters bool) bool {
+	if len(values) == 0 {
+		return false
+	}
+	for _, filter := range filters {
+		var ok bool
+		want := filter.GetProperty()[0].GetValue()
+		for _, val := range values {
+			d, valid := comparePropertyValue(val, want)
+			if !valid {
+				if matchOnAllFilters {
+					return false
+				} else {
+					continue
+				}
+			}
+			switch filter.GetOp() {
+			case pb.Query_Filter_EQUAL:
+				ok = d == 0
+			case pb.Query_Filter_LESS_THAN:
+				ok = d < 0
+			case pb.Query_Filter_GREATER_THAN:
+				ok = d > 0
+			case pb.Query_Filter_LESS_THAN_OR_EQUAL:
+				ok = d <= 0
+			case pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+				ok = d >= 0
+			}
+			if ok {
+				// We found a match. No need to search through the rest of the values for a match
+				break
+			}
+		}
+		if ok && !matchOnAllFilters {
+			// if we only need to match on one (any) filter and we already did, return true now
+			return true
+		}
+		if !ok && matchOnAllFilters {
+			// if we need to match on all filters, and this filter did not have a match, the match has failed
+			return false
+		}
+	}
+	return matchOnAllFilters
+}
+
+// matches returns whether the entity matches the filters and the ancestor of the query, and has values for its
+// sort orders
+func (this *sortableEntities) matches(e *pb.EntityProto) bool {
+	return this.matchesAncestor(e) && this.matchesFilters(e) && this.sortable(e)
+}
+
+func (this *sortableEntities) sortable(e *pb.EntityProto) bool {
+	for _, key := range this.getSortKeys(e) {
+		if key == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *sortableEntities) matchesFilters(entity *pb.EntityProto) bool {
+	for propName, filters := range this.filters {
+		props := getProperty(entity, propName)
+		multi := len(props) > 0 && props[0].GetMultiple()
+		any := multi && this.any[propName]
+		values := getPropValues(entity, propName)
+		if !anyValueMatches(values, filters, !any) {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *sortableEntities) matchesAncestor(ep *pb.EntityProto) bool {
+	ref := this.ancestor
+	if ref == nil {
+		return true
+	}
+	if ep.EntityGroup == nil {
+		return false
+	}
+	for i, el := range ref.Path.Element {
+		if len(ep.Key.Path.Element) <= i || compareProtoRefPathElem(el, ep.Key.Path.Element[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func entityProtoKind(e *pb.EntityProto) string {
+	el := e.GetKey().GetPath().GetElement()
+	return el[len(el)-1].GetType()
+}
+
+// checkQuery returns a BAD_REQUEST error for queries production rejects
+func checkQuery(q *pb.Query) error {
+	ineqProp := ""
+	for _, f := range q.GetFilter() {
+		if len(f.GetProperty()) != 1 {
+			return apiError(pb.Error_BAD_REQUEST, "Filter has %d properties, expected 1", len(f.GetProperty()))
+		}
+		name := f.GetProperty()[0].GetName()
+		switch f.GetOp() {
+		case pb.Query_Filter_EQUAL:
+		case pb.Query_Filter_LESS_THAN, pb.Query_Filter_LESS_THAN_OR_EQUAL,
+			pb.Query_Filter_GREATER_THAN, pb.Query_Filter_GREATER_THAN_OR_EQUAL:
+			if ineqProp != "" && ineqProp != name {
+				return apiError(pb.Error_BAD_REQUEST, "Only one inequality filter per query is supported. Encountered both %s and %s", ineqProp, name)
+			}
+			ineqProp = name
+		default:
+			return apiError(pb.Error_BAD_REQUEST, "Unsupported query filter operation %s", f.GetOp())
+		}
+	}
+	for _, o := range q.GetOrder() {
+		if o.GetProperty() == "" {
+			return apiError(pb.Error_BAD_REQUEST, "Sort property cannot be empty")
+		}
+		if o.GetDirection() != pb.Query_Order_ASCENDING && o.GetDirection() != pb.Query_Order_DESCENDING {
+			return apiError(pb.Error_BAD_REQUEST, "Unsupported sort direction %d", o.GetDirection())
+		}
+	}
+	if order := q.GetOrder(); ineqProp != "" && len(order) > 0 && order[0].GetProperty() != ineqProp {
+		return apiError(pb.Error_BAD_REQUEST, "The first sort property must be the same as the property to which the inequality filter is applied. In your query the first sort property is %s but the inequality filter is on %s", order[0].GetProperty(), ineqProp)
+	}
+	if q.Kind == nil && len(q.GetFilter()) > 0 {
+		return apiError(pb.Error_BAD_REQUEST, "kind is required for all filters except __key__")
+	}
+	if q.Kind == nil && len(q.GetOrder()) > 0 {
+		return apiError(pb.Error_BAD_REQUEST, "kind is required for all orders except __key__ ascending")
+	}
+	return nil
+}
+
+func nonsupported(q *pb.Query) string {
+	switch {
+	case q.EndCompiledCursor != nil:
+		return "End()"
+	case len(q.PropertyName) > 0:
+		return "Project()"
+	case len(q.GroupByPropertyName) > 0, q.Distinct != nil:
+		return "Distinct()"
+	}
+	for _, f := range q.GetFilter() {
+		for _, p := range f.GetProperty() {
+			if p.GetName() == "__key__" {
+				return "__key__ filters"
+			}
+		}
+	}
+	for _, o := range q.GetOrder() {
+		if o.GetProperty() == "__key__" {
+			return "__key__ orders"
+		}
+	}
+	return ""
+}
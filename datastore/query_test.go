@@ -1,459 +1,841 @@
-package datastore
-
-import (
-	"appengine"
-	"appengine/datastore"
-	"fmt"
-	"reflect"
-	"testing"
-)
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	} else {
-		return b
-	}
-}
-
-func getKeys(c appengine.Context, kind string, intIDs ...int64) []*datastore.Key {
-	keys := make([]*datastore.Key, len(intIDs))
-	for i, id := range intIDs {
-		keys[i] = datastore.NewKey(c, kind, "", id, nil)
-	}
-	return keys
-}
-
-func keysAndObjs(c appengine.Context, kind string, n int) ([]*datastore.Key, []Thing) {
-	keys := make([]*datastore.Key, n)
-	objs := make([]Thing, n)
-	for i := 0; i < n; i++ {
-		keys[i] = datastore.NewKey(c, kind, "", int64(i+1), nil)
-		objs[i] = thing(i + 1)
-	}
-	return keys, objs
-}
-
-func reverse(objs []Thing) []Thing {
-	n := len(objs)
-	os := make([]Thing, n)
-	for i := range objs {
-		os[i] = objs[n-i-1]
-	}
-	return os
-}
-
-func expect(c appengine.Context, q *datastore.Query, expected []Thing) string {
-	actual := make([]Thing, 0)
-	_, err := q.GetAll(c, &actual)
-	if err != nil {
-		return fmt.Sprintf("GetAll() returned error %v", err)
-	}
-	if len(actual) != len(expected) {
-		return fmt.Sprintf("GetAll() returned wrong number of entities (got %d, want %d). Got %v. Want %v", len(actual), len(expected), actual, expected)
-	} else {
-		for i := range expected {
-			if !reflect.DeepEqual(actual[i], expected[i]) {
-				return fmt.Sprintf("GetAll() returned wrong entity at index %d. Got %v, want %v", i, actual, expected)
-			}
-		}
-	}
-	return ""
-}
-
-func TestDatastoreQueryOnKind(t *testing.T) {
-	c := newContext()
-	keys := []*datastore.Key{datastore.NewKey(c, "KindA", "", 1, nil), datastore.NewKey(c, "KindB", "", 1, nil)}
-	objs := []Thing{thing(1), thing(2)}
-	_, err := datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-
-	q := datastore.NewQuery("KindA")
-	expected := []Thing{objs[0]}
-	if e := expect(c, q, expected); e != "" {
-		t.Error(e)
-	}
-
-	q = datastore.NewQuery("KindB")
-	expected = []Thing{objs[1]}
-	if e := expect(c, q, expected); e != "" {
-		t.Error(e)
-	}
-}
-
-func TestDatastoreQueryLimit(t *testing.T) {
-	c := newContext()
-	keys, objs := keysAndObjs(c, "Kind", 20)
-	_, err := datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-	for i := 5; i <= 25; i += 5 { // iterate to above len(objs) to see if we handle limit > store entity count
-		n := min(len(objs), i)
-		expected := objs[:n]
-		q := datastore.NewQuery("Kind").Limit(i)
-		if e := expect(c, q, expected); e != "" {
-			t.Errorf("Limit(%d)", i, e)
-		}
-	}
-
-	// Negative limit
-	expected := objs
-	q := datastore.NewQuery("Kind").Limit(-1)
-	if e := expect(c, q, expected); e != "" {
-		t.Errorf("Limit(-1): %s", e)
-	}
-
-	// Limit = 0
-	expected = make([]Thing, 0)
-	q = datastore.NewQuery("Kind").Limit(0)
-	if e := expect(c, q, expected); e != "" {
-		t.Errorf("Limit(0): %s", e)
-	}
-}
-
-func TestDatastoreQueryOffset(t *testing.T) {
-	c := newContext()
-	keys, objs := keysAndObjs(c, "Kind", 5)
-	_, err := datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-	for i := range keys { // iterate to above len(objs) to see if we handle limit > store entity count
-		expected := objs[i:]
-		q := datastore.NewQuery("Kind").Offset(i)
-		if e := expect(c, q, expected); e != "" {
-			t.Errorf("Offset(%d): %s", i, e)
-		}
-	}
-
-	expected := make([]Thing, 0)
-	q := datastore.NewQuery("Kind").Offset(len(objs))
-	if e := expect(c, q, expected); e != "" {
-		t.Errorf("Offset(len(objs)): %s", e)
-	}
-}
-
-func TestDatastoreQueryOrder(t *testing.T) {
-
-	// to implement:
-	// - order on multiple properties
-	// - if ordering is equal, orders on key
-	// - slice fields?
-	// - order on geopoint, reference
-
-	// Order on int, string, double
-	c := newContext()
-	// Scramble the keys. If the keys and objs are in the same order, we'll get the correct result by ordering on key
-	// The end result of key->obj refs is this:
-	// obj|key 1|4, 2|5, 3|1, 4|3, 5|2. keys asc: 4,5,1,3,2
-	keys := getKeys(c, "Kind", 1, 4, 2, 5, 3)
-	objs := []Thing{thing(3), thing(1), thing(5), thing(2), thing(4)}
-	_, err := datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-
-	expected := []Thing{thing(1), thing(2), thing(3), thing(4), thing(5)}
-
-	// Ascending
-	fields := []string{"IntProp", "StrProp", "DblProp"}
-	for _, field := range fields {
-		q := datastore.NewQuery("Kind").Order(field)
-		if e := expect(c, q, expected); e != "" {
-			t.Errorf("Order by %s: %s", field, e)
-			continue
-		}
-	}
-
-	//Descending
-	expected = reverse(expected)
-	for _, field := range fields {
-		q := datastore.NewQuery("Kind").Order("-" + field)
-		if e := expect(c, q, expected); e != "" {
-			t.Errorf("Order by -%s: %s", field, e)
-		}
-	}
-
-	// Order on bool
-	c = newContext()
-	keys = getKeys(c, "Kind", 1, 2)
-	objs = []Thing{thing(1), thing(2)}
-	objs[0].BoolProp = false
-	objs[1].BoolProp = true
-	_, err = datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-
-	// Asc
-	q := datastore.NewQuery("Kind").Order("BoolProp")
-	if e := expect(c, q, objs); e != "" {
-		t.Errorf("Order by BoolProp: %s", e)
-	}
-
-	// Desc
-	expected = []Thing{objs[1], objs[0]}
-	q = datastore.NewQuery("Kind").Order("-BoolProp")
-	if e := expect(c, q, expected); e != "" {
-		t.Errorf("Order by -BoolProp: %s", e)
-	}
-
-	// Order on non-existant field
-	c = newContext()
-	keys = getKeys(c, "Kind", 1, 2)
-	objs = []Thing{thing(1), thing(2)}
-	_, err = datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-	q = datastore.NewQuery("Kind").Order("NonExistantField")
-	expected = []Thing{}
-	if e := expect(c, q, expected); e != "" {
-		t.Errorf("Order by NonExistantField: %s", e)
-	}
-}
-
-func TestDatastoreQueryFilter(t *testing.T) {
-	type obj struct {
-		I  int64
-		F  float64
-		Is []int64
-		Fs []float64
-	}
-	type f struct {
-		op  string
-		val interface{}
-	}
-	tests := []struct {
-		name    string
-		objs    []obj // object stored in datastore
-		filters []f
-		want    []int // indexes of the objects from .objs we want returned by the query
-	}{
-		// Non existant field
-		{
-			name:    "Non existant field",
-			objs:    []obj{obj{I: 1, F: 1}},
-			filters: []f{f{"NonExistantField=", 1}},
-			want:    nil,
-		},
-		// // One field
-		{
-			name:    "=",
-			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
-			filters: []f{f{"I=", 1}},
-			want:    []int{1},
-		},
-		{
-			name:    "<",
-			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
-			filters: []f{f{"I<", 2}},
-			want:    []int{0, 1},
-		},
-		{
-			name:    "<=",
-			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
-			filters: []f{f{"I<=", 1}},
-			want:    []int{0, 1},
-		},
-		{
-			name:    "<",
-			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
-			filters: []f{f{"I>", 0}},
-			want:    []int{1, 2},
-		},
-		{
-			name:    "<=",
-			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
-			filters: []f{f{"I>=", 1}},
-			want:    []int{1, 2},
-		},
-		// // One field, multiple conditions
-		{
-			name:    "I=1 && I=2",
-			objs:    []obj{obj{I: 1}, obj{I: 2}},
-			filters: []f{f{"I=", 1}, f{"I=", 2}},
-			want:    nil,
-		},
-		{
-			name:    "1 < I < 4",
-			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}, obj{I: 3}, obj{I: 4}, obj{I: 5}},
-			filters: []f{f{"I>", 1}, f{"I<", 4}},
-			want:    []int{2, 3},
-		},
-		// Multiple fields, multiple conditions
-		{
-			name:    "I = 1, F = 2.5",
-			objs:    []obj{obj{I: 1, F: 2.4}, obj{I: 1, F: 2.5}, obj{I: 2, F: 2.5}},
-			filters: []f{f{"I=", 1}, f{"F=", 2.5}},
-			want:    []int{1},
-		},
-		{
-			name:    "1 < I < 4, F = 2.5",
-			objs:    []obj{obj{I: 1, F: 2.5}, obj{I: 2, F: 2.5}, obj{I: 3, F: 2.5}, obj{I: 3, F: 2.4}},
-			filters: []f{f{"I>", 1}, f{"I<", 4}, f{"F=", 2.5}},
-			want:    []int{1, 2},
-		},
-		// Slice field(s)
-		{
-			name: "Is = 2",
-			objs: []obj{
-				obj{Is: []int64{-1, 0, 1}}, // don't want
-				obj{Is: []int64{0, 1, 2}},  // want
-				obj{Is: []int64{1, 2, 3}},  // want
-				obj{Is: []int64{2, 3, 4}},  // want
-				obj{Is: []int64{3, 4, 5}}}, // don't want
-			filters: []f{f{"Is=", 2}},
-			want:    []int{1, 2, 3},
-		},
-		{
-			name: "Is > 2",
-			objs: []obj{
-				obj{Is: []int64{-1, 0, 1}}, // don't want
-				obj{Is: []int64{0, 1, 2}},  // don't want
-				obj{Is: []int64{1, 2, 3}},  // want
-				obj{Is: []int64{2, 3, 4}},  // want
-				obj{Is: []int64{3, 4, 5}}}, // want
-			filters: []f{f{"Is>", 2}},
-			want:    []int{2, 3, 4},
-		},
-		// "Special" slice cases (non intuitive/unexpected behaviours):
-		// see https://cloud.	google.com/appengine/docs/go/datastore/queries#Go_Filters
-		// Multiple equality filters on slice property matches if at least one slice value matches *one* of the filters
-		{
-			name: "Is = 2, Is = 3",
-			objs: []obj{
-				obj{Is: []int64{-1, 0, 1}}, // don't want
-				obj{Is: []int64{0, 1, 2}},  // want (2)
-				obj{Is: []int64{1, 2, 3}},  // want (2 and 3)
-				obj{Is: []int64{2, 3, 4}},  // want (2 and 3)
-				obj{Is: []int64{3, 4, 5}},  // want (3)
-				obj{Is: []int64{4, 5, 6}}}, // don't want
-			filters: []f{f{"Is=", 2}, f{"Is=", 3}},
-			want:    []int{1, 2, 3, 4}, // want entities with slice containing 2 or 3 or both 2 and 3
-		},
-		{
-			// "If a query has multiple inequality filters on a given property, an entity will match the query only if
-			// at least one of its individual values for the property satisfies all of the filters"
-			name: "2 > Is > 4",
-			objs: []obj{
-				obj{Is: []int64{0, 1, 2}},  // don't want
-				obj{Is: []int64{1, 2, 3}},  // want
-				obj{Is: []int64{2, 3, 4}},  // want
-				obj{Is: []int64{3, 4, 5}},  // want
-				obj{Is: []int64{4, 5, 6}}}, // don't want
-			filters: []f{f{"Is>", 2}, f{"Is<", 4}},
-			want:    []int{1, 2, 3}, // want entities with slice containing 3
-		},
-
-		//TODO: key equality
-	}
-
-	for _, test := range tests {
-		c := newContext()
-		keys := make([]*datastore.Key, len(test.objs))
-		for i := range test.objs {
-			keys[i] = datastore.NewKey(c, "Obj", "", int64(i+1), nil)
-		}
-		if _, err := datastore.PutMulti(c, keys, test.objs); err != nil {
-			t.Errorf("Error saving objects (should not happen): %v", err)
-			continue
-		}
-
-		q := datastore.NewQuery("Obj")
-		for _, filter := range test.filters {
-			q = q.Filter(filter.op, filter.val)
-		}
-		var got []obj
-		_, err := q.GetAll(c, &got)
-		if err != nil {
-			t.Errorf("Test %s: GetAll() returned error %v", test.name, err)
-		}
-		if len(got) != len(test.want) {
-			t.Errorf("Test %s: GetAll() returned wrong number of entities (got %d, want %d).\nGot %v", test.name, len(got), len(test.want), got)
-		} else {
-			for i, wantIndex := range test.want {
-				want := test.objs[wantIndex]
-				if !reflect.DeepEqual(got[i], want) {
-					t.Errorf("Test %s: GetAll() returned wrong entity at index %d.\nGot  %v\nWant %v", test.name, i, got[i], want)
-				}
-			}
-		}
-		// TODO: check keys
-	}
-}
-
-func TestDatastoreQueryStart(t *testing.T) {
-	c := newContext()
-	keys, objs := keysAndObjs(c, "Kind", 5)
-	_, err := datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-
-	q := datastore.NewQuery("Kind")
-	var cursor *datastore.Cursor
-	for i := 0; i < len(keys); i++ {
-		obj := Thing{}
-		if cursor != nil {
-			q = q.Start(*cursor)
-		}
-		iter := q.Run(c)
-		_, err := iter.Next(&obj)
-		if err == datastore.Done {
-			t.Errorf("Next() returned Done after %d iterations. Want %d", i, len(keys))
-			t.FailNow()
-		}
-		if err != nil {
-			t.Errorf("Next() returned error %v", err)
-			t.FailNow()
-		}
-		if !reflect.DeepEqual(obj, objs[i]) {
-			t.Errorf("Next() returned wrong object. Got %v, want %v", obj, objs[i])
-		}
-		cs, _ := iter.Cursor()
-		cursor = &cs
-	}
-}
-
-func TestDatastoreQueryAncestor(t *testing.T) {
-	c := newContext()
-	g1 := datastore.NewKey(c, "Kind", "G1", 0, nil)
-	g1p1 := datastore.NewKey(c, "Kind", "G1.P1", 0, g1)
-	g1p1c1 := datastore.NewKey(c, "Kind", "G1.P1.C1", 0, g1p1)
-	g1p1c2 := datastore.NewKey(c, "Kind", "G1.P1.C2", 0, g1p1)
-	g1p2 := datastore.NewKey(c, "Kind", "G1.P2", 0, g1)
-	g1p2c1 := datastore.NewKey(c, "Kind", "G1.P2.C1", 0, g1p2)
-	g2 := datastore.NewKey(c, "Kind", "G2", 0, nil)
-	g2p1 := datastore.NewKey(c, "Kind", "G2.P1", 0, g2)
-	keys := []*datastore.Key{g1, g1p1, g1p1c1, g1p1c2, g1p2, g1p2c1, g2, g2p1}
-	objs := make([]Thing, len(keys))
-	for i, key := range keys {
-		objs[i] = Thing{StrProp: key.StringID()}
-	}
-	_, err := datastore.PutMulti(c, keys, objs)
-	PanicIfErr(err)
-
-	nodes := func(ks ...*datastore.Key) []Thing {
-		os := make([]Thing, len(ks))
-		for i, k := range ks {
-			for j := range keys {
-				if keys[j].Equal(k) {
-					os[i] = objs[j]
-				}
-			}
-		}
-		return os
-	}
-
-	tests := []struct {
-		ancestor *datastore.Key
-		expected []Thing
-	}{
-		{g1p1c1, nodes(g1p1c1)},
-		{g1p1c2, nodes(g1p1c2)},
-		{g1p2c1, nodes(g1p2c1)},
-		{g2p1, nodes(g2p1)},
-		{g1p1, nodes(g1p1, g1p1c1, g1p1c2)},
-		{g1p2, nodes(g1p2, g1p2c1)},
-		{g2, nodes(g2, g2p1)},
-		{g1, nodes(g1, g1p1, g1p1c1, g1p1c2, g1p2, g1p2c1)},
-	}
-
-	for _, test := range tests {
-		q := datastore.NewQuery("Kind").Ancestor(test.ancestor)
-		if e := expect(c, q, test.expected); e != "" {
-			t.Errorf("Ancestor(%v): %s", test.ancestor, e)
-		}
-	}
-
-}
+package datastore
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine_internal"
+	pb "appengine_internal/datastore"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
+func getKeys(c appengine.Context, kind string, intIDs ...int64) []*datastore.Key {
+	keys := make([]*datastore.Key, len(intIDs))
+	for i, id := range intIDs {
+		keys[i] = datastore.NewKey(c, kind, "", id, nil)
+	}
+	return keys
+}
+
+func keysAndObjs(c appengine.Context, kind string, n int) ([]*datastore.Key, []Thing) {
+	keys := make([]*datastore.Key, n)
+	objs := make([]Thing, n)
+	for i := 0; i < n; i++ {
+		keys[i] = datastore.NewKey(c, kind, "", int64(i+1), nil)
+		objs[i] = thing(i + 1)
+	}
+	return keys, objs
+}
+
+func reverse(objs []Thing) []Thing {
+	n := len(objs)
+	os := make([]Thing, n)
+	for i := range objs {
+		os[i] = objs[n-i-1]
+	}
+	return os
+}
+
+func expect(c appengine.Context, q *datastore.Query, expected []Thing) string {
+	actual := make([]Thing, 0)
+	_, err := q.GetAll(c, &actual)
+	if err != nil {
+		return fmt.Sprintf("GetAll() returned error %v", err)
+	}
+	if len(actual) != len(expected) {
+		return fmt.Sprintf("GetAll() returned wrong number of entities (got %d, want %d). Got %v. Want %v", len(actual), len(expected), actual, expected)
+	} else {
+		for i := range expected {
+			if !reflect.DeepEqual(actual[i], expected[i]) {
+				return fmt.Sprintf("GetAll() returned wrong entity at index %d. Got %v, want %v", i, actual, expected)
+			}
+		}
+	}
+	return ""
+}
+
+func TestDatastoreQueryOnKind(t *testing.T) {
+	c := newContext()
+	keys := []*datastore.Key{datastore.NewKey(c, "KindA", "", 1, nil), datastore.NewKey(c, "KindB", "", 1, nil)}
+	objs := []Thing{thing(1), thing(2)}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	q := datastore.NewQuery("KindA")
+	expected := []Thing{objs[0]}
+	if e := expect(c, q, expected); e != "" {
+		t.Error(e)
+	}
+
+	q = datastore.NewQuery("KindB")
+	expected = []Thing{objs[1]}
+	if e := expect(c, q, expected); e != "" {
+		t.Error(e)
+	}
+}
+
+func TestDatastoreQueryOnChildKind(t *testing.T) {
+	c := newContext()
+	parent := datastore.NewKey(c, "KindA", "", 1, nil)
+	keys := []*datastore.Key{parent, datastore.NewKey(c, "KindB", "", 1, parent)}
+	objs := []Thing{thing(1), thing(2)}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// The kind of an entity is the kind of the last element of its key, not of its root
+	if e := expect(c, datastore.NewQuery("KindB"), []Thing{objs[1]}); e != "" {
+		t.Error(e)
+	}
+	if e := expect(c, datastore.NewQuery("KindA"), []Thing{objs[0]}); e != "" {
+		t.Error(e)
+	}
+	var exported bytes.Buffer
+	PanicIfErr(c.(*testContext).ds.ExportBackup(&exported, "KindB"))
+	imported := New()
+	PanicIfErr(imported.ImportBackup(&exported, c.FullyQualifiedAppID(), "KindB"))
+	if n := len(imported.entities.Entities()); n != 1 {
+		t.Errorf("Backup of KindB had %d entities. Want 1", n)
+	}
+}
+
+func TestDatastoreQueryLimit(t *testing.T) {
+	c := newContext()
+	keys, objs := keysAndObjs(c, "Kind", 20)
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+	for i := 5; i <= 25; i += 5 { // iterate to above len(objs) to see if we handle limit > store entity count
+		n := min(len(objs), i)
+		expected := objs[:n]
+		q := datastore.NewQuery("Kind").Limit(i)
+		if e := expect(c, q, expected); e != "" {
+			t.Errorf("Limit(%d)", i, e)
+		}
+	}
+
+	// Negative limit
+	expected := objs
+	q := datastore.NewQuery("Kind").Limit(-1)
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Limit(-1): %s", e)
+	}
+
+	// Limit = 0
+	expected = make([]Thing, 0)
+	q = datastore.NewQuery("Kind").Limit(0)
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Limit(0): %s", e)
+	}
+}
+
+func TestDatastoreQueryOffset(t *testing.T) {
+	c := newContext()
+	keys, objs := keysAndObjs(c, "Kind", 5)
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+	for i := range keys { // iterate to above len(objs) to see if we handle limit > store entity count
+		expected := objs[i:]
+		q := datastore.NewQuery("Kind").Offset(i)
+		if e := expect(c, q, expected); e != "" {
+			t.Errorf("Offset(%d): %s", i, e)
+		}
+	}
+
+	expected := make([]Thing, 0)
+	q := datastore.NewQuery("Kind").Offset(len(objs))
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Offset(len(objs)): %s", e)
+	}
+}
+
+func TestDatastoreQueryOrder(t *testing.T) {
+
+	// to implement:
+	// - order on multiple properties
+	// - if ordering is equal, orders on key
+	// - slice fields?
+	// - order on geopoint, reference
+
+	// Order on int, string, double
+	c := newContext()
+	// Scramble the keys. If the keys and objs are in the same order, we'll get the correct result by ordering on key
+	// The end result of key->obj refs is this:
+	// obj|key 1|4, 2|5, 3|1, 4|3, 5|2. keys asc: 4,5,1,3,2
+	keys := getKeys(c, "Kind", 1, 4, 2, 5, 3)
+	objs := []Thing{thing(3), thing(1), thing(5), thing(2), thing(4)}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	expected := []Thing{thing(1), thing(2), thing(3), thing(4), thing(5)}
+
+	// Ascending
+	fields := []string{"IntProp", "StrProp", "DblProp"}
+	for _, field := range fields {
+		q := datastore.NewQuery("Kind").Order(field)
+		if e := expect(c, q, expected); e != "" {
+			t.Errorf("Order by %s: %s", field, e)
+			continue
+		}
+	}
+
+	//Descending
+	expected = reverse(expected)
+	for _, field := range fields {
+		q := datastore.NewQuery("Kind").Order("-" + field)
+		if e := expect(c, q, expected); e != "" {
+			t.Errorf("Order by -%s: %s", field, e)
+		}
+	}
+
+	// Order on bool
+	c = newContext()
+	keys = getKeys(c, "Kind", 1, 2)
+	objs = []Thing{thing(1), thing(2)}
+	objs[0].BoolProp = false
+	objs[1].BoolProp = true
+	_, err = datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// Asc
+	q := datastore.NewQuery("Kind").Order("BoolProp")
+	if e := expect(c, q, objs); e != "" {
+		t.Errorf("Order by BoolProp: %s", e)
+	}
+
+	// Desc
+	expected = []Thing{objs[1], objs[0]}
+	q = datastore.NewQuery("Kind").Order("-BoolProp")
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Order by -BoolProp: %s", e)
+	}
+
+	// Order on non-existant field
+	c = newContext()
+	keys = getKeys(c, "Kind", 1, 2)
+	objs = []Thing{thing(1), thing(2)}
+	_, err = datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+	q = datastore.NewQuery("Kind").Order("NonExistantField")
+	expected = []Thing{}
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Order by NonExistantField: %s", e)
+	}
+}
+
+func TestDatastoreQueryFilter(t *testing.T) {
+	type obj struct {
+		I  int64
+		F  float64
+		Is []int64
+		Fs []float64
+	}
+	type f struct {
+		op  string
+		val interface{}
+	}
+	tests := []struct {
+		name    string
+		objs    []obj // object stored in datastore
+		filters []f
+		want    []int // indexes of the objects from .objs we want returned by the query
+	}{
+		// Non existant field
+		{
+			name:    "Non existant field",
+			objs:    []obj{obj{I: 1, F: 1}},
+			filters: []f{f{"NonExistantField=", 1}},
+			want:    nil,
+		},
+		// // One field
+		{
+			name:    "=",
+			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
+			filters: []f{f{"I=", 1}},
+			want:    []int{1},
+		},
+		{
+			name:    "<",
+			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
+			filters: []f{f{"I<", 2}},
+			want:    []int{0, 1},
+		},
+		{
+			name:    "<=",
+			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
+			filters: []f{f{"I<=", 1}},
+			want:    []int{0, 1},
+		},
+		{
+			name:    "<",
+			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
+			filters: []f{f{"I>", 0}},
+			want:    []int{1, 2},
+		},
+		{
+			name:    "<=",
+			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}},
+			filters: []f{f{"I>=", 1}},
+			want:    []int{1, 2},
+		},
+		// // One field, multiple conditions
+		{
+			name:    "I=1 && I=2",
+			objs:    []obj{obj{I: 1}, obj{I: 2}},
+			filters: []f{f{"I=", 1}, f{"I=", 2}},
+			want:    nil,
+		},
+		{
+			name:    "1 < I < 4",
+			objs:    []obj{obj{I: 0}, obj{I: 1}, obj{I: 2}, obj{I: 3}, obj{I: 4}, obj{I: 5}},
+			filters: []f{f{"I>", 1}, f{"I<", 4}},
+			want:    []int{2, 3},
+		},
+		// Multiple fields, multiple conditions
+		{
+			name:    "I = 1, F = 2.5",
+			objs:    []obj{obj{I: 1, F: 2.4}, obj{I: 1, F: 2.5}, obj{I: 2, F: 2.5}},
+			filters: []f{f{"I=", 1}, f{"F=", 2.5}},
+			want:    []int{1},
+		},
+		{
+			name:    "1 < I < 4, F = 2.5",
+			objs:    []obj{obj{I: 1, F: 2.5}, obj{I: 2, F: 2.5}, obj{I: 3, F: 2.5}, obj{I: 3, F: 2.4}},
+			filters: []f{f{"I>", 1}, f{"I<", 4}, f{"F=", 2.5}},
+			want:    []int{1, 2},
+		},
+		// Slice field(s)
+		{
+			name: "Is = 2",
+			objs: []obj{
+				obj{Is: []int64{-1, 0, 1}}, // don't want
+				obj{Is: []int64{0, 1, 2}},  // want
+				obj{Is: []int64{1, 2, 3}},  // want
+				obj{Is: []int64{2, 3, 4}},  // want
+				obj{Is: []int64{3, 4, 5}}}, // don't want
+			filters: []f{f{"Is=", 2}},
+			want:    []int{1, 2, 3},
+		},
+		{
+			name: "Is > 2",
+			objs: []obj{
+				obj{Is: []int64{-1, 0, 1}}, // don't want
+				obj{Is: []int64{0, 1, 2}},  // don't want
+				obj{Is: []int64{1, 2, 3}},  // want
+				obj{Is: []int64{2, 3, 4}},  // want
+				obj{Is: []int64{3, 4, 5}}}, // want
+			filters: []f{f{"Is>", 2}},
+			want:    []int{2, 3, 4},
+		},
+		// "Special" slice cases (non intuitive/unexpected behaviours):
+		// see https://cloud.	google.com/appengine/docs/go/datastore/queries#Go_Filters
+		// Multiple equality filters on slice property matches if at least one slice value matches *one* of the filters
+		{
+			name: "Is = 2, Is = 3",
+			objs: []obj{
+				obj{Is: []int64{-1, 0, 1}}, // don't want
+				obj{Is: []int64{0, 1, 2}},  // want (2)
+				obj{Is: []int64{1, 2, 3}},  // want (2 and 3)
+				obj{Is: []int64{2, 3, 4}},  // want (2 and 3)
+				obj{Is: []int64{3, 4, 5}},  // want (3)
+				obj{Is: []int64{4, 5, 6}}}, // don't want
+			filters: []f{f{"Is=", 2}, f{"Is=", 3}},
+			want:    []int{1, 2, 3, 4}, // want entities with slice containing 2 or 3 or both 2 and 3
+		},
+		{
+			// "If a query has multiple inequality filters on a given property, an entity will match the query only if
+			// at least one of its individual values for the property satisfies all of the filters"
+			name: "2 > Is > 4",
+			objs: []obj{
+				obj{Is: []int64{0, 1, 2}},  // don't want
+				obj{Is: []int64{1, 2, 3}},  // want
+				obj{Is: []int64{2, 3, 4}},  // want
+				obj{Is: []int64{3, 4, 5}},  // want
+				obj{Is: []int64{4, 5, 6}}}, // don't want
+			filters: []f{f{"Is>", 2}, f{"Is<", 4}},
+			want:    []int{1, 2, 3}, // want entities with slice containing 3
+		},
+
+		//TODO: key equality
+	}
+
+	for _, test := range tests {
+		c := newContext()
+		keys := make([]*datastore.Key, len(test.objs))
+		for i := range test.objs {
+			keys[i] = datastore.NewKey(c, "Obj", "", int64(i+1), nil)
+		}
+		if _, err := datastore.PutMulti(c, keys, test.objs); err != nil {
+			t.Errorf("Error saving objects (should not happen): %v", err)
+			continue
+		}
+
+		q := datastore.NewQuery("Obj")
+		for _, filter := range test.filters {
+			q = q.Filter(filter.op, filter.val)
+		}
+		var got []obj
+		_, err := q.GetAll(c, &got)
+		if err != nil {
+			t.Errorf("Test %s: GetAll() returned error %v", test.name, err)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("Test %s: GetAll() returned wrong number of entities (got %d, want %d).\nGot %v", test.name, len(got), len(test.want), got)
+		} else {
+			for i, wantIndex := range test.want {
+				want := test.objs[wantIndex]
+				if !reflect.DeepEqual(got[i], want) {
+					t.Errorf("Test %s: GetAll() returned wrong entity at index %d.\nGot  %v\nWant %v", test.name, i, got[i], want)
+				}
+			}
+		}
+		// TODO: check keys
+	}
+}
+
+func TestDatastoreQueryStart(t *testing.T) {
+	c := newContext()
+	keys, objs := keysAndObjs(c, "Kind", 5)
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	q := datastore.NewQuery("Kind")
+	var cursor *datastore.Cursor
+	for i := 0; i < len(keys); i++ {
+		obj := Thing{}
+		if cursor != nil {
+			q = q.Start(*cursor)
+		}
+		iter := q.Run(c)
+		_, err := iter.Next(&obj)
+		if err == datastore.Done {
+			t.Errorf("Next() returned Done after %d iterations. Want %d", i, len(keys))
+			t.FailNow()
+		}
+		if err != nil {
+			t.Errorf("Next() returned error %v", err)
+			t.FailNow()
+		}
+		if !reflect.DeepEqual(obj, objs[i]) {
+			t.Errorf("Next() returned wrong object. Got %v, want %v", obj, objs[i])
+		}
+		cs, _ := iter.Cursor()
+		cursor = &cs
+	}
+}
+
+func TestDatastoreQueryStartOrdered(t *testing.T) {
+	c := newContext()
+	// Put the objects in the reverse order of their keys, so ordering by key and by IntProp differ
+	keys := getKeys(c, "Kind", 5, 4, 3, 2, 1)
+	objs := []Thing{thing(1), thing(2), thing(3), thing(4), thing(5)}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// Get a cursor for every result of the query
+	q := datastore.NewQuery("Kind").Order("IntProp")
+	iter := q.Run(c)
+	cursors := make([]datastore.Cursor, 0)
+	for {
+		var obj Thing
+		_, err := iter.Next(&obj)
+		if err == datastore.Done {
+			break
+		}
+		PanicIfErr(err)
+		cursor, err := iter.Cursor()
+		if err != nil {
+			t.Errorf("Cursor() returned error %v", err)
+			t.FailNow()
+		}
+		cursors = append(cursors, cursor)
+	}
+	if len(cursors) != len(objs) {
+		t.Errorf("Query returned %d results. Want %d", len(cursors), len(objs))
+		t.FailNow()
+	}
+
+	for i, cursor := range cursors {
+		if e := expect(c, q.Start(cursor), objs[i+1:]); e != "" {
+			t.Errorf("Start(cursor %d): %s", i, e)
+		}
+	}
+
+	// Resuming from a cursor works even if the entity it was created from is deleted
+	PanicIfErr(datastore.Delete(c, keys[1]))
+	if e := expect(c, q.Start(cursors[1]), objs[2:]); e != "" {
+		t.Errorf("Start(cursor) after deleting the cursor's entity: %s", e)
+	}
+	if e := expect(c, q.Start(cursors[0]), objs[2:]); e != "" {
+		t.Errorf("Start(cursor) after deleting the entity following the cursor: %s", e)
+	}
+
+	// Entities with equal values for the sort property are ordered by key
+	c = newContext()
+	keys = getKeys(c, "Kind", 3, 1, 2)
+	objs = []Thing{thing(1), thing(2), thing(3)}
+	for i := range objs {
+		objs[i].BoolProp = true
+	}
+	_, err = datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+	q = datastore.NewQuery("Kind").Order("BoolProp")
+	if e := expect(c, q, []Thing{objs[1], objs[2], objs[0]}); e != "" {
+		t.Errorf("Order by BoolProp with equal values: %s", e)
+	}
+	iter = q.Limit(1).Run(c)
+	_, err = iter.Next(&Thing{})
+	PanicIfErr(err)
+	cursor, err := iter.Cursor()
+	PanicIfErr(err)
+	if e := expect(c, datastore.NewQuery("Kind").Order("BoolProp").Start(cursor), []Thing{objs[2], objs[0]}); e != "" {
+		t.Errorf("Start(cursor) with equal sort values: %s", e)
+	}
+}
+
+// pages returns the results of the query, read one at a time by resuming from the cursor of the previous result
+func pages(c appengine.Context, q *datastore.Query, n int) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	var cursor *datastore.Cursor
+	for i := 0; i < n; i++ {
+		page := q.Limit(1)
+		if cursor != nil {
+			page = page.Start(*cursor)
+		}
+		iter := page.Run(c)
+		key, err := iter.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		cs, err := iter.Cursor()
+		if err != nil {
+			return nil, err
+		}
+		cursor = &cs
+	}
+	return keys, nil
+}
+
+func TestDatastoreQueryStartDescending(t *testing.T) {
+	c := newContext()
+	keys := getKeys(c, "Kind", 1, 2, 3, 4)
+	objs := []Thing{thing(1), thing(2), thing(3), thing(4)}
+	for i := range objs {
+		objs[i].IntProp = 1 + i/2
+	}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// Entities with equal values for a descending sort property are still ordered by key
+	q := datastore.NewQuery("Kind").Order("-IntProp")
+	want := []*datastore.Key{keys[2], keys[3], keys[0], keys[1]}
+	got, err := q.KeysOnly().GetAll(c, nil)
+	PanicIfErr(err)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Order by -IntProp with equal values returned %v. Want %v", got, want)
+	}
+	if got, err = pages(c, q.KeysOnly(), 10); err != nil {
+		t.Errorf("Reading the query with cursors returned error %v", err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reading the query with cursors returned %v. Want %v", got, want)
+	}
+}
+
+// queryContext records the last query run through it
+type queryContext struct {
+	testContext
+	query *pb.Query
+}
+
+func (this *queryContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if method == "RunQuery" {
+		this.query = in.(*pb.Query)
+	}
+	return this.testContext.Call(service, method, in, out, opts)
+}
+
+func TestDatastoreQueryStartSeeks(t *testing.T) {
+	c := &queryContext{testContext: testContext{ds: New()}}
+	c.ds.AddIndex(&pb.Index{
+		EntityType: proto.String("Kind"),
+		Ancestor:   proto.Bool(false),
+		Property: []*pb.Index_Property{
+			&pb.Index_Property{Name: proto.String("BoolProp")},
+			&pb.Index_Property{Name: proto.String("IntProp"), Direction: pb.Index_Property_DESCENDING.Enum()},
+		},
+	})
+	keys, objs := keysAndObjs(c, "Kind", 100)
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Kind", "", int64(i+1), parent)
+	}
+	_, err = datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// A query that starts at a cursor reads the index from the cursor's position, instead of from its start
+	tests := []struct {
+		name  string
+		q     *datastore.Query
+		total int // results of the query
+		skip  int // results before the cursor
+	}{
+		{"ascending order", datastore.NewQuery("Kind").Order("IntProp"), 200, 180},
+		{"descending order", datastore.NewQuery("Kind").Order("-IntProp"), 200, 180},
+		{"key order", datastore.NewQuery("Kind"), 200, 180},
+		{"ancestor", datastore.NewQuery("Kind").Ancestor(parent), 100, 90},
+		{"composite index", datastore.NewQuery("Kind").Filter("BoolProp =", true).Order("-IntProp"), 100, 80},
+	}
+	for _, test := range tests {
+		iter := test.q.KeysOnly().Limit(test.skip).Run(c)
+		for {
+			if _, err := iter.Next(nil); err == datastore.Done {
+				break
+			} else if err != nil {
+				PanicIfErr(err)
+			}
+		}
+		cursor, err := iter.Cursor()
+		PanicIfErr(err)
+		_, err = test.q.KeysOnly().Start(cursor).Limit(1).Run(c).Next(nil)
+		PanicIfErr(err)
+
+		read := 0
+		scan, _ := c.ds.candidates(c.query)
+		scan(func(e *pb.EntityProto) bool {
+			read++
+			return true
+		})
+		// The entities after the cursor, and the ones with the same values as the entity at the cursor: every
+		// value is of a root entity and of a child entity
+		if max := test.total - test.skip + 2; read > max {
+			t.Errorf("%s: query from a cursor read %d entities, want at most %d", test.name, read, max)
+		}
+	}
+}
+
+func TestDatastoreQueryStartMultipleValues(t *testing.T) {
+	type obj struct {
+		Is []int64
+	}
+	c := newContext()
+	keys := getKeys(c, "Kind", 1, 2, 3)
+	objs := []obj{{Is: []int64{3, 7}}, {Is: []int64{5}}, {Is: []int64{6}}}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// An entity is sorted by its smallest or largest value that matches the inequality filter, and can be
+	// resumed after with a cursor
+	tests := []struct {
+		q    *datastore.Query
+		want []*datastore.Key
+	}{
+		{datastore.NewQuery("Kind").Filter("Is >", 4).Order("Is"), []*datastore.Key{keys[1], keys[2], keys[0]}},
+		{datastore.NewQuery("Kind").Filter("Is <", 6).Order("-Is"), []*datastore.Key{keys[1], keys[0]}},
+		{datastore.NewQuery("Kind").Filter("Is >", 4).Filter("Is <", 7).Order("Is"), []*datastore.Key{keys[1], keys[2]}},
+	}
+	for i, test := range tests {
+		got, err := test.q.KeysOnly().GetAll(c, nil)
+		PanicIfErr(err)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: query returned %v. Want %v", i, got, test.want)
+		}
+		if got, err = pages(c, test.q.KeysOnly(), 10); err != nil {
+			t.Errorf("%d: reading the query with cursors returned error %v", i, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: reading the query with cursors returned %v. Want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestDatastoreQueryAncestor(t *testing.T) {
+	c := newContext()
+	g1 := datastore.NewKey(c, "Kind", "G1", 0, nil)
+	g1p1 := datastore.NewKey(c, "Kind", "G1.P1", 0, g1)
+	g1p1c1 := datastore.NewKey(c, "Kind", "G1.P1.C1", 0, g1p1)
+	g1p1c2 := datastore.NewKey(c, "Kind", "G1.P1.C2", 0, g1p1)
+	g1p2 := datastore.NewKey(c, "Kind", "G1.P2", 0, g1)
+	g1p2c1 := datastore.NewKey(c, "Kind", "G1.P2.C1", 0, g1p2)
+	g2 := datastore.NewKey(c, "Kind", "G2", 0, nil)
+	g2p1 := datastore.NewKey(c, "Kind", "G2.P1", 0, g2)
+	keys := []*datastore.Key{g1, g1p1, g1p1c1, g1p1c2, g1p2, g1p2c1, g2, g2p1}
+	objs := make([]Thing, len(keys))
+	for i, key := range keys {
+		objs[i] = Thing{StrProp: key.StringID()}
+	}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	nodes := func(ks ...*datastore.Key) []Thing {
+		os := make([]Thing, len(ks))
+		for i, k := range ks {
+			for j := range keys {
+				if keys[j].Equal(k) {
+					os[i] = objs[j]
+				}
+			}
+		}
+		return os
+	}
+
+	tests := []struct {
+		ancestor *datastore.Key
+		expected []Thing
+	}{
+		{g1p1c1, nodes(g1p1c1)},
+		{g1p1c2, nodes(g1p1c2)},
+		{g1p2c1, nodes(g1p2c1)},
+		{g2p1, nodes(g2p1)},
+		{g1p1, nodes(g1p1, g1p1c1, g1p1c2)},
+		{g1p2, nodes(g1p2, g1p2c1)},
+		{g2, nodes(g2, g2p1)},
+		{g1, nodes(g1, g1p1, g1p1c1, g1p1c2, g1p2, g1p2c1)},
+	}
+
+	for _, test := range tests {
+		q := datastore.NewQuery("Kind").Ancestor(test.ancestor)
+		if e := expect(c, q, test.expected); e != "" {
+			t.Errorf("Ancestor(%v): %s", test.ancestor, e)
+		}
+	}
+
+}
+
+func TestDatastoreQueryMultipleOrders(t *testing.T) {
+	c := newContext()
+	keys := getKeys(c, "Kind", 1, 2, 3, 4)
+	objs := []Thing{
+		Thing{IntProp: 1, StrProp: "b"},
+		Thing{IntProp: 2, StrProp: "a"},
+		Thing{IntProp: 3, StrProp: "b"},
+		Thing{IntProp: 4, StrProp: "a"},
+	}
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	q := datastore.NewQuery("Kind").Order("StrProp").Order("-IntProp")
+	expected := []Thing{objs[3], objs[1], objs[2], objs[0]}
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Order by StrProp, -IntProp: %s", e)
+	}
+}
+
+func TestDatastoreQueryCompositeIndex(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+	ds.AddIndex(&pb.Index{
+		EntityType: proto.String("Kind"),
+		Ancestor:   proto.Bool(false),
+		Property: []*pb.Index_Property{
+			&pb.Index_Property{Name: proto.String("BoolProp")},
+			&pb.Index_Property{Name: proto.String("IntProp"), Direction: pb.Index_Property_DESCENDING.Enum()},
+		},
+	})
+	keys, objs := keysAndObjs(c, "Kind", 10)
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	// Served from the composite index
+	q := datastore.NewQuery("Kind").Filter("BoolProp =", true).Order("-IntProp")
+	expected := []Thing{objs[9], objs[7], objs[5], objs[3], objs[1]}
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Composite index: %s", e)
+	}
+	q = datastore.NewQuery("Kind").Filter("BoolProp =", true).Filter("IntProp <", 6).Order("-IntProp")
+	expected = []Thing{objs[3], objs[1]}
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Composite index with inequality filter: %s", e)
+	}
+
+	// Changes are reflected in the index
+	PanicIfErr(datastore.Delete(c, keys[9]))
+	objs[7].BoolProp = false
+	_, err = datastore.Put(c, keys[7], &objs[7])
+	PanicIfErr(err)
+	q = datastore.NewQuery("Kind").Filter("BoolProp =", true).Order("-IntProp")
+	expected = []Thing{objs[5], objs[3], objs[1]}
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Composite index after changes: %s", e)
+	}
+
+	// Not matching the composite index: served from the built-in indexes
+	q = datastore.NewQuery("Kind").Filter("BoolProp =", false).Order("IntProp")
+	expected = []Thing{objs[0], objs[2], objs[4], objs[6], objs[7], objs[8]}
+	if e := expect(c, q, expected); e != "" {
+		t.Errorf("Built-in index: %s", e)
+	}
+}
+
+func TestDatastoreQueryErrors(t *testing.T) {
+	c := newContext()
+	ds := c.(*testContext).ds
+	keys, objs := keysAndObjs(c, "Kind", 3)
+	_, err := datastore.PutMulti(c, keys, objs)
+	PanicIfErr(err)
+
+	isBadRequest := func(err error) bool {
+		apiErr, ok := err.(*appengine_internal.APIError)
+		return ok && apiErr.Code == int32(pb.Error_BAD_REQUEST)
+	}
+	tests := []struct {
+		name string
+		q    *datastore.Query
+	}{
+		{"Inequality filters on two properties", datastore.NewQuery("Kind").Filter("IntProp >", 1).Filter("DblProp <", 2.0)},
+		{"First order not on inequality property", datastore.NewQuery("Kind").Filter("IntProp >", 1).Order("StrProp")},
+		{"Kindless query with filter", datastore.NewQuery("").Filter("IntProp =", 1)},
+	}
+	for _, test := range tests {
+		if _, err := test.q.GetAll(c, &[]Thing{}); !isBadRequest(err) {
+			t.Errorf("%s: GetAll returned %v, want a BAD_REQUEST error", test.name, err)
+		}
+	}
+
+	// Unsupported filter operation
+	q := &pb.Query{
+		App:  proto.String("dev~aeunit"),
+		Kind: proto.String("Kind"),
+		Filter: []*pb.Query_Filter{&pb.Query_Filter{
+			Op:       pb.Query_Filter_IN.Enum(),
+			Property: []*pb.Property{&pb.Property{Name: proto.String("IntProp"), Value: &pb.PropertyValue{Int64Value: proto.Int64(1)}, Multiple: proto.Bool(false)}},
+		}},
+	}
+	if err := ds.RunQuery(q, &pb.QueryResult{}); !isBadRequest(err) {
+		t.Errorf("Filter with operation IN: RunQuery returned %v, want a BAD_REQUEST error", err)
+	}
+
+	// __key__ filters and orders, which are allowed on kindless queries, are not implemented
+	isInternalError := func(err error) bool {
+		apiErr, ok := err.(*appengine_internal.APIError)
+		return ok && apiErr.Code == int32(pb.Error_INTERNAL_ERROR)
+	}
+	keyQueries := []*datastore.Query{
+		datastore.NewQuery("").Filter("__key__ >", keys[0]),
+		datastore.NewQuery("").Order("__key__"),
+		datastore.NewQuery("Kind").Filter("__key__ =", keys[0]),
+	}
+	for _, q := range keyQueries {
+		if _, err := q.GetAll(c, &[]Thing{}); !isInternalError(err) {
+			t.Errorf("%v: GetAll returned %v, want an INTERNAL_ERROR error", q, err)
+		}
+	}
+
+	// Queries are never continued with Next
+	next := &pb.NextRequest{Cursor: &pb.Cursor{Cursor: proto.Uint64(1)}}
+	if err := ds.Next(next, &pb.QueryResult{}); !isBadRequest(err) {
+		t.Errorf("Next returned %v, want a BAD_REQUEST error", err)
+	}
+}
@@ -0,0 +1,244 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"sort"
+)
+
+// entityMap is implemented by the entityStore holding the committed entities, and by the entityDict holding the
+// changes made in a transaction
+type entityMap interface {
+	Put(key *pb.Reference, obj *pb.EntityProto)
+	Delete(key *pb.Reference)
+	Get(key *pb.Reference) *pb.EntityProto
+	Entities() []entityDictEntity
+}
+
+// entityStore holds the committed entities of the datastore, grouped by namespace and kind.
+//
+// A store can be shared with snapshots. Shared maps and kindStores are never written to: they are copied
+// the first time they are changed.
+type entityStore struct {
+	kinds     map[string]*kindStore // by namespace and kind, see kindStoreKey
+	composite map[string][]*pb.Index
+	shared    bool
+}
+
+// kindStore holds the entities of one kind in one namespace, indexed by key and on every property
+type kindStore struct {
+	kind      string
+	entities  map[string]entityDictEntity
+	byKey     *index
+	builtin   map[string]*index // single property indexes, by property name
+	composite []*index
+	shared    bool
+}
+
+func newEntityStore() *entityStore {
+	return &entityStore{
+		kinds:     make(map[string]*kindStore),
+		composite: make(map[string][]*pb.Index),
+	}
+}
+
+func kindStoreKey(namespace, kind string) string {
+	return namespace + "\x00" + kind
+}
+
+func keyKind(key *pb.Reference) string {
+	el := key.GetPath().GetElement()
+	return el[len(el)-1].GetType()
+}
+
+// Kind returns the store for the given namespace and kind, or nil if there are no entities of that kind
+func (this *entityStore) Kind(namespace, kind string) *kindStore {
+	return this.kinds[kindStoreKey(namespace, kind)]
+}
+
+// Namespace returns the stores for all kinds in the namespace
+func (this *entityStore) Namespace(namespace string) []*kindStore {
+	stores := make([]*kindStore, 0)
+	for k, ks := range this.kinds {
+		if len(k) > len(namespace) && k[:len(namespace)+1] == namespace+"\x00" {
+			stores = append(stores, ks)
+		}
+	}
+	return stores
+}
+
+// own gives the store its own copies of the maps it shares with snapshots
+func (this *entityStore) own() {
+	if this.shared {
+		kinds := make(map[string]*kindStore, len(this.kinds))
+		for k, ks := range this.kinds {
+			kinds[k] = ks
+		}
+		this.kinds = kinds
+		composite := make(map[string][]*pb.Index, len(this.composite))
+		for k, defs := range this.composite {
+			// The slices are copied too, so appending to them doesn't write to the arrays of snapshots
+			composite[k] = append([]*pb.Index(nil), defs...)
+		}
+		this.composite = composite
+		this.shared = false
+	}
+}
+
+// writableKind returns a store for the kind of the key that may be written to
+func (this *entityStore) writableKind(key *pb.Reference) *kindStore {
+	this.own()
+	kind := keyKind(key)
+	k := kindStoreKey(key.GetNameSpace(), kind)
+	ks := this.kinds[k]
+	switch {
+	case ks == nil:
+		ks = newKindStore(kind, this.composite[kind])
+		this.kinds[k] = ks
+	case ks.shared:
+		ks = ks.clone()
+		this.kinds[k] = ks
+	}
+	return ks
+}
+
+func (this *entityStore) Put(key *pb.Reference, obj *pb.EntityProto) {
+	this.writableKind(key).Put(key, obj)
+}
+
+func (this *entityStore) Delete(key *pb.Reference) {
+	if this.Kind(key.GetNameSpace(), keyKind(key)) == nil {
+		return
+	}
+	this.writableKind(key).Delete(key)
+}
+
+func (this *entityStore) Get(key *pb.Reference) *pb.EntityProto {
+	ks := this.Kind(key.GetNameSpace(), keyKind(key))
+	if ks == nil {
+		return nil
+	}
+	return ks.entities[getDictKey(key)].Obj
+}
+
+// Entities returns the entities ordered by namespace and key
+func (this *entityStore) Entities() []entityDictEntity {
+	entries := make([]indexEntry, 0)
+	for _, ks := range this.kinds {
+		entries = append(entries, ks.byKey.Range(nil, nil)...)
+	}
+	sort.Sort(byDictKey(entries))
+	entities := make([]entityDictEntity, len(entries))
+	for i, entry := range entries {
+		entities[i] = this.kinds[kindStoreKey(entry.key.GetNameSpace(), keyKind(entry.key))].entities[entry.dictKey]
+	}
+	return entities
+}
+
+// AddIndex adds a composite index. Entities of the index' kind are indexed in all namespaces.
+func (this *entityStore) AddIndex(def *pb.Index) {
+	kind := def.GetEntityType()
+	this.own()
+	this.composite[kind] = append(this.composite[kind], def)
+	for k, ks := range this.kinds {
+		if ks.kind != kind {
+			continue
+		}
+		if ks.shared {
+			ks = ks.clone()
+			this.kinds[k] = ks
+		}
+		ks.AddIndex(def)
+	}
+}
+
+// share marks the store and all its kind stores as shared, and returns a copy of the store
+func (this *entityStore) share() *entityStore {
+	this.shared = true
+	for _, ks := range this.kinds {
+		ks.shared = true
+	}
+	return &entityStore{
+		kinds:     this.kinds,
+		composite: this.composite,
+		shared:    true,
+	}
+}
+
+func newKindStore(kind string, composite []*pb.Index) *kindStore {
+	ks := &kindStore{
+		kind:     kind,
+		entities: make(map[string]entityDictEntity),
+		byKey:    newIndex(nil),
+		builtin:  make(map[string]*index),
+	}
+	for _, def := range composite {
+		ks.composite = append(ks.composite, newCompositeIndex(def))
+	}
+	return ks
+}
+
+func (this *kindStore) clone() *kindStore {
+	ks := &kindStore{
+		kind:     this.kind,
+		entities: make(map[string]entityDictEntity, len(this.entities)),
+		byKey:    this.byKey.clone(),
+		builtin:  make(map[string]*index, len(this.builtin)),
+	}
+	for k, e := range this.entities {
+		ks.entities[k] = e
+	}
+	for name, idx := range this.builtin {
+		ks.builtin[name] = idx.clone()
+	}
+	for _, idx := range this.composite {
+		ks.composite = append(ks.composite, idx.clone())
+	}
+	return ks
+}
+
+func (this *kindStore) indexes() []*index {
+	indexes := make([]*index, 0, len(this.builtin)+len(this.composite)+1)
+	indexes = append(indexes, this.byKey)
+	for _, idx := range this.builtin {
+		indexes = append(indexes, idx)
+	}
+	return append(indexes, this.composite...)
+}
+
+func (this *kindStore) Put(key *pb.Reference, obj *pb.EntityProto) {
+	k := getDictKey(key)
+	if old, ok := this.entities[k]; ok {
+		for _, idx := range this.indexes() {
+			idx.Remove(old.Obj, k)
+		}
+	}
+	this.entities[k] = entityDictEntity{key, obj}
+	for _, p := range obj.GetProperty() {
+		if this.builtin[p.GetName()] == nil {
+			this.builtin[p.GetName()] = newIndex([]indexProperty{indexProperty{name: p.GetName()}})
+		}
+	}
+	for _, idx := range this.indexes() {
+		idx.Add(obj, k)
+	}
+}
+
+func (this *kindStore) Delete(key *pb.Reference) {
+	k := getDictKey(key)
+	old, ok := this.entities[k]
+	if !ok {
+		return
+	}
+	for _, idx := range this.indexes() {
+		idx.Remove(old.Obj, k)
+	}
+	delete(this.entities, k)
+}
+
+func (this *kindStore) AddIndex(def *pb.Index) {
+	idx := newCompositeIndex(def)
+	for k, e := range this.entities {
+		idx.Add(e.Obj, k)
+	}
+	this.composite = append(this.composite, idx)
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	pb "appengine_internal/datastore"
+	"time"
+)
+
+// DefaultTransactionTimeout is the time after which transactions expire, like in production
+const DefaultTransactionTimeout = 60 * time.Second
+
+// finishedTransactionRetention is the time for which the state of a finished transaction is kept. After that,
+// using the transaction returns a "not found" error instead of saying why it is no longer in progress.
+const finishedTransactionRetention = 10 * time.Minute
+
+// transactionState is the state of a transaction that is no longer in progress
+type transactionState int
+
+const (
+	transactionCommitted transactionState = iota + 1
+	transactionRolledBack
+	transactionExpired
+)
+
+// finishedTransaction is a transaction in the order transactions finished, see InMemoryDatastore.tFinishedOrder
+type finishedTransaction struct {
+	handle uint64
+	at     time.Time
+}
+
+func (this transactionState) String() string {
+	switch this {
+	case transactionCommitted:
+		return "committed"
+	case transactionRolledBack:
+		return "rolled back"
+	case transactionExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// SetTransactionTimeout sets the time after which transactions that are in progress expire. Using an expired
+// transaction returns a BAD_REQUEST error. A timeout of 0 means transactions never expire.
+func (this *InMemoryDatastore) SetTransactionTimeout(d time.Duration) {
+	this.tTimeout = d
+}
+
+// SetClock sets the function the datastore gets the current time from. The default is time.Now.
+func (this *InMemoryDatastore) SetClock(now func() time.Time) {
+	this.now = now
+}
+
+// activeTransaction returns the changes made in the transaction that is in progress with the given handle, or a
+// BAD_REQUEST error if there is no such transaction
+func (this *InMemoryDatastore) activeTransaction(handle uint64) (*entityDict, error) {
+	dict, ok := this.tEntities[handle]
+	if ok && this.tTimeout > 0 && !this.now().Before(dict.began.Add(this.tTimeout)) {
+		this.finishTransaction(handle, transactionExpired)
+		ok = false
+	}
+	if ok {
+		return dict, nil
+	}
+	if state, finished := this.tFinished[handle]; finished {
+		return nil, apiError(pb.Error_BAD_REQUEST, "transaction %d has already been %s", handle, state)
+	}
+	return nil, apiError(pb.Error_BAD_REQUEST, "transaction handle %d not found", handle)
+}
+
+// expireTransactions finishes the transactions in progress that have timed out. Transactions that are abandoned,
+// like the ones whose function panicked in RunInTransaction, are never used again, so without it they would stay in
+// progress, and the tasks held for them by the task queue would never be dropped.
+func (this *InMemoryDatastore) expireTransactions() {
+	if this.tTimeout <= 0 {
+		return
+	}
+	now := this.now()
+	for handle, dict := range this.tEntities {
+		if !now.Before(dict.began.Add(this.tTimeout)) {
+			this.finishTransaction(handle, transactionExpired)
+		}
+	}
+}
+
+// OnTransactionEnd sets a function that is called when a transaction is committed, rolled back or expires, with
+// whether it was committed. NewContext uses it to add the tasks that were added in a transaction to the task queue.
+func (this *InMemoryDatastore) OnTransactionEnd(f func(handle uint64, committed bool)) {
+	this.tEnd = f
+}
+
+// finishTransaction discards the transaction and records why it is no longer in progress. The states of
+// transactions that finished longer than finishedTransactionRetention ago are forgotten, and so are the ones that
+// finished after now, which happens when the clock is set back.
+func (this *InMemoryDatastore) finishTransaction(handle uint64, state transactionState) {
+	now := this.now()
+	for len(this.tFinishedOrder) > 0 {
+		if at := this.tFinishedOrder[0].at; !now.Before(at) && now.Sub(at) <= finishedTransactionRetention {
+			break
+		}
+		delete(this.tFinished, this.tFinishedOrder[0].handle)
+		this.tFinishedOrder = this.tFinishedOrder[1:]
+	}
+	delete(this.tEntities, handle)
+	this.tFinished[handle] = state
+	this.tFinishedOrder = append(this.tFinishedOrder, finishedTransaction{handle, now})
+	if this.tEnd != nil {
+		this.tEnd(handle, state == transactionCommitted)
+	}
+}
@@ -0,0 +1,64 @@
+package yamlfixture
+
+import (
+	"fmt"
+	"github.com/siniec/aeunit/datastore"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Read reads a fixture in YAML format
+func Read(r io.Reader) (datastore.Fixture, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var f datastore.Fixture
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("aeunit datastore: could not read fixture: %v", err)
+	}
+	return f, nil
+}
+
+// Write writes the fixture in YAML format
+func Write(w io.Writer, f datastore.Fixture) error {
+	b, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// LoadFile loads a YAML fixture file into the datastore
+func LoadFile(ds *datastore.InMemoryDatastore, path, appID string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	f, err := Read(file)
+	if err != nil {
+		return err
+	}
+	return ds.LoadFixture(f, appID)
+}
+
+// DumpFile writes all entities in the datastore to a YAML fixture file
+func DumpFile(ds *datastore.InMemoryDatastore, path string) error {
+	f, err := ds.DumpFixture()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Write(file, f); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,75 @@
+package yamlfixture
+
+import (
+	"bytes"
+	"github.com/siniec/aeunit/datastore"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testFixtureYAML = `
+- kind: Company
+  key: [Company, acme]
+  properties:
+  - {name: Name, type: string, value: Acme}
+- kind: Person
+  key: [Company, acme, Person, 1]
+  properties:
+  - {name: Name, type: string, value: Alice}
+  - {name: Age, type: int, value: 30}
+  - {name: Height, type: float, value: 1.7}
+  - {name: Weight, type: float, value: 60}
+  - {name: Admin, type: bool, value: true}
+  - {name: Tags, type: string, values: [a, b]}
+  - {name: Employer, type: key, value: [Company, acme]}
+  - {name: Born, type: time, value: "1990-01-02T15:04:05Z"}
+  - {name: Home, type: geo, value: {lat: 59.9, lng: 10.7}}
+  - {name: Owner, type: user, value: {email: alice@example.com, auth_domain: example.com}}
+  - {name: Bio, type: text, value: A long text}
+  - {name: Avatar, type: blob, value: AQID}
+`
+
+func TestYAMLFixture(t *testing.T) {
+	f, err := Read(strings.NewReader(testFixtureYAML))
+	if err != nil {
+		t.Errorf("Read returned error: %v", err)
+		t.FailNow()
+	}
+	ds := datastore.New()
+	if err = ds.LoadFixture(f, "dev~aeunit"); err != nil {
+		t.Errorf("LoadFixture returned error: %v", err)
+		t.FailNow()
+	}
+	dump, err := ds.DumpFixture()
+	PanicIfErr(err)
+	if len(dump) != 2 || len(dump[1].Properties) != 12 {
+		t.Errorf("DumpFixture returned unexpected entities: %v", dump)
+		t.FailNow()
+	}
+
+	// A dump can be written, and loaded into a datastore with the same state
+	var buf bytes.Buffer
+	PanicIfErr(Write(&buf, dump))
+	loaded, err := Read(&buf)
+	if err != nil {
+		t.Errorf("Reading a dumped fixture returned error: %v", err)
+		t.FailNow()
+	}
+	ds2 := datastore.New()
+	if err = ds2.LoadFixture(loaded, "dev~aeunit"); err != nil {
+		t.Errorf("Loading a dumped fixture returned error: %v", err)
+		t.FailNow()
+	}
+	dump2, err := ds2.DumpFixture()
+	PanicIfErr(err)
+	if !reflect.DeepEqual(dump2, dump) {
+		t.Errorf("Fixture changed after writing and loading it.\nGot  %v\nWant %v", dump2, dump)
+	}
+}
+
+func PanicIfErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,136 @@
+package aeunit
+
+import (
+	"appengine"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// delayPath is the path of the tasks added by appengine/delay
+const delayPath = "/_ah/queue/go/delay"
+
+// delayInvocation is the payload of a task added by appengine/delay
+type delayInvocation struct {
+	Key  string
+	Args []interface{}
+}
+
+var (
+	contextType = reflect.TypeOf((*appengine.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterDelayFunc registers a function that was declared with delay.Func(key, f), so RunDelayTasks can invoke it.
+// The delay package keeps its functions to itself, so tests register the ones they run again, with the same key.
+// It panics if f is not a function with a first argument of type appengine.Context, like delay.Func does.
+func (this *Context) RegisterDelayFunc(key string, f interface{}) {
+	fv := reflect.ValueOf(f)
+	if t := fv.Type(); t.Kind() != reflect.Func || t.NumIn() == 0 || t.In(0) != contextType {
+		panic(fmt.Sprintf("aeunit: delay func %s must be a function with a first argument of type appengine.Context", key))
+	}
+	this.delayFuncs[key] = fv
+}
+
+// delayFunc returns the registered function of the key of an invocation, which is the file the function was
+// declared in followed by the key it was declared with. A function registered with the whole key is preferred,
+// then the one with the longest key that the invocation's key ends with.
+func (this *Context) delayFunc(key string) (reflect.Value, bool) {
+	if fv, ok := this.delayFuncs[key]; ok {
+		return fv, true
+	}
+	match := ""
+	for k := range this.delayFuncs {
+		if strings.HasSuffix(key, ":"+k) && len(k) > len(match) {
+			match = k
+		}
+	}
+	if match == "" {
+		return reflect.Value{}, false
+	}
+	return this.delayFuncs[match], true
+}
+
+// RunDelayTasks runs the tasks of the default queue that are due, like RunTasks of the task queue, and returns the
+// number of tasks that ran. Tasks added by appengine/delay invoke their registered function with a new Context that
+// shares the services, clock and logger of this one, like the context of the task's request. Like in production,
+// a function that returns a non-nil error is retried with a backoff. Other tasks are served by
+// http.DefaultServeMux, where classic apps register their handlers.
+//
+// An error is returned if a delay task can't be decoded, its function was not registered, or its function
+// panicked. The task is then kept in the queue, and a task whose function panicked is retried with a backoff.
+func (this *Context) RunDelayTasks() (int, error) {
+	tq := this.TaskQueue()
+	if tq == nil {
+		return 0, fmt.Errorf("aeunit: the task queue service was replaced")
+	}
+	var err error
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != delayPath {
+			http.DefaultServeMux.ServeHTTP(w, req)
+			return
+		}
+		if e := this.runDelayFunc(w, req); e != nil && err == nil {
+			err = e
+		}
+	})
+	n, runErr := tq.RunTasks("default", handler)
+	if runErr != nil {
+		return n, runErr
+	}
+	return n, err
+}
+
+// runDelayFunc invokes the function of a delay task, like the handler of appengine/delay
+func (this *Context) runDelayFunc(w http.ResponseWriter, req *http.Request) error {
+	var inv delayInvocation
+	if err := gob.NewDecoder(req.Body).Decode(&inv); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return fmt.Errorf("aeunit: could not decode delay task %s: %v", req.Header.Get("X-AppEngine-TaskName"), err)
+	}
+	fv, ok := this.delayFunc(inv.Key)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return fmt.Errorf("aeunit: no delay func is registered for %s", inv.Key)
+	}
+
+	c := *this
+	ft := fv.Type()
+	in := []reflect.Value{reflect.ValueOf(&c)}
+	for _, arg := range inv.Args {
+		if arg != nil {
+			in = append(in, reflect.ValueOf(arg))
+			continue
+		}
+		// A nil argument is passed as the zero value of the parameter
+		n := len(in)
+		if !ft.IsVariadic() || n < ft.NumIn()-1 {
+			in = append(in, reflect.Zero(ft.In(n)))
+		} else {
+			in = append(in, reflect.Zero(ft.In(ft.NumIn()-1).Elem()))
+		}
+	}
+	out, err := callDelayFunc(fv, in)
+	if err != nil {
+		this.Errorf("delay: func failed (will retry): %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return fmt.Errorf("aeunit: delay func %s %v", inv.Key, err)
+	}
+	if n := ft.NumOut(); n > 0 && ft.Out(n-1) == errorType && !out[n-1].IsNil() {
+		this.Errorf("delay: func failed (will retry): %v", out[n-1].Interface())
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// callDelayFunc calls the function, and returns an error if it panics
+func callDelayFunc(fv reflect.Value, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panicked: %v", r)
+		}
+	}()
+	return fv.Call(in), nil
+}
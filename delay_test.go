@@ -0,0 +1,110 @@
+package aeunit
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"appengine/delay"
+	"errors"
+	"testing"
+	"time"
+)
+
+type delayed struct {
+	Value string
+}
+
+var failures int
+
+func putDelayed(c appengine.Context, id int64, value string) error {
+	if failures > 0 {
+		failures--
+		return errors.New("failed")
+	}
+	_, err := datastore.Put(c, datastore.NewKey(c, "Delayed", "", id, nil), &delayed{Value: value})
+	return err
+}
+
+func panicDelayed(c appengine.Context) {
+	panic("delayed panic")
+}
+
+var sent string
+
+func sendDelayed(c appengine.Context) {
+	sent = "send"
+}
+
+func sendMailDelayed(c appengine.Context) {
+	sent = "mail:send"
+}
+
+var (
+	putDelayedFunc      = delay.Func("put", putDelayed)
+	panicDelayedFunc    = delay.Func("panic", panicDelayed)
+	sendMailDelayedFunc = delay.Func("mail:send", sendMailDelayed)
+)
+
+func TestRunDelayTasks(t *testing.T) {
+	c := NewContext(nil)
+	c.RegisterDelayFunc("put", putDelayed)
+	c.RegisterDelayFunc("panic", panicDelayed)
+
+	putDelayedFunc.Call(c, int64(1), "value")
+	if n, err := c.RunDelayTasks(); n != 1 || err != nil {
+		t.Fatalf("RunDelayTasks ran %d tasks and returned %v, want 1 task", n, err)
+	}
+	var got delayed
+	if err := datastore.Get(c, datastore.NewKey(c, "Delayed", "", 1, nil), &got); err != nil || got.Value != "value" {
+		t.Errorf("Get of the entity put by the delay func returned %+v, %v", got, err)
+	}
+
+	// Functions that return an error are retried
+	failures = 1
+	putDelayedFunc.Call(c, int64(2), "retried")
+	c.RunDelayTasks()
+	if tasks := c.TaskQueue().Tasks("default"); len(tasks) != 1 || tasks[0].RetryCount != 1 {
+		t.Errorf("Queue had tasks %v after the delay func failed, want the task to be retried", tasks)
+	}
+	c.Clock().Advance(time.Second)
+	if n, err := c.RunDelayTasks(); n != 1 || err != nil {
+		t.Errorf("RunDelayTasks ran %d tasks and returned %v after the backoff, want the retried task", n, err)
+	}
+	if n := len(c.TaskQueue().Tasks("default")); n != 0 {
+		t.Errorf("Queue had %d tasks after the retried task succeeded, want 0", n)
+	}
+
+	// Panics fail the run, and are retried
+	panicDelayedFunc.Call(c)
+	if n, err := c.RunDelayTasks(); n != 1 || err == nil {
+		t.Errorf("RunDelayTasks of a panicking func ran %d tasks and returned %v, want 1 task and an error", n, err)
+	}
+	if tasks := c.TaskQueue().Tasks("default"); len(tasks) != 1 || tasks[0].RetryCount != 1 {
+		t.Errorf("Queue had tasks %v after the delay func panicked, want the task to be retried", tasks)
+	}
+	c.Clock().Advance(time.Second)
+	if n, err := c.RunDelayTasks(); n != 1 || err == nil {
+		t.Errorf("RunDelayTasks of a panicking func after the backoff ran %d tasks and returned %v, want 1 task and an error", n, err)
+	}
+
+	// Functions must be registered
+	c = NewContext(nil)
+	putDelayedFunc.Call(c, int64(3), "unregistered")
+	if _, err := c.RunDelayTasks(); err == nil {
+		t.Errorf("RunDelayTasks of an unregistered func did not return an error")
+	}
+}
+
+func TestRunDelayTasksKeys(t *testing.T) {
+	c := NewContext(nil)
+	c.RegisterDelayFunc("send", sendDelayed)
+	c.RegisterDelayFunc("mail:send", sendMailDelayed)
+
+	// The key that the invocation's key ends with the most of wins, whatever the order of the registered keys
+	for i := 0; i < 10; i++ {
+		sent = ""
+		sendMailDelayedFunc.Call(c)
+		if _, err := c.RunDelayTasks(); err != nil || sent != "mail:send" {
+			t.Fatalf("RunDelayTasks returned %v and ran the func of key %q, want the func of key mail:send", err, sent)
+		}
+	}
+}
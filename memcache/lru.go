@@ -0,0 +1,101 @@
+package memcache
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Statistics are the statistics of the memcache. Unlike the statistics returned by the Stats call, they include
+// the number of evicted items.
+type Statistics struct {
+	Hits     uint64 // Get calls that found the item
+	Misses   uint64 // Get calls that did not
+	ByteHits uint64 // bytes of the values returned by Get
+	Items    uint64
+	Bytes    uint64 // of the values of the items
+	Oldest   int64  // seconds since the least recently used item was used
+
+	Evictions uint64 // items that were evicted, because the memcache was full or at random
+}
+
+// SetCapacity sets the number of bytes the memcache holds. When a new item doesn't fit, the least recently used
+// items are evicted, like production does under memory pressure. The size of an item is the size of its key
+// (including the namespace) and value. The capacity is unlimited if 0, which is the default.
+func (this *InMemoryMemcache) SetCapacity(bytes int) {
+	this.capacity = bytes
+	this.evict()
+}
+
+// SetRandomEviction makes the memcache evict items at random, to test that code tolerates cache misses. Every
+// time an item is looked up, it is evicted with the given probability. Random eviction is off if the probability
+// is 0, which is the default.
+func (this *InMemoryMemcache) SetRandomEviction(probability float64) {
+	this.evictRate = probability
+}
+
+// SetEvictionSeed seeds the random numbers that decide which items are evicted at random. The seed is 1 by
+// default, so that tests are repeatable.
+func (this *InMemoryMemcache) SetEvictionSeed(seed int64) {
+	this.rand = rand.New(rand.NewSource(seed))
+}
+
+// Statistics returns the statistics of the memcache
+func (this *InMemoryMemcache) Statistics() Statistics {
+	stats := Statistics{
+		Hits:      this.hits,
+		Misses:    this.misses,
+		ByteHits:  this.byteHits,
+		Evictions: this.evictions,
+	}
+	var oldest time.Time
+	for _, it := range this.items {
+		if this.expired(it) || it.locked() {
+			continue
+		}
+		stats.Items++
+		stats.Bytes += uint64(len(it.value))
+		if oldest.IsZero() || it.accessed.Before(oldest) {
+			oldest = it.accessed
+		}
+	}
+	if !oldest.IsZero() {
+		stats.Oldest = int64(this.now().Sub(oldest) / time.Second)
+	}
+	return stats
+}
+
+func (this *item) size() int {
+	return len(this.key) + len(this.value)
+}
+
+// put stores the item as the most recently used one, replacing the item at its key, and evicts items if the
+// memcache is over its capacity
+func (this *InMemoryMemcache) put(it *item) {
+	if old, ok := this.items[it.key]; ok {
+		this.remove(old)
+	}
+	this.items[it.key] = it
+	it.elem = this.lru.PushFront(it)
+	this.bytes += it.size()
+	this.evict()
+}
+
+func (this *InMemoryMemcache) remove(it *item) {
+	delete(this.items, it.key)
+	this.lru.Remove(it.elem)
+	this.bytes -= it.size()
+}
+
+// touch marks the item as the most recently used one
+func (this *InMemoryMemcache) touch(it *item) {
+	it.accessed = this.now()
+	this.lru.MoveToFront(it.elem)
+}
+
+// evict removes the least recently used items until the memcache is within its capacity
+func (this *InMemoryMemcache) evict() {
+	for this.capacity > 0 && this.bytes > this.capacity {
+		this.remove(this.lru.Back().Value.(*item))
+		this.evictions++
+	}
+}
@@ -0,0 +1,70 @@
+package memcache
+
+import (
+	"appengine/memcache"
+	"fmt"
+	"testing"
+)
+
+func TestMemcacheLRU(t *testing.T) {
+	c := newContext(t)
+	// Items of 10 bytes: 1 for the namespace separator, 2 for the key and 7 for the value
+	c.mc.SetCapacity(30)
+	set := func(key string) {
+		PanicIfErr(memcache.Set(c, &memcache.Item{Key: key, Value: []byte("1234567")}))
+	}
+	cached := func() string {
+		s := ""
+		for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+			if _, ok := c.mc.items[itemKey("", []byte(key))]; ok {
+				s += key + " "
+			}
+		}
+		return s
+	}
+
+	set("k1")
+	set("k2")
+	set("k3")
+	if got := cached(); got != "k1 k2 k3 " {
+		t.Errorf("Cached items were %q, want %q", got, "k1 k2 k3 ")
+	}
+	// k1 was used more recently than k2
+	memcache.Get(c, "k1")
+	set("k4")
+	if got := cached(); got != "k1 k3 k4 " {
+		t.Errorf("Cached items after eviction were %q, want %q", got, "k1 k3 k4 ")
+	}
+	if _, err := memcache.Get(c, "k2"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of evicted item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+
+	// Lowering the capacity evicts items
+	c.mc.SetCapacity(10)
+	if got := cached(); got != "k4 " {
+		t.Errorf("Cached items after lowering the capacity were %q, want %q", got, "k4 ")
+	}
+	if stats := c.mc.Statistics(); stats.Evictions != 3 || stats.Items != 1 || stats.Bytes != 7 {
+		t.Errorf("Statistics were %+v, want 3 evictions and 1 item of 7 bytes", stats)
+	}
+}
+
+func TestMemcacheRandomEviction(t *testing.T) {
+	c := newContext(t)
+	for i := 0; i < 200; i++ {
+		PanicIfErr(memcache.Set(c, &memcache.Item{Key: fmt.Sprint(i), Value: []byte("value")}))
+	}
+	c.mc.SetRandomEviction(0.5)
+	misses := 0
+	for i := 0; i < 200; i++ {
+		if _, err := memcache.Get(c, fmt.Sprint(i)); err == memcache.ErrCacheMiss {
+			misses++
+		}
+	}
+	if misses < 60 || misses > 140 {
+		t.Errorf("%d of 200 items were evicted with a probability of 0.5", misses)
+	}
+	if n := c.mc.Statistics().Evictions; n != uint64(misses) {
+		t.Errorf("Statistics had %d evictions, want %d", n, misses)
+	}
+}
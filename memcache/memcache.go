@@ -0,0 +1,350 @@
+package memcache
+
+import (
+	"appengine_internal"
+	pb "appengine_internal/memcache"
+	"code.google.com/p/goprotobuf/proto"
+	"container/list"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Limits of the production memcache
+const (
+	maxKeySize       = 250     // bytes
+	maxValueSize     = 1000000 // bytes, of the key and the value plus an overhead
+	itemOverhead     = 73      // bytes
+	maxRelExpiration = 30 * 24 * 60 * 60
+)
+
+type item struct {
+	key        string // namespace and key, see itemKey
+	value      []byte
+	flags      uint32
+	casID      uint64
+	expires    time.Time // zero if the item does not expire
+	lockedTill time.Time // set for items that were deleted with a lock, until which they can't be added or replaced
+	accessed   time.Time
+	elem       *list.Element // of the item in the LRU list
+}
+
+// InMemoryMemcache is a memcache service that keeps its items in memory. Items are stored by namespace and key.
+type InMemoryMemcache struct {
+	items     map[string]*item
+	lru       *list.List // items, most recently used first
+	bytes     int        // size of the items
+	capacity  int        // in bytes, unlimited if 0
+	evictRate float64    // probability of evicting an item when it is looked up
+	rand      *rand.Rand // decides which items are evicted at random
+	casID     uint64     // of the last item that was stored
+	hits      uint64
+	misses    uint64
+	byteHits  uint64
+	evictions uint64
+	now       func() time.Time
+}
+
+func New() *InMemoryMemcache {
+	return &InMemoryMemcache{
+		items: make(map[string]*item),
+		lru:   list.New(),
+		rand:  rand.New(rand.NewSource(1)),
+		now:   time.Now,
+	}
+}
+
+func (this *InMemoryMemcache) Call(method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	switch method {
+	case "Get":
+		return this.Get(in.(*pb.MemcacheGetRequest), out.(*pb.MemcacheGetResponse))
+	case "Set":
+		return this.Set(in.(*pb.MemcacheSetRequest), out.(*pb.MemcacheSetResponse))
+	case "Delete":
+		return this.Delete(in.(*pb.MemcacheDeleteRequest), out.(*pb.MemcacheDeleteResponse))
+	case "Increment":
+		return this.Increment(in.(*pb.MemcacheIncrementRequest), out.(*pb.MemcacheIncrementResponse))
+	case "BatchIncrement":
+		return this.BatchIncrement(in.(*pb.MemcacheBatchIncrementRequest), out.(*pb.MemcacheBatchIncrementResponse))
+	case "FlushAll":
+		return this.FlushAll(in.(*pb.MemcacheFlushRequest), out.(*pb.MemcacheFlushResponse))
+	case "Stats":
+		return this.Stats(in.(*pb.MemcacheStatsRequest), out.(*pb.MemcacheStatsResponse))
+	default:
+		return fmt.Errorf("aeunit memcache: Unknown method %s", method)
+	}
+}
+
+func (this *InMemoryMemcache) Close() error {
+	return nil
+}
+
+// SetClock sets the function the memcache gets the current time from, which decides when items expire and
+// delete locks are released. The default is time.Now.
+func (this *InMemoryMemcache) SetClock(now func() time.Time) {
+	this.now = now
+}
+
+// apiError returns an application error of the memcache service, like the ones returned by production
+func apiError(code pb.MemcacheServiceError_ErrorCode, format string, v ...interface{}) error {
+	return &appengine_internal.APIError{
+		Service: "memcache",
+		Detail:  fmt.Sprintf(format, v...),
+		Code:    int32(code),
+	}
+}
+
+func checkKey(key []byte) error {
+	if len(key) > maxKeySize {
+		return apiError(pb.MemcacheServiceError_INVALID_VALUE, "key is longer than %d bytes", maxKeySize)
+	}
+	return nil
+}
+
+func itemKey(namespace string, key []byte) string {
+	return namespace + "\x00" + string(key)
+}
+
+// lookup returns the item stored at the key, if it has not expired. Expired items are removed. With random
+// eviction, the item may be evicted instead.
+func (this *InMemoryMemcache) lookup(k string) *item {
+	it, ok := this.items[k]
+	if !ok {
+		return nil
+	}
+	if this.expired(it) {
+		this.remove(it)
+		return nil
+	}
+	if this.evictRate > 0 && this.rand.Float64() < this.evictRate {
+		this.remove(it)
+		this.evictions++
+		return nil
+	}
+	return it
+}
+
+// expired returns whether the item has expired, or its delete lock was released
+func (this *InMemoryMemcache) expired(it *item) bool {
+	now := this.now()
+	return !it.expires.IsZero() && !now.Before(it.expires) || !it.lockedTill.IsZero() && !now.Before(it.lockedTill)
+}
+
+// locked returns whether the item was deleted with a lock
+func (this *item) locked() bool {
+	return !this.lockedTill.IsZero()
+}
+
+// expiration returns the time an item set with the given expiration time expires. Like in production, an
+// expiration time of up to 30 days is relative to now, and a larger one is a unix timestamp.
+func (this *InMemoryMemcache) expiration(t uint32) time.Time {
+	switch {
+	case t == 0:
+		return time.Time{}
+	case t <= maxRelExpiration:
+		return this.now().Add(time.Duration(t) * time.Second)
+	default:
+		return time.Unix(int64(t), 0)
+	}
+}
+
+// store stores the value at the key, with a new CAS ID
+func (this *InMemoryMemcache) store(k string, value []byte, flags uint32, expires time.Time) {
+	this.casID++
+	this.put(&item{
+		key:      k,
+		value:    append([]byte{}, value...),
+		flags:    flags,
+		casID:    this.casID,
+		expires:  expires,
+		accessed: this.now(),
+	})
+}
+
+func (this *InMemoryMemcache) Get(req *pb.MemcacheGetRequest, res *pb.MemcacheGetResponse) error {
+	for _, key := range req.Key {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range req.Key {
+		it := this.lookup(itemKey(req.GetNameSpace(), key))
+		if it == nil || it.locked() {
+			this.misses++
+			continue
+		}
+		this.hits++
+		this.byteHits += uint64(len(it.value))
+		this.touch(it)
+		resItem := &pb.MemcacheGetResponse_Item{
+			Key:   key,
+			Value: append([]byte{}, it.value...),
+			Flags: proto.Uint32(it.flags),
+		}
+		if req.GetForCas() {
+			resItem.CasId = proto.Uint64(it.casID)
+		}
+		if !it.expires.IsZero() {
+			resItem.ExpiresInSeconds = proto.Int32(int32(it.expires.Sub(this.now()) / time.Second))
+		}
+		res.Item = append(res.Item, resItem)
+	}
+	return nil
+}
+
+func (this *InMemoryMemcache) Set(req *pb.MemcacheSetRequest, res *pb.MemcacheSetResponse) error {
+	for _, reqItem := range req.Item {
+		if err := checkKey(reqItem.Key); err != nil {
+			return err
+		}
+	}
+	res.SetStatus = make([]pb.MemcacheSetResponse_SetStatusCode, len(req.Item))
+	for i, reqItem := range req.Item {
+		res.SetStatus[i] = this.set(req.GetNameSpace(), reqItem)
+	}
+	return nil
+}
+
+// set stores the item according to its set policy, and returns the status of the item
+func (this *InMemoryMemcache) set(namespace string, reqItem *pb.MemcacheSetRequest_Item) pb.MemcacheSetResponse_SetStatusCode {
+	if len(reqItem.Key)+len(reqItem.Value)+itemOverhead > maxValueSize {
+		return pb.MemcacheSetResponse_ERROR
+	}
+	k := itemKey(namespace, reqItem.Key)
+	old := this.lookup(k)
+	switch reqItem.GetSetPolicy() {
+	case pb.MemcacheSetRequest_ADD:
+		if old != nil {
+			return pb.MemcacheSetResponse_NOT_STORED
+		}
+	case pb.MemcacheSetRequest_REPLACE:
+		if old == nil || old.locked() {
+			return pb.MemcacheSetResponse_NOT_STORED
+		}
+	case pb.MemcacheSetRequest_CAS:
+		if old == nil || old.locked() || reqItem.CasId == nil {
+			return pb.MemcacheSetResponse_NOT_STORED
+		}
+		if old.casID != reqItem.GetCasId() {
+			return pb.MemcacheSetResponse_EXISTS
+		}
+	}
+	this.store(k, reqItem.Value, reqItem.GetFlags(), this.expiration(reqItem.GetExpirationTime()))
+	return pb.MemcacheSetResponse_STORED
+}
+
+func (this *InMemoryMemcache) Delete(req *pb.MemcacheDeleteRequest, res *pb.MemcacheDeleteResponse) error {
+	for _, reqItem := range req.Item {
+		if err := checkKey(reqItem.Key); err != nil {
+			return err
+		}
+	}
+	res.DeleteStatus = make([]pb.MemcacheDeleteResponse_DeleteStatusCode, len(req.Item))
+	for i, reqItem := range req.Item {
+		k := itemKey(req.GetNameSpace(), reqItem.Key)
+		it := this.lookup(k)
+		if it == nil || it.locked() {
+			res.DeleteStatus[i] = pb.MemcacheDeleteResponse_NOT_FOUND
+			continue
+		}
+		res.DeleteStatus[i] = pb.MemcacheDeleteResponse_DELETED
+		if lock := reqItem.GetDeleteTime(); lock > 0 {
+			// The key can't be added or replaced until the lock expires
+			this.put(&item{key: k, lockedTill: this.expiration(lock), accessed: this.now()})
+		} else {
+			this.remove(it)
+		}
+	}
+	return nil
+}
+
+func (this *InMemoryMemcache) Increment(req *pb.MemcacheIncrementRequest, res *pb.MemcacheIncrementResponse) error {
+	if err := checkKey(req.Key); err != nil {
+		return err
+	}
+	this.increment(req.GetNameSpace(), req, res)
+	return nil
+}
+
+func (this *InMemoryMemcache) BatchIncrement(req *pb.MemcacheBatchIncrementRequest, res *pb.MemcacheBatchIncrementResponse) error {
+	for _, reqItem := range req.Item {
+		if err := checkKey(reqItem.Key); err != nil {
+			return err
+		}
+	}
+	res.Item = make([]*pb.MemcacheIncrementResponse, len(req.Item))
+	for i, reqItem := range req.Item {
+		res.Item[i] = &pb.MemcacheIncrementResponse{}
+		this.increment(req.GetNameSpace(), reqItem, res.Item[i])
+	}
+	return nil
+}
+
+// increment adds the delta to the decimal value of the item. Like in production, increments wrap around at
+// 2^64 and decrements stop at 0. A missing item is created with the initial value, if the request has one, unless
+// it was deleted with a lock that didn't expire yet.
+func (this *InMemoryMemcache) increment(namespace string, req *pb.MemcacheIncrementRequest, res *pb.MemcacheIncrementResponse) {
+	k := itemKey(namespace, req.Key)
+	it := this.lookup(k)
+	if it != nil && it.locked() {
+		// Like adds, increments can't recreate an item while it is locked by a delete
+		res.IncrementStatus = pb.MemcacheIncrementResponse_NOT_CHANGED.Enum()
+		return
+	}
+	var value uint64
+	if it != nil {
+		var err error
+		if value, err = strconv.ParseUint(string(it.value), 10, 64); err != nil {
+			res.IncrementStatus = pb.MemcacheIncrementResponse_ERROR.Enum()
+			return
+		}
+	} else if req.InitialValue != nil {
+		value = req.GetInitialValue()
+	} else {
+		res.IncrementStatus = pb.MemcacheIncrementResponse_NOT_CHANGED.Enum()
+		return
+	}
+
+	delta := req.GetDelta()
+	if req.GetDirection() == pb.MemcacheIncrementRequest_DECREMENT {
+		if delta > value {
+			value = 0
+		} else {
+			value -= delta
+		}
+	} else {
+		value += delta
+	}
+
+	encoded := []byte(strconv.FormatUint(value, 10))
+	if it != nil {
+		// Increments keep the expiration and flags of the item
+		this.store(k, encoded, it.flags, it.expires)
+	} else {
+		this.store(k, encoded, req.GetInitialFlags(), time.Time{})
+	}
+	res.NewValue = proto.Uint64(value)
+	res.IncrementStatus = pb.MemcacheIncrementResponse_OK.Enum()
+}
+
+func (this *InMemoryMemcache) FlushAll(req *pb.MemcacheFlushRequest, res *pb.MemcacheFlushResponse) error {
+	this.items = make(map[string]*item)
+	this.lru.Init()
+	this.bytes = 0
+	this.hits, this.misses, this.byteHits, this.evictions = 0, 0, 0, 0
+	return nil
+}
+
+func (this *InMemoryMemcache) Stats(req *pb.MemcacheStatsRequest, res *pb.MemcacheStatsResponse) error {
+	stats := this.Statistics()
+	res.Stats = &pb.MergedNamespaceStats{
+		Hits:          proto.Uint64(stats.Hits),
+		Misses:        proto.Uint64(stats.Misses),
+		ByteHits:      proto.Uint64(stats.ByteHits),
+		Items:         proto.Uint64(stats.Items),
+		Bytes:         proto.Uint64(stats.Bytes),
+		OldestItemAge: proto.Uint32(uint32(stats.Oldest)),
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package memcache
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"appengine_internal"
+	pb "appengine_internal/memcache"
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcacheGetSet(t *testing.T) {
+	c := newContext(t)
+	if _, err := memcache.Get(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of missing item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "key", Value: []byte("value"), Flags: 3}))
+	item, err := memcache.Get(c, "key")
+	PanicIfErr(err)
+	if string(item.Value) != "value" || item.Flags != 3 {
+		t.Errorf("Get returned %q with flags %d, want %q with flags 3", item.Value, item.Flags, "value")
+	}
+	items, err := memcache.GetMulti(c, []string{"key", "missing"})
+	PanicIfErr(err)
+	if len(items) != 1 || items["key"] == nil {
+		t.Errorf("GetMulti returned %v, want only the item at key", items)
+	}
+
+	// Add and replace
+	if err = memcache.Add(c, &memcache.Item{Key: "key", Value: []byte("added")}); err != memcache.ErrNotStored {
+		t.Errorf("Add of existing item returned %v, want %v", err, memcache.ErrNotStored)
+	}
+	PanicIfErr(memcache.Add(c, &memcache.Item{Key: "new", Value: []byte("added")}))
+	req := &pb.MemcacheSetRequest{Item: []*pb.MemcacheSetRequest_Item{
+		&pb.MemcacheSetRequest_Item{Key: []byte("key"), Value: []byte("replaced"), SetPolicy: pb.MemcacheSetRequest_REPLACE.Enum()},
+		&pb.MemcacheSetRequest_Item{Key: []byte("missing"), Value: []byte("replaced"), SetPolicy: pb.MemcacheSetRequest_REPLACE.Enum()},
+	}}
+	res := &pb.MemcacheSetResponse{}
+	PanicIfErr(c.mc.Set(req, res))
+	if s := res.SetStatus; len(s) != 2 || s[0] != pb.MemcacheSetResponse_STORED || s[1] != pb.MemcacheSetResponse_NOT_STORED {
+		t.Errorf("Replace returned statuses %v, want [STORED NOT_STORED]", s)
+	}
+
+	// Compare and swap
+	item, err = memcache.Get(c, "key")
+	PanicIfErr(err)
+	other, err := memcache.Get(c, "key")
+	PanicIfErr(err)
+	item.Value = []byte("swapped")
+	PanicIfErr(memcache.CompareAndSwap(c, item))
+	if err = memcache.CompareAndSwap(c, other); err != memcache.ErrCASConflict {
+		t.Errorf("CompareAndSwap of changed item returned %v, want %v", err, memcache.ErrCASConflict)
+	}
+	PanicIfErr(memcache.Delete(c, "key"))
+	if err = memcache.CompareAndSwap(c, item); err != memcache.ErrNotStored {
+		t.Errorf("CompareAndSwap of deleted item returned %v, want %v", err, memcache.ErrNotStored)
+	}
+
+	// Values are copied
+	value := []byte("value")
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "copied", Value: value}))
+	value[0] = 'V'
+	if item, _ = memcache.Get(c, "copied"); string(item.Value) != "value" {
+		t.Errorf("Changing the value that was set changed the item to %q", item.Value)
+	}
+
+	// Limits
+	if err = memcache.Set(c, &memcache.Item{Key: "big", Value: make([]byte, maxValueSize)}); err != memcache.ErrServerError {
+		t.Errorf("Set of too big value returned %v, want %v", err, memcache.ErrServerError)
+	}
+	if _, err = memcache.Get(c, strings.Repeat("k", maxKeySize+1)); err == nil {
+		t.Errorf("Get of too long key did not return an error")
+	}
+
+	// Namespaces
+	getNS := &pb.MemcacheGetRequest{Key: [][]byte{[]byte("copied")}, NameSpace: proto.String("other")}
+	getRes := &pb.MemcacheGetResponse{}
+	PanicIfErr(c.mc.Get(getNS, getRes))
+	if len(getRes.Item) != 0 {
+		t.Errorf("Get in other namespace returned %v, want no items", getRes.Item)
+	}
+}
+
+func TestMemcacheDelete(t *testing.T) {
+	c := newContext(t)
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "key", Value: []byte("value")}))
+	PanicIfErr(memcache.Delete(c, "key"))
+	if _, err := memcache.Get(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of deleted item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	if err := memcache.Delete(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Delete of missing item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+
+	// Deleted keys with a lock can be set, but not added
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "key", Value: []byte("value")}))
+	req := &pb.MemcacheDeleteRequest{Item: []*pb.MemcacheDeleteRequest_Item{
+		&pb.MemcacheDeleteRequest_Item{Key: []byte("key"), DeleteTime: proto.Uint32(10)},
+	}}
+	PanicIfErr(c.mc.Delete(req, &pb.MemcacheDeleteResponse{}))
+	if _, err := memcache.Get(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of locked item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	if err := memcache.Add(c, &memcache.Item{Key: "key", Value: []byte("added")}); err != memcache.ErrNotStored {
+		t.Errorf("Add of locked item returned %v, want %v", err, memcache.ErrNotStored)
+	}
+	if _, err := memcache.Increment(c, "key", 1, 10); err != memcache.ErrCacheMiss {
+		t.Errorf("Increment of locked item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	if _, err := memcache.Get(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of locked item after Increment returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "key", Value: []byte("set")}))
+	if item, err := memcache.Get(c, "key"); err != nil || string(item.Value) != "set" {
+		t.Errorf("Get after Set of locked item returned %v, %v", item, err)
+	}
+
+	PanicIfErr(memcache.Flush(c))
+	if _, err := memcache.Get(c, "key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get after Flush returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	c := newContext(t)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.mc.SetClock(func() time.Time { return now })
+	get := func(key string) error {
+		_, err := memcache.Get(c, key)
+		return err
+	}
+
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "relative", Value: []byte("v"), Expiration: time.Minute}))
+	req := &pb.MemcacheSetRequest{Item: []*pb.MemcacheSetRequest_Item{&pb.MemcacheSetRequest_Item{
+		Key:            []byte("absolute"),
+		Value:          []byte("v"),
+		ExpirationTime: proto.Uint32(uint32(now.Add(time.Hour).Unix())),
+	}}}
+	PanicIfErr(c.mc.Set(req, &pb.MemcacheSetResponse{}))
+	cas, err := memcache.Get(c, "relative")
+	PanicIfErr(err)
+
+	now = now.Add(59 * time.Second)
+	if err = get("relative"); err != nil {
+		t.Errorf("Get before the expiration returned %v", err)
+	}
+	getRes := &pb.MemcacheGetResponse{}
+	PanicIfErr(c.mc.Get(&pb.MemcacheGetRequest{Key: [][]byte{[]byte("relative")}}, getRes))
+	if s := getRes.Item[0].GetExpiresInSeconds(); s != 1 {
+		t.Errorf("Item expires in %d seconds, want 1", s)
+	}
+	now = now.Add(time.Second)
+	if err = get("relative"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get after the expiration returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	if err = memcache.CompareAndSwap(c, cas); err != memcache.ErrNotStored {
+		t.Errorf("CompareAndSwap of expired item returned %v, want %v", err, memcache.ErrNotStored)
+	}
+	if err = get("absolute"); err != nil {
+		t.Errorf("Get before the absolute expiration returned %v", err)
+	}
+	now = now.Add(time.Hour)
+	if err = get("absolute"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get after the absolute expiration returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+
+	// Delete locks are released after their delete time
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "locked", Value: []byte("v")}))
+	del := &pb.MemcacheDeleteRequest{Item: []*pb.MemcacheDeleteRequest_Item{
+		&pb.MemcacheDeleteRequest_Item{Key: []byte("locked"), DeleteTime: proto.Uint32(10)},
+	}}
+	PanicIfErr(c.mc.Delete(del, &pb.MemcacheDeleteResponse{}))
+	now = now.Add(9 * time.Second)
+	if err = memcache.Add(c, &memcache.Item{Key: "locked", Value: []byte("v")}); err != memcache.ErrNotStored {
+		t.Errorf("Add during the delete lock returned %v, want %v", err, memcache.ErrNotStored)
+	}
+	now = now.Add(time.Second)
+	if err = memcache.Add(c, &memcache.Item{Key: "locked", Value: []byte("v")}); err != nil {
+		t.Errorf("Add after the delete lock returned %v", err)
+	}
+}
+
+func TestMemcacheIncrement(t *testing.T) {
+	c := newContext(t)
+	if _, err := memcache.IncrementExisting(c, "counter", 1); err != memcache.ErrCacheMiss {
+		t.Errorf("IncrementExisting of missing item returned %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	tests := []struct {
+		delta int64
+		want  uint64
+	}{
+		{5, 15},
+		{-3, 12},
+		{-20, 0},
+		{-1 << 63, 0},
+	}
+	for _, test := range tests {
+		v, err := memcache.Increment(c, "counter", test.delta, 10)
+		if err != nil || v != test.want {
+			t.Errorf("Increment by %d returned %d, %v, want %d", test.delta, v, err, test.want)
+		}
+	}
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "counter", Value: []byte("18446744073709551615")}))
+	if v, err := memcache.Increment(c, "counter", 2, 0); err != nil || v != 1 {
+		t.Errorf("Increment past the max value returned %d, %v, want 1", v, err)
+	}
+	if item, _ := memcache.Get(c, "counter"); string(item.Value) != "1" {
+		t.Errorf("Incremented item had value %q, want %q", item.Value, "1")
+	}
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "text", Value: []byte("text")}))
+	if _, err := memcache.Increment(c, "text", 1, 0); err == nil {
+		t.Errorf("Increment of non-numeric value did not return an error")
+	}
+
+	req := &pb.MemcacheBatchIncrementRequest{Item: []*pb.MemcacheIncrementRequest{
+		&pb.MemcacheIncrementRequest{Key: []byte("counter"), Delta: proto.Uint64(1)},
+		&pb.MemcacheIncrementRequest{Key: []byte("missing"), Delta: proto.Uint64(1)},
+		&pb.MemcacheIncrementRequest{Key: []byte("new"), Delta: proto.Uint64(1), InitialValue: proto.Uint64(7)},
+	}}
+	res := &pb.MemcacheBatchIncrementResponse{}
+	PanicIfErr(c.mc.BatchIncrement(req, res))
+	want := []string{"OK 2", "NOT_CHANGED 0", "OK 8"}
+	for i, item := range res.Item {
+		if got := fmt.Sprintf("%v %d", item.GetIncrementStatus(), item.GetNewValue()); got != want[i] {
+			t.Errorf("BatchIncrement returned %s for item %d, want %s", got, i, want[i])
+		}
+	}
+}
+
+func TestMemcacheStats(t *testing.T) {
+	c := newContext(t)
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "a", Value: []byte("12345")}))
+	PanicIfErr(memcache.Set(c, &memcache.Item{Key: "b", Value: []byte("1")}))
+	memcache.GetMulti(c, []string{"a", "b", "c"})
+	stats, err := memcache.Stats(c)
+	PanicIfErr(err)
+	want := memcache.Statistics{Hits: 2, Misses: 1, ByteHits: 6, Items: 2, Bytes: 6}
+	if *stats != want {
+		t.Errorf("Stats returned %+v, want %+v", *stats, want)
+	}
+}
+
+type testContext struct {
+	t  *testing.T
+	mc *InMemoryMemcache
+}
+
+func newContext(t *testing.T) *testContext {
+	return &testContext{t: t, mc: New()}
+}
+
+func (this *testContext) Debugf(s string, v ...interface{}) {
+	this.t.Logf(s, v...)
+}
+func (this *testContext) Infof(s string, v ...interface{})     { this.Debugf(s, v...) }
+func (this *testContext) Warningf(s string, v ...interface{})  { this.Debugf(s, v...) }
+func (this *testContext) Errorf(s string, v ...interface{})    { this.Debugf(s, v...) }
+func (this *testContext) Criticalf(s string, v ...interface{}) { this.Debugf(s, v...) }
+func (this *testContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if service != "memcache" {
+		return fmt.Errorf("Unknown service: %s", service)
+	}
+	return this.mc.Call(method, in, out, opts)
+}
+func (this *testContext) FullyQualifiedAppID() string { return "dev~aeunit" }
+func (this *testContext) Request() interface{}        { panic("Request() is not implemented") }
+
+var _ appengine.Context = &testContext{}
+
+func PanicIfErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
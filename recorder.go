@@ -0,0 +1,114 @@
+package aeunit
+
+import (
+	"appengine_internal"
+	dspb "appengine_internal/datastore"
+	"code.google.com/p/goprotobuf/proto"
+	"time"
+)
+
+// Record is a service call made through a Context
+type Record struct {
+	Service  string
+	Method   string
+	In       appengine_internal.ProtoMessage // copy of the request
+	Out      appengine_internal.ProtoMessage // copy of the response
+	Err      error
+	Start    time.Time     // on the clock of the context
+	Duration time.Duration // on the clock of the context, which only advances with Advance and latency faults
+}
+
+// Recorder records the service calls made through a Context. Its assertion helpers report failures to a
+// *testing.T, for example to guard against N+1 datastore access:
+//
+//	r := c.Record()
+//	loadDashboard(c)
+//	r.ExpectCalls(t, "datastore_v3", "Get", 2)
+//	r.ExpectNoQueries(t, "Comment")
+type Recorder struct {
+	Records []Record
+}
+
+// TestingT is the part of *testing.T used by the Recorder's assertion helpers
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Record starts recording the service calls made through the context, and returns the recorder they are
+// recorded to. A previous recorder stops recording.
+func (this *Context) Record() *Recorder {
+	this.recorder = &Recorder{}
+	return this.recorder
+}
+
+// StopRecording stops recording service calls
+func (this *Context) StopRecording() {
+	this.recorder = nil
+}
+
+func (this *Recorder) record(service, method string, in, out appengine_internal.ProtoMessage, start, end time.Time, err error) {
+	this.Records = append(this.Records, Record{
+		Service:  service,
+		Method:   method,
+		In:       cloneMessage(in),
+		Out:      cloneMessage(out),
+		Err:      err,
+		Start:    start,
+		Duration: end.Sub(start),
+	})
+}
+
+// Calls returns the records of the calls to the service method. An empty method matches all methods of the service.
+func (this *Recorder) Calls(service, method string) []Record {
+	records := make([]Record, 0)
+	for _, r := range this.Records {
+		if r.Service == service && (method == "" || r.Method == method) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// Queries returns the records of the datastore queries on the kind
+func (this *Recorder) Queries(kind string) []Record {
+	records := make([]Record, 0)
+	for _, r := range this.Calls("datastore_v3", "RunQuery") {
+		if q, ok := r.In.(*dspb.Query); ok && q.GetKind() == kind {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// Reset removes all records
+func (this *Recorder) Reset() {
+	this.Records = nil
+}
+
+// ExpectCalls reports an error if the service method was not called exactly n times
+func (this *Recorder) ExpectCalls(t TestingT, service, method string, n int) {
+	if got := len(this.Calls(service, method)); got != n {
+		t.Errorf("aeunit: %s.%s was called %d times, want %d", service, method, got, n)
+	}
+}
+
+// ExpectMaxCalls reports an error if the service method was called more than n times
+func (this *Recorder) ExpectMaxCalls(t TestingT, service, method string, n int) {
+	if got := len(this.Calls(service, method)); got > n {
+		t.Errorf("aeunit: %s.%s was called %d times, want at most %d", service, method, got, n)
+	}
+}
+
+// ExpectNoQueries reports an error if the kind was queried
+func (this *Recorder) ExpectNoQueries(t TestingT, kind string) {
+	if got := len(this.Queries(kind)); got != 0 {
+		t.Errorf("aeunit: kind %s was queried %d times, want no queries", kind, got)
+	}
+}
+
+func cloneMessage(m appengine_internal.ProtoMessage) appengine_internal.ProtoMessage {
+	if m == nil {
+		return nil
+	}
+	return proto.Clone(m)
+}
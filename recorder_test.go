@@ -0,0 +1,94 @@
+package aeunit
+
+import (
+	"appengine/datastore"
+	"fmt"
+	aedatastore "github.com/siniec/aeunit/datastore"
+	"testing"
+	"time"
+)
+
+type fakeT struct {
+	errors []string
+}
+
+func (this *fakeT) Errorf(format string, args ...interface{}) {
+	this.errors = append(this.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRecorder(t *testing.T) {
+	c := NewContext(nil)
+	type Thing struct {
+		Name string
+	}
+	key := datastore.NewKey(c, "Thing", "", 1, nil)
+	if _, err := datastore.Put(c, key, &Thing{"a"}); err != nil {
+		t.Fatalf("Put returned error %v", err)
+	}
+
+	r := c.Record()
+	for i := 0; i < 2; i++ {
+		if err := datastore.Get(c, key, &Thing{}); err != nil {
+			t.Fatalf("Get returned error %v", err)
+		}
+	}
+	if _, err := datastore.NewQuery("Thing").GetAll(c, &[]Thing{}); err != nil {
+		t.Fatalf("GetAll returned error %v", err)
+	}
+	c.StopRecording()
+	datastore.Get(c, key, &Thing{})
+
+	if n := len(r.Records); n != 3 {
+		t.Errorf("Recorded %d calls, want 3", n)
+	}
+	gets := r.Calls("datastore_v3", "Get")
+	if len(gets) != 2 {
+		t.Fatalf("Recorded %d Get calls, want 2", len(gets))
+	}
+	if gets[0].In == nil || gets[0].Out == nil || gets[0].Err != nil {
+		t.Errorf("Record of Get did not have the request and response. Got %+v", gets[0])
+	}
+
+	// Passing assertions
+	ft := &fakeT{}
+	r.ExpectCalls(ft, "datastore_v3", "Get", 2)
+	r.ExpectMaxCalls(ft, "datastore_v3", "", 3)
+	r.ExpectNoQueries(ft, "Other")
+	if len(ft.errors) != 0 {
+		t.Errorf("Assertions failed: %v", ft.errors)
+	}
+
+	// Failing assertions
+	ft = &fakeT{}
+	r.ExpectCalls(ft, "datastore_v3", "Get", 1)
+	r.ExpectMaxCalls(ft, "datastore_v3", "", 2)
+	r.ExpectNoQueries(ft, "Thing")
+	if len(ft.errors) != 3 {
+		t.Errorf("%d assertions failed, want 3: %v", len(ft.errors), ft.errors)
+	}
+
+	r.Reset()
+	if len(r.Records) != 0 {
+		t.Errorf("Reset did not remove the records")
+	}
+}
+
+func TestRecorderClock(t *testing.T) {
+	c := NewContext(nil)
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Clock().Set(start)
+	ds := c.services["datastore_v3"].(*aedatastore.InMemoryDatastore)
+	if err := ds.InjectFault(aedatastore.Fault{Method: "Get", Latency: time.Hour}); err != nil {
+		t.Fatalf("InjectFault returned error %v", err)
+	}
+
+	// Calls are timed on the clock of the context
+	r := c.Record()
+	datastore.Get(c, datastore.NewKey(c, "Thing", "", 1, nil), &struct{}{})
+	if n := len(r.Records); n != 1 {
+		t.Fatalf("Recorded %d calls, want 1", n)
+	}
+	if rec := r.Records[0]; !rec.Start.Equal(start) || rec.Duration != time.Hour {
+		t.Errorf("Recorded call started at %v and took %v, want %v and %v", rec.Start, rec.Duration, start, time.Hour)
+	}
+}
@@ -0,0 +1,107 @@
+package taskqueue
+
+import (
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+	"time"
+)
+
+// Limits of production pull queues
+const (
+	maxLease      = 7 * 24 * time.Hour
+	maxLeaseTasks = 1000
+)
+
+// QueryAndOwnTasks leases the pull tasks of a queue that are due, in order of ETA. The ETA of a leased task is
+// moved to the end of its lease, so it can't be leased again until the lease expires on the task queue's clock.
+// With group by tag, only tasks with the tag are leased, or if no tag is given, tasks with the tag of the first
+// task.
+func (this *InMemoryTaskQueue) QueryAndOwnTasks(req *pb.TaskQueueQueryAndOwnTasksRequest, res *pb.TaskQueueQueryAndOwnTasksResponse) error {
+	q, err := this.queue(string(req.QueueName))
+	if err != nil {
+		return err
+	}
+	if q.def != nil && !q.def.pull() {
+		return apiError(pb.TaskQueueServiceError_INVALID_QUEUE_MODE, "queue %s is not a pull queue", req.QueueName)
+	}
+	lease, err := leaseDuration(req.GetLeaseSeconds())
+	if err != nil {
+		return err
+	}
+	if req.GetMaxTasks() <= 0 || req.GetMaxTasks() > maxLeaseTasks {
+		return apiError(pb.TaskQueueServiceError_INVALID_REQUEST, "max tasks must be between 1 and %d", maxLeaseTasks)
+	}
+
+	now := this.now()
+	tag, tagged := string(req.Tag), len(req.Tag) > 0
+	res.Task = make([]*pb.TaskQueueQueryAndOwnTasksResponse_Task, 0)
+	for _, t := range q.sorted() {
+		if int64(len(res.Task)) >= req.GetMaxTasks() {
+			break
+		}
+		if t.Method != "PULL" || t.ETA.After(now) {
+			continue
+		}
+		if req.GetGroupByTag() {
+			if !tagged {
+				tag, tagged = t.Tag, true
+			}
+			if t.Tag != tag {
+				continue
+			}
+		}
+		t.ETA = now.Add(lease)
+		t.RetryCount++
+		resTask := &pb.TaskQueueQueryAndOwnTasksResponse_Task{
+			TaskName:   []byte(t.Name),
+			EtaUsec:    proto.Int64(usec(t.ETA)),
+			RetryCount: proto.Int32(int32(t.RetryCount)),
+			Body:       append([]byte{}, t.Payload...),
+		}
+		if t.Tag != "" {
+			resTask.Tag = []byte(t.Tag)
+		}
+		res.Task = append(res.Task, resTask)
+	}
+	return nil
+}
+
+// ModifyTaskLease extends or ends the lease of a leased task. The request has the ETA the task was leased
+// until, to show it still owns the lease.
+func (this *InMemoryTaskQueue) ModifyTaskLease(req *pb.TaskQueueModifyTaskLeaseRequest, res *pb.TaskQueueModifyTaskLeaseResponse) error {
+	q, err := this.queue(string(req.QueueName))
+	if err != nil {
+		return err
+	}
+	// A lease of 0 ends the lease
+	lease := time.Duration(req.GetLeaseSeconds() * float64(time.Second))
+	if lease < 0 || lease > maxLease {
+		return apiError(pb.TaskQueueServiceError_INVALID_REQUEST, "lease seconds must be at least 0 and at most %v", maxLease.Seconds())
+	}
+	name := string(req.TaskName)
+	t := q.tasks[name]
+	switch {
+	case t == nil && q.tombstones[name]:
+		return apiError(pb.TaskQueueServiceError_TOMBSTONED_TASK, "task %s was deleted", name)
+	case t == nil:
+		return apiError(pb.TaskQueueServiceError_UNKNOWN_TASK, "task %s does not exist", name)
+	case t.Method != "PULL":
+		return apiError(pb.TaskQueueServiceError_INVALID_QUEUE_MODE, "task %s is not a pull task", name)
+	}
+	now := this.now()
+	if usec(t.ETA) != req.GetEtaUsec() || !t.ETA.After(now) {
+		return apiError(pb.TaskQueueServiceError_TASK_LEASE_EXPIRED, "the lease of task %s expired", name)
+	}
+	t.ETA = now.Add(lease)
+	res.UpdatedEtaUsec = proto.Int64(usec(t.ETA))
+	return nil
+}
+
+// leaseDuration returns the duration of a lease of the given number of seconds
+func leaseDuration(seconds float64) (time.Duration, error) {
+	d := time.Duration(seconds * float64(time.Second))
+	if d <= 0 || d > maxLease {
+		return 0, apiError(pb.TaskQueueServiceError_INVALID_REQUEST, "lease seconds must be more than 0 and at most %v", maxLease.Seconds())
+	}
+	return d, nil
+}
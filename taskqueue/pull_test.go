@@ -0,0 +1,97 @@
+package taskqueue
+
+import (
+	"appengine/taskqueue"
+	pb "appengine_internal/taskqueue"
+	"testing"
+	"time"
+)
+
+func TestTaskQueueLease(t *testing.T) {
+	c := newContext(t)
+	now := time.Now()
+	c.tq.SetClock(func() time.Time { return now })
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := taskqueue.Add(c, &taskqueue.Task{Name: name, Method: "PULL", Payload: []byte(name)}, "pull")
+		PanicIfErr(err)
+		now = now.Add(time.Second)
+	}
+
+	tasks, err := taskqueue.Lease(c, 2, "pull", 60)
+	PanicIfErr(err)
+	if len(tasks) != 2 || tasks[0].Name != "a" || string(tasks[1].Payload) != "b" || tasks[0].RetryCount != 1 {
+		t.Fatalf("Lease returned %v, want tasks a and b", tasks)
+	}
+	if tasks, _ := taskqueue.Lease(c, 10, "pull", 60); len(tasks) != 1 || tasks[0].Name != "c" {
+		t.Errorf("Second lease returned %v, want only the task that was not leased", tasks)
+	}
+
+	// Extending and ending leases
+	now = now.Add(30 * time.Second)
+	PanicIfErr(taskqueue.ModifyLease(c, tasks[0], "pull", 60))
+	PanicIfErr(taskqueue.ModifyLease(c, tasks[1], "pull", 0))
+	if leased, _ := taskqueue.Lease(c, 10, "pull", 60); len(leased) != 1 || leased[0].Name != "b" {
+		t.Errorf("Lease returned %v, want the task whose lease ended", leased)
+	}
+
+	// Expired leases
+	now = now.Add(60 * time.Second)
+	if err = taskqueue.ModifyLease(c, tasks[0], "pull", 60); !isCode(err, pb.TaskQueueServiceError_TASK_LEASE_EXPIRED) {
+		t.Errorf("ModifyLease of expired lease returned %v, want TASK_LEASE_EXPIRED", err)
+	}
+	leased, err := taskqueue.Lease(c, 10, "pull", 60)
+	PanicIfErr(err)
+	if len(leased) != 3 || leased[0].RetryCount != 2 {
+		t.Errorf("Lease after the leases expired returned %v, want all tasks leased for the second time", leased)
+	}
+	if err = taskqueue.ModifyLease(c, tasks[0], "pull", 60); !isCode(err, pb.TaskQueueServiceError_TASK_LEASE_EXPIRED) {
+		t.Errorf("ModifyLease of a lease taken by another worker returned %v, want TASK_LEASE_EXPIRED", err)
+	}
+
+	// Deleting leased tasks
+	PanicIfErr(taskqueue.DeleteMulti(c, leased, "pull"))
+	if n := len(c.tq.Tasks("pull")); n != 0 {
+		t.Errorf("Queue had %d tasks after deleting them, want 0", n)
+	}
+	if err = taskqueue.ModifyLease(c, leased[0], "pull", 60); !isCode(err, pb.TaskQueueServiceError_TOMBSTONED_TASK) {
+		t.Errorf("ModifyLease of deleted task returned %v, want TOMBSTONED_TASK", err)
+	}
+	if _, err = taskqueue.Lease(c, 10, "pull", 0); !isCode(err, pb.TaskQueueServiceError_INVALID_REQUEST) {
+		t.Errorf("Lease for 0 seconds returned %v, want INVALID_REQUEST", err)
+	}
+}
+
+func TestTaskQueueLeaseByTag(t *testing.T) {
+	c := newContext(t)
+	now := time.Now()
+	c.tq.SetClock(func() time.Time { return now })
+	for i, tag := range []string{"x", "y", "x", ""} {
+		task := &taskqueue.Task{Method: "PULL", Tag: tag, ETA: now.Add(time.Duration(i-10) * time.Second)}
+		_, err := taskqueue.Add(c, task, "pull")
+		PanicIfErr(err)
+	}
+
+	tags := func(tasks []*taskqueue.Task) string {
+		s := ""
+		for _, t := range tasks {
+			s += t.Tag + ","
+		}
+		return s
+	}
+	tasks, err := taskqueue.LeaseByTag(c, 10, "pull", 60, "y")
+	PanicIfErr(err)
+	if got := tags(tasks); got != "y," {
+		t.Errorf("LeaseByTag y returned tasks with tags %q, want %q", got, "y,")
+	}
+	// Without a tag, the tag of the first task
+	tasks, err = taskqueue.LeaseByTag(c, 10, "pull", 60, "")
+	PanicIfErr(err)
+	if got := tags(tasks); got != "x,x," {
+		t.Errorf("LeaseByTag returned tasks with tags %q, want %q", got, "x,x,")
+	}
+	tasks, err = taskqueue.LeaseByTag(c, 10, "pull", 60, "")
+	PanicIfErr(err)
+	if got := tags(tasks); got != "," {
+		t.Errorf("LeaseByTag returned tasks with tags %q, want the untagged task", got)
+	}
+}
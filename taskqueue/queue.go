@@ -0,0 +1,254 @@
+package taskqueue
+
+import (
+	pb "appengine_internal/taskqueue"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// QueueConfig is the configuration of the queues of an app, as defined in queue.yaml. The yamlqueue package
+// reads it from a queue.yaml file:
+//
+//	queue:
+//	- name: mail
+//	  rate: 5/s
+//	  bucket_size: 10
+//	  retry_parameters:
+//	    task_retry_limit: 3
+//	    min_backoff_seconds: 1
+//	- name: work
+//	  mode: pull
+type QueueConfig struct {
+	Queues []QueueDef `yaml:"queue"`
+}
+
+// QueueDef is the definition of a queue in a QueueConfig
+type QueueDef struct {
+	Name                  string           `yaml:"name"`
+	Mode                  string           `yaml:"mode,omitempty"` // push, the default, or pull
+	Rate                  string           `yaml:"rate,omitempty"` // tasks per second, minute, hour or day, like 5/s or 10/m
+	BucketSize            int              `yaml:"bucket_size,omitempty"`
+	MaxConcurrentRequests int              `yaml:"max_concurrent_requests,omitempty"`
+	RetryParameters       *RetryParameters `yaml:"retry_parameters,omitempty"`
+}
+
+// RetryParameters decide when failed push tasks are retried, and when they are given up on
+type RetryParameters struct {
+	TaskRetryLimit    *int     `yaml:"task_retry_limit,omitempty"`
+	TaskAgeLimit      string   `yaml:"task_age_limit,omitempty"` // a number of seconds, minutes, hours or days, like 2d
+	MinBackoffSeconds *float64 `yaml:"min_backoff_seconds,omitempty"`
+	MaxBackoffSeconds *float64 `yaml:"max_backoff_seconds,omitempty"`
+	MaxDoublings      *int     `yaml:"max_doublings,omitempty"`
+}
+
+// Defaults of production queues
+const (
+	defaultRate         = 5.0 // tasks per second, of the default queue
+	defaultBucketSize   = 5
+	defaultMaxDoublings = 16
+)
+
+// Configure defines the queues of the task queue. Like in production, tasks can then only be added to the defined
+// queues and the default queue, push tasks only to push queues and pull tasks only to pull queues.
+//
+// RunTasks follows the configuration of push queues: it runs at most as many tasks as there are tokens in the
+// queue's bucket, which holds bucket size tokens and is refilled at the queue's rate as the task queue's clock
+// advances; a queue with a rate of 0 is paused. Failed tasks are retried with the backoff of their retry
+// parameters, and are removed when they exceed the retry limit or the age limit, or both limits if both are set.
+// Tasks are run one at a time, so at most one request is in progress, whatever the max concurrent requests.
+//
+// Without a configuration, tasks can be added to any queue and RunTasks runs all tasks that are due.
+func (this *InMemoryTaskQueue) Configure(config *QueueConfig) error {
+	defs := map[string]*QueueDef{"default": {Name: "default"}}
+	for i := range config.Queues {
+		def := &config.Queues[i]
+		if err := def.check(); err != nil {
+			return fmt.Errorf("aeunit taskqueue: invalid queue %q: %v", def.Name, err)
+		}
+		defs[def.Name] = def
+	}
+	for _, q := range this.queues {
+		q.def = nil
+	}
+	now := this.now()
+	for name, def := range defs {
+		q, ok := this.queues[name]
+		if !ok {
+			q = newQueue()
+			this.queues[name] = q
+		}
+		q.def = def
+		q.rate, _ = def.rate()
+		q.tokens = float64(def.bucketSize())
+		if q.rate == 0 {
+			// The queue is paused
+			q.tokens = 0
+		}
+		q.refilled = now
+	}
+	this.configured = true
+	return nil
+}
+
+func (this *QueueDef) check() error {
+	if !queueNameRE.MatchString(this.Name) {
+		return fmt.Errorf("invalid name")
+	}
+	if this.Mode != "" && this.Mode != "push" && this.Mode != "pull" {
+		return fmt.Errorf("invalid mode %q", this.Mode)
+	}
+	if _, err := this.rate(); err != nil {
+		return err
+	}
+	if this.BucketSize < 0 || this.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("bucket size and max concurrent requests must not be negative")
+	}
+	if p := this.RetryParameters; p != nil {
+		if _, err := parseDuration(p.TaskAgeLimit); p.TaskAgeLimit != "" && err != nil {
+			return fmt.Errorf("invalid task age limit %q", p.TaskAgeLimit)
+		}
+	}
+	return nil
+}
+
+func (this *QueueDef) pull() bool {
+	return this.Mode == "pull"
+}
+
+// rate returns the number of tasks per second
+func (this *QueueDef) rate() (float64, error) {
+	if this.Rate == "" {
+		return defaultRate, nil
+	}
+	n := len(this.Rate)
+	if n < 3 || this.Rate[n-2] != '/' {
+		return 0, fmt.Errorf("invalid rate %q", this.Rate)
+	}
+	tasks, err := strconv.ParseFloat(this.Rate[:n-2], 64)
+	if err != nil || tasks < 0 {
+		return 0, fmt.Errorf("invalid rate %q", this.Rate)
+	}
+	per, err := parseDuration("1" + this.Rate[n-1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", this.Rate)
+	}
+	return tasks / per.Seconds(), nil
+}
+
+func (this *QueueDef) bucketSize() int {
+	if this.BucketSize == 0 {
+		return defaultBucketSize
+	}
+	return this.BucketSize
+}
+
+// parseDuration parses a number of seconds, minutes, hours or days, like 10s or 2d
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+// retryParameters are the retry parameters of a task, with the defaults of production
+type retryParameters struct {
+	retryLimit   int           // no limit if negative
+	ageLimit     time.Duration // no limit if 0
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	maxDoublings int
+}
+
+func defaultRetryParameters() retryParameters {
+	return retryParameters{
+		retryLimit:   -1,
+		minBackoff:   minBackoff,
+		maxBackoff:   maxBackoff,
+		maxDoublings: defaultMaxDoublings,
+	}
+}
+
+// merge sets the parameters that are given in p
+func (this *retryParameters) merge(p *RetryParameters) {
+	if p == nil {
+		return
+	}
+	if p.TaskRetryLimit != nil {
+		this.retryLimit = *p.TaskRetryLimit
+	}
+	if d, err := parseDuration(p.TaskAgeLimit); err == nil {
+		this.ageLimit = d
+	}
+	if p.MinBackoffSeconds != nil {
+		this.minBackoff = seconds(*p.MinBackoffSeconds)
+	}
+	if p.MaxBackoffSeconds != nil {
+		this.maxBackoff = seconds(*p.MaxBackoffSeconds)
+	}
+	if p.MaxDoublings != nil {
+		this.maxDoublings = *p.MaxDoublings
+	}
+}
+
+// mergeProto sets the parameters that are given in p, which a task was added with
+func (this *retryParameters) mergeProto(p *pb.TaskQueueRetryParameters) {
+	if p == nil {
+		return
+	}
+	if p.RetryLimit != nil {
+		this.retryLimit = int(*p.RetryLimit)
+	}
+	if p.AgeLimitSec != nil {
+		this.ageLimit = time.Duration(*p.AgeLimitSec) * time.Second
+	}
+	if p.MinBackoffSec != nil {
+		this.minBackoff = seconds(*p.MinBackoffSec)
+	}
+	if p.MaxBackoffSec != nil {
+		this.maxBackoff = seconds(*p.MaxBackoffSec)
+	}
+	if p.MaxDoublings != nil {
+		this.maxDoublings = int(*p.MaxDoublings)
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// backoff returns the time until a task that failed for the given number of times is retried. Like in
+// production, the backoff doubles max doublings times, and then increases linearly.
+func (this retryParameters) backoff(retries int) time.Duration {
+	doublings := retries
+	if doublings > this.maxDoublings {
+		doublings = this.maxDoublings
+	}
+	d := float64(this.minBackoff) * math.Pow(2, float64(doublings))
+	d *= float64(retries - doublings + 1)
+	if d > float64(this.maxBackoff) {
+		return this.maxBackoff
+	}
+	return time.Duration(d)
+}
+
+// exceeded returns whether a task that failed for the given number of times, and was first tried at the given
+// time, should not be retried. If both limits are given, both have to be exceeded.
+func (this retryParameters) exceeded(retries int, firstTry, now time.Time) bool {
+	retriesExceeded := this.retryLimit >= 0 && retries > this.retryLimit
+	ageExceeded := this.ageLimit > 0 && now.Sub(firstTry) > this.ageLimit
+	if this.retryLimit >= 0 && this.ageLimit > 0 {
+		return retriesExceeded && ageExceeded
+	}
+	return retriesExceeded || ageExceeded
+}
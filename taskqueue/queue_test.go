@@ -0,0 +1,162 @@
+package taskqueue
+
+import (
+	"appengine/taskqueue"
+	pb "appengine_internal/taskqueue"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func intPtr(i int) *int           { return &i }
+func floatPtr(f float64) *float64 { return &f }
+
+// testQueueConfig returns the configuration of the queue.yaml of the yamlqueue tests
+func testQueueConfig() *QueueConfig {
+	return &QueueConfig{Queues: []QueueDef{
+		{Name: "slow", Rate: "1/s", BucketSize: 2},
+		{Name: "retried", Rate: "100/s", RetryParameters: &RetryParameters{
+			TaskRetryLimit: intPtr(2), MinBackoffSeconds: floatPtr(1), MaxBackoffSeconds: floatPtr(3)}},
+		{Name: "aged", Rate: "100/s", RetryParameters: &RetryParameters{
+			TaskRetryLimit: intPtr(1), TaskAgeLimit: "10m", MinBackoffSeconds: floatPtr(10)}},
+		{Name: "paused", Rate: "0/s"},
+		{Name: "work", Mode: "pull"},
+	}}
+}
+
+func newConfiguredContext(t *testing.T) (*testContext, *time.Time) {
+	c := newContext(t)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.tq.SetClock(func() time.Time { return now })
+	PanicIfErr(c.tq.Configure(testQueueConfig()))
+	return c, &now
+}
+
+func TestTaskQueueConfigure(t *testing.T) {
+	c, _ := newConfiguredContext(t)
+	_, err := taskqueue.Add(c, &taskqueue.Task{Path: "/work"}, "")
+	PanicIfErr(err)
+	_, err = taskqueue.Add(c, &taskqueue.Task{Method: "PULL"}, "work")
+	PanicIfErr(err)
+
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work"}, "unknown"); !isCode(err, pb.TaskQueueServiceError_UNKNOWN_QUEUE) {
+		t.Errorf("Add to unknown queue returned %v, want UNKNOWN_QUEUE", err)
+	}
+	if err = taskqueue.Purge(c, "unknown"); !isCode(err, pb.TaskQueueServiceError_UNKNOWN_QUEUE) {
+		t.Errorf("Purge of unknown queue returned %v, want UNKNOWN_QUEUE", err)
+	}
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Method: "PULL"}, "slow"); !isCode(err, pb.TaskQueueServiceError_INVALID_QUEUE_MODE) {
+		t.Errorf("Add of pull task to push queue returned %v, want INVALID_QUEUE_MODE", err)
+	}
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work"}, "work"); !isCode(err, pb.TaskQueueServiceError_INVALID_QUEUE_MODE) {
+		t.Errorf("Add of push task to pull queue returned %v, want INVALID_QUEUE_MODE", err)
+	}
+	if _, err = taskqueue.Lease(c, 1, "default", 60); !isCode(err, pb.TaskQueueServiceError_INVALID_QUEUE_MODE) {
+		t.Errorf("Lease from push queue returned %v, want INVALID_QUEUE_MODE", err)
+	}
+
+	// Invalid configurations
+	invalid := []QueueDef{
+		{Name: "invalid name!"},
+		{Name: "q", Mode: "poll"},
+		{Name: "q", Rate: "5/w"},
+		{Name: "q", Rate: "five/s"},
+		{Name: "q", BucketSize: -1},
+		{Name: "q", RetryParameters: &RetryParameters{TaskAgeLimit: "2 days"}},
+	}
+	for _, def := range invalid {
+		if err := c.tq.Configure(&QueueConfig{Queues: []QueueDef{def}}); err == nil {
+			t.Errorf("Configure with queue %+v did not return an error", def)
+		}
+	}
+}
+
+func TestTaskQueueRate(t *testing.T) {
+	c, now := newConfiguredContext(t)
+	for i := 0; i < 5; i++ {
+		_, err := taskqueue.Add(c, &taskqueue.Task{Path: "/work"}, "slow")
+		PanicIfErr(err)
+		_, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work"}, "paused")
+		PanicIfErr(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	if n, _ := c.tq.RunTasks("slow", ok); n != 2 {
+		t.Errorf("RunTasks ran %d tasks, want the bucket size of 2", n)
+	}
+	if n, _ := c.tq.RunTasks("slow", ok); n != 0 {
+		t.Errorf("RunTasks ran %d tasks with an empty bucket, want 0", n)
+	}
+	*now = now.Add(time.Second)
+	if n, _ := c.tq.RunTasks("slow", ok); n != 1 {
+		t.Errorf("RunTasks ran %d tasks after 1s at 1/s, want 1", n)
+	}
+	*now = now.Add(time.Minute)
+	if n, _ := c.tq.RunTasks("slow", ok); n != 2 {
+		t.Errorf("RunTasks ran %d tasks after 1m, want the bucket size of 2", n)
+	}
+	if n, _ := c.tq.RunTasks("paused", ok); n != 0 {
+		t.Errorf("RunTasks ran %d tasks of a paused queue, want 0", n)
+	}
+}
+
+func TestTaskQueueRetryParameters(t *testing.T) {
+	c, now := newConfiguredContext(t)
+	failed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	// A retry limit of 2 with a backoff of 1s, 2s
+	_, err := taskqueue.Add(c, &taskqueue.Task{Name: "retried", Path: "/work"}, "retried")
+	PanicIfErr(err)
+	for i, backoff := range []time.Duration{0, time.Second, 2 * time.Second} {
+		*now = now.Add(backoff - time.Millisecond)
+		if n, _ := c.tq.RunTasks("retried", failed); n != 0 {
+			t.Errorf("RunTasks ran the task before try %d", i)
+		}
+		*now = now.Add(time.Millisecond)
+		if n, _ := c.tq.RunTasks("retried", failed); n != 1 {
+			t.Errorf("RunTasks did not run the task at try %d", i)
+		}
+	}
+	if tasks := c.tq.Tasks("retried"); len(tasks) != 0 {
+		t.Errorf("Queue had tasks %v after the retry limit, want none", tasks)
+	}
+
+	// The retry options of a task override the ones of the queue
+	_, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work", RetryOptions: &taskqueue.RetryOptions{MinBackoff: 5 * time.Second}}, "retried")
+	PanicIfErr(err)
+	c.tq.RunTasks("retried", failed)
+	if tasks := c.tq.Tasks("retried"); len(tasks) != 1 || !tasks[0].ETA.Equal(now.Add(3*time.Second)) {
+		t.Errorf("Queue had tasks %v, want a task backed off to the max backoff of the queue", tasks)
+	}
+
+	// With a retry limit and an age limit, both have to be exceeded
+	_, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work"}, "aged")
+	PanicIfErr(err)
+	for i := 0; i < 3; i++ {
+		c.tq.RunTasks("aged", failed)
+		*now = now.Add(time.Minute)
+	}
+	if tasks := c.tq.Tasks("aged"); len(tasks) != 1 || tasks[0].RetryCount != 3 {
+		t.Errorf("Queue had tasks %v, want a task that failed 3 times within the age limit", tasks)
+	}
+	*now = now.Add(10 * time.Minute)
+	c.tq.RunTasks("aged", failed)
+	if tasks := c.tq.Tasks("aged"); len(tasks) != 0 {
+		t.Errorf("Queue had tasks %v after the age limit, want none", tasks)
+	}
+}
+
+func TestTaskQueueBackoff(t *testing.T) {
+	p := retryParameters{minBackoff: time.Second, maxBackoff: time.Minute, maxDoublings: 2}
+	want := []time.Duration{1, 2, 4, 8, 12, 16}
+	for retries, w := range want {
+		if got := p.backoff(retries); got != w*time.Second {
+			t.Errorf("Backoff after %d retries was %v, want %v", retries, got, w*time.Second)
+		}
+	}
+	if got := p.backoff(100); got != time.Minute {
+		t.Errorf("Backoff after 100 retries was %v, want the max backoff", got)
+	}
+}
@@ -0,0 +1,134 @@
+package taskqueue
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+// Default backoff of failed tasks, like production's default retry parameters
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = time.Hour
+)
+
+// Tasks returns copies of the tasks in the queue, ordered by ETA and name
+func (this *InMemoryTaskQueue) Tasks(queueName string) []*Task {
+	q, ok := this.queues[queueName]
+	if !ok {
+		return []*Task{}
+	}
+	tasks := q.sorted()
+	for i, t := range tasks {
+		c := *t
+		c.Header = cloneHeader(t.Header)
+		c.Payload = append([]byte{}, t.Payload...)
+		tasks[i] = &c
+	}
+	return tasks
+}
+
+// RunTasks runs the push tasks of the queue that are due, in order of ETA, by serving their requests with the
+// handler, and returns the number of tasks that were run. Tasks that respond with a 2xx status are removed from
+// the queue. Other tasks are retried: their ETA is moved back by a backoff that doubles with every retry, until
+// they exceed the limits of their retry parameters and are removed. If the task queue is configured, at most as
+// many tasks are run as the rate and bucket size of the queue allow, see Configure.
+//
+// Tasks added while the tasks run are not run until the next call.
+func (this *InMemoryTaskQueue) RunTasks(queueName string, handler http.Handler) (int, error) {
+	q, ok := this.queues[queueName]
+	if !ok {
+		return 0, nil
+	}
+	now := this.now()
+	q.refill(now)
+	run := 0
+	for _, t := range q.sorted() {
+		if q.tasks[t.Name] != t || t.Method == "PULL" || t.ETA.After(now) {
+			// The task was deleted by the handler of an earlier task, or is not due
+			continue
+		}
+		if q.def != nil {
+			if q.tokens < 1 {
+				break
+			}
+			q.tokens--
+		}
+		req, err := this.request(queueName, t)
+		if err != nil {
+			return run, err
+		}
+		if t.executions == 0 {
+			t.firstTry = now
+		}
+		t.executions++
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		run++
+		if q.tasks[t.Name] != t {
+			// The handler deleted the task
+			continue
+		}
+		retry := q.retryParameters(t)
+		switch {
+		case w.Code >= 200 && w.Code < 300:
+			q.remove(t.Name)
+		case retry.exceeded(t.RetryCount+1, t.firstTry, now):
+			// The task failed permanently
+			q.remove(t.Name)
+		default:
+			t.ETA = now.Add(retry.backoff(t.RetryCount))
+			t.RetryCount++
+		}
+	}
+	return run, nil
+}
+
+// request returns the request of a push task, with the headers production adds to task requests
+func (this *InMemoryTaskQueue) request(queueName string, t *Task) (*http.Request, error) {
+	req, err := http.NewRequest(t.Method, t.Path, bytes.NewReader(t.Payload))
+	if err != nil {
+		return nil, fmt.Errorf("aeunit taskqueue: task %s has an invalid request: %v", t.Name, err)
+	}
+	req.Header = cloneHeader(t.Header)
+	req.Header.Set("X-AppEngine-QueueName", queueName)
+	req.Header.Set("X-AppEngine-TaskName", t.Name)
+	req.Header.Set("X-AppEngine-TaskRetryCount", strconv.Itoa(t.RetryCount))
+	req.Header.Set("X-AppEngine-TaskExecutionCount", strconv.Itoa(t.executions))
+	req.Header.Set("X-AppEngine-TaskETA", strconv.FormatFloat(float64(t.ETA.UnixNano())/1e9, 'f', 6, 64))
+	req.RemoteAddr = "0.1.0.2"
+	return req, nil
+}
+
+// refill adds the tokens for the time since the bucket of a configured queue was last refilled
+func (this *queue) refill(now time.Time) {
+	if this.def == nil {
+		return
+	}
+	this.tokens += this.rate * now.Sub(this.refilled).Seconds()
+	if max := float64(this.def.bucketSize()); this.tokens > max {
+		this.tokens = max
+	}
+	this.refilled = now
+}
+
+// retryParameters returns the retry parameters of a task: the ones it was added with, then the ones of its queue
+func (this *queue) retryParameters(t *Task) retryParameters {
+	p := defaultRetryParameters()
+	if this.def != nil {
+		p.merge(this.def.RetryParameters)
+	}
+	p.mergeProto(t.retry)
+	return p
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, vs := range h {
+		c[k] = append([]string{}, vs...)
+	}
+	return c
+}
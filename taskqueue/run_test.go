@@ -0,0 +1,86 @@
+package taskqueue
+
+import (
+	"appengine/taskqueue"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTaskQueueRunTasks(t *testing.T) {
+	c := newContext(t)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.tq.SetClock(func() time.Time { return now })
+	var requests []*http.Request
+	status := http.StatusOK
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests = append(requests, r)
+		w.WriteHeader(status)
+	})
+
+	_, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/work", url.Values{"a": {"1"}}), "")
+	PanicIfErr(err)
+	_, err = taskqueue.Add(c, &taskqueue.Task{Name: "delayed", Path: "/later", Delay: time.Minute}, "")
+	PanicIfErr(err)
+	_, err = taskqueue.Add(c, &taskqueue.Task{Name: "pull", Method: "PULL", Payload: []byte("p")}, "pull")
+	PanicIfErr(err)
+
+	if n, err := c.tq.RunTasks("default", handler); n != 1 || err != nil {
+		t.Fatalf("RunTasks ran %d tasks and returned %v, want 1 task", n, err)
+	}
+	r := requests[0]
+	if r.URL.Path != "/work" || r.Method != "POST" || r.FormValue("a") != "1" || r.Header.Get("X-AppEngine-QueueName") != "default" {
+		t.Errorf("Task request was %s %s with form %v and headers %v", r.Method, r.URL, r.Form, r.Header)
+	}
+	if tasks := c.tq.Tasks("default"); len(tasks) != 1 || tasks[0].Name != "delayed" {
+		t.Errorf("Queue had tasks %v after running, want only the delayed task", tasks)
+	}
+	if n, _ := c.tq.RunTasks("pull", handler); n != 0 {
+		t.Errorf("RunTasks ran %d pull tasks", n)
+	}
+
+	// Failed tasks are retried with a backoff
+	now = now.Add(time.Minute)
+	status = http.StatusInternalServerError
+	if n, _ := c.tq.RunTasks("default", handler); n != 1 {
+		t.Errorf("RunTasks ran %d tasks, want the delayed task", n)
+	}
+	if n, _ := c.tq.RunTasks("default", handler); n != 0 {
+		t.Errorf("RunTasks ran %d tasks during the backoff of the failed task", n)
+	}
+	now = now.Add(100 * time.Millisecond)
+	status = http.StatusOK
+	if n, _ := c.tq.RunTasks("default", handler); n != 1 {
+		t.Errorf("RunTasks ran %d tasks after the backoff, want the failed task", n)
+	}
+	if retries := requests[len(requests)-1].Header.Get("X-AppEngine-TaskRetryCount"); retries != "1" {
+		t.Errorf("Retried task had retry count %s, want 1", retries)
+	}
+	if n := len(c.tq.Tasks("default")); n != 0 {
+		t.Errorf("Queue had %d tasks after they succeeded, want 0", n)
+	}
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Name: "delayed", Path: "/later"}, ""); err != taskqueue.ErrTaskAlreadyAdded {
+		t.Errorf("Add of task that ran returned %v, want %v", err, taskqueue.ErrTaskAlreadyAdded)
+	}
+}
+
+func TestTaskQueueRunTasksDeleted(t *testing.T) {
+	c := newContext(t)
+	for _, name := range []string{"a", "b"} {
+		_, err := taskqueue.Add(c, &taskqueue.Task{Name: name, Path: "/" + name}, "")
+		PanicIfErr(err)
+	}
+	var paths []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		PanicIfErr(taskqueue.Delete(c, &taskqueue.Task{Name: "b"}, ""))
+	})
+	if n, err := c.tq.RunTasks("default", handler); n != 1 || err != nil {
+		t.Errorf("RunTasks ran %d tasks and returned %v, want 1 task", n, err)
+	}
+	if len(paths) != 1 || paths[0] != "/a" {
+		t.Errorf("RunTasks ran tasks %v, want only task a, which deleted task b", paths)
+	}
+}
@@ -0,0 +1,407 @@
+package taskqueue
+
+import (
+	"appengine_internal"
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Limits of the production task queue
+const (
+	maxTaskSize           = 100 * 1024          // bytes, of a push task
+	maxETA                = 30 * 24 * time.Hour // after now
+	maxTransactionalTasks = 5                   // tasks added in a datastore transaction
+)
+
+var (
+	queueNameRE = regexp.MustCompile(`^[a-zA-Z0-9-]{1,100}$`)
+	taskNameRE  = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,500}$`)
+)
+
+// Task is a task in a queue of an InMemoryTaskQueue
+type Task struct {
+	Name       string
+	Method     string // HTTP method of a push task, or "PULL" for a pull task
+	Path       string
+	Header     http.Header
+	Payload    []byte
+	ETA        time.Time
+	Tag        string
+	RetryCount int // number of times a push task failed, or a pull task was leased
+
+	seq        int // order in which the task was added, which orders tasks with the same ETA
+	created    time.Time
+	executions int
+	firstTry   time.Time                    // when a push task first ran
+	retry      *pb.TaskQueueRetryParameters // of the task, which override the ones of its queue
+}
+
+type queue struct {
+	tasks      map[string]*Task
+	tombstones map[string]bool // names of the tasks that were deleted or ran, which can't be used again
+
+	// Set for the queues of a configured task queue
+	def      *QueueDef
+	rate     float64 // tokens added to the bucket per second
+	tokens   float64 // tasks that can run before the bucket has to be refilled
+	refilled time.Time
+}
+
+func newQueue() *queue {
+	return &queue{
+		tasks:      make(map[string]*Task),
+		tombstones: make(map[string]bool),
+	}
+}
+
+// sorted returns the tasks of the queue ordered by ETA, and then in the order they were added
+func (this *queue) sorted() []*Task {
+	tasks := make([]*Task, 0, len(this.tasks))
+	for _, t := range this.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Sort(byETA(tasks))
+	return tasks
+}
+
+type byETA []*Task
+
+func (this byETA) Len() int      { return len(this) }
+func (this byETA) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this byETA) Less(i, j int) bool {
+	if !this[i].ETA.Equal(this[j].ETA) {
+		return this[i].ETA.Before(this[j].ETA)
+	}
+	return this[i].seq < this[j].seq
+}
+
+// InMemoryTaskQueue is a task queue service that keeps its tasks in memory. Push tasks are not run by themselves:
+// tests run them with RunTasks. Pull tasks are leased with QueryAndOwnTasks.
+type InMemoryTaskQueue struct {
+	queues        map[string]*queue
+	configured    bool                   // whether only the queues of the configuration exist
+	nameCounter   int                    // for the names of tasks added without a name
+	taskCounter   int                    // for the sequence numbers of tasks
+	transactional map[uint64][]*heldTask // tasks added in transactions that are in progress, by handle
+	now           func() time.Time
+}
+
+// heldTask is a task that was added in a transaction, which is added to its queue when the transaction commits
+type heldTask struct {
+	queue string
+	task  *Task
+}
+
+func New() *InMemoryTaskQueue {
+	return &InMemoryTaskQueue{
+		queues:        make(map[string]*queue),
+		transactional: make(map[uint64][]*heldTask),
+		now:           time.Now,
+	}
+}
+
+func (this *InMemoryTaskQueue) Call(method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	switch method {
+	case "Add":
+		return this.Add(in.(*pb.TaskQueueAddRequest), out.(*pb.TaskQueueAddResponse))
+	case "BulkAdd":
+		return this.BulkAdd(in.(*pb.TaskQueueBulkAddRequest), out.(*pb.TaskQueueBulkAddResponse))
+	case "Delete":
+		return this.Delete(in.(*pb.TaskQueueDeleteRequest), out.(*pb.TaskQueueDeleteResponse))
+	case "PurgeQueue":
+		return this.PurgeQueue(in.(*pb.TaskQueuePurgeQueueRequest), out.(*pb.TaskQueuePurgeQueueResponse))
+	case "QueryTasks":
+		return this.QueryTasks(in.(*pb.TaskQueueQueryTasksRequest), out.(*pb.TaskQueueQueryTasksResponse))
+	case "QueryAndOwnTasks":
+		return this.QueryAndOwnTasks(in.(*pb.TaskQueueQueryAndOwnTasksRequest), out.(*pb.TaskQueueQueryAndOwnTasksResponse))
+	case "ModifyTaskLease":
+		return this.ModifyTaskLease(in.(*pb.TaskQueueModifyTaskLeaseRequest), out.(*pb.TaskQueueModifyTaskLeaseResponse))
+	default:
+		return fmt.Errorf("aeunit taskqueue: Unknown method %s", method)
+	}
+}
+
+func (this *InMemoryTaskQueue) Close() error {
+	return nil
+}
+
+// SetClock sets the function the task queue gets the current time from, which decides when tasks are due.
+// The default is time.Now.
+func (this *InMemoryTaskQueue) SetClock(now func() time.Time) {
+	this.now = now
+}
+
+// apiError returns an application error of the task queue service, like the ones returned by production
+func apiError(code pb.TaskQueueServiceError_ErrorCode, format string, v ...interface{}) error {
+	return &appengine_internal.APIError{
+		Service: "taskqueue",
+		Detail:  fmt.Sprintf(format, v...),
+		Code:    int32(code),
+	}
+}
+
+// queue returns the queue with the given name, or an empty queue that is not kept if it doesn't exist yet. Queues
+// are only created by adding tasks to them. If the task queue is configured, only the configured queues exist.
+func (this *InMemoryTaskQueue) queue(name string) (*queue, error) {
+	if !queueNameRE.MatchString(name) {
+		return nil, apiError(pb.TaskQueueServiceError_INVALID_QUEUE_NAME, "invalid queue name %q", name)
+	}
+	q, ok := this.queues[name]
+	switch {
+	case this.configured && (!ok || q.def == nil):
+		return nil, apiError(pb.TaskQueueServiceError_UNKNOWN_QUEUE, "queue %q is not configured", name)
+	case !ok:
+		return newQueue(), nil
+	}
+	return q, nil
+}
+
+// addQueue returns the queue with the given name, creating it if it doesn't exist
+func (this *InMemoryTaskQueue) addQueue(name string) *queue {
+	q, ok := this.queues[name]
+	if !ok {
+		q = newQueue()
+		this.queues[name] = q
+	}
+	return q
+}
+
+// Add adds a task. The client computes the ETA of a task from the wall clock, so the time between the wall clock
+// and the ETA is added to the task queue's clock: a task added with a delay d is due when the clock was advanced
+// by d.
+func (this *InMemoryTaskQueue) Add(req *pb.TaskQueueAddRequest, res *pb.TaskQueueAddResponse) error {
+	bulkRes := &pb.TaskQueueBulkAddResponse{}
+	if err := this.BulkAdd(&pb.TaskQueueBulkAddRequest{AddRequest: []*pb.TaskQueueAddRequest{req}}, bulkRes); err != nil {
+		return err
+	}
+	result := bulkRes.Taskresult[0]
+	if code := result.GetResult(); code != pb.TaskQueueServiceError_OK {
+		return apiError(code, "could not add task %q: %v", req.TaskName, code)
+	}
+	res.ChosenTaskName = result.ChosenTaskName
+	return nil
+}
+
+// BulkAdd adds tasks. Like in production, if a task is invalid, none of the tasks are added and the others
+// have the result SKIPPED.
+//
+// Tasks added in a datastore transaction are held until the transaction ends, see EndTransaction. Like in
+// production, they can't be named, and at most 5 can be added in a transaction.
+func (this *InMemoryTaskQueue) BulkAdd(req *pb.TaskQueueBulkAddRequest, res *pb.TaskQueueBulkAddResponse) error {
+	res.Taskresult = make([]*pb.TaskQueueBulkAddResponse_TaskResult, len(req.AddRequest))
+	invalid := false
+	names := make(map[string]bool)
+	held := make(map[uint64]int) // tasks of each transaction, with the ones added by earlier requests
+	for i, addReq := range req.AddRequest {
+		code := this.checkAddRequest(addReq)
+		name := string(addReq.QueueName) + "\x00" + string(addReq.TaskName)
+		if code == pb.TaskQueueServiceError_OK && len(addReq.TaskName) > 0 && names[name] {
+			code = pb.TaskQueueServiceError_DUPLICATE_TASK_NAME
+		}
+		names[name] = true
+		if code == pb.TaskQueueServiceError_OK && addReq.Transaction != nil {
+			handle := addReq.Transaction.GetHandle()
+			if _, ok := held[handle]; !ok {
+				held[handle] = len(this.transactional[handle])
+			}
+			if held[handle]++; held[handle] > maxTransactionalTasks {
+				code = pb.TaskQueueServiceError_TOO_MANY_TASKS
+			}
+		}
+		res.Taskresult[i] = &pb.TaskQueueBulkAddResponse_TaskResult{Result: code.Enum()}
+		invalid = invalid || code != pb.TaskQueueServiceError_OK
+	}
+	if invalid {
+		for _, result := range res.Taskresult {
+			if result.GetResult() == pb.TaskQueueServiceError_OK {
+				result.Result = pb.TaskQueueServiceError_SKIPPED.Enum()
+			}
+		}
+		return nil
+	}
+
+	for i, addReq := range req.AddRequest {
+		result := res.Taskresult[i]
+		q := this.addQueue(string(addReq.QueueName))
+		name := string(addReq.TaskName)
+		switch {
+		case name == "":
+			this.nameCounter++
+			name = "task" + strconv.Itoa(this.nameCounter)
+			result.ChosenTaskName = []byte(name)
+		case q.tasks[name] != nil:
+			result.Result = pb.TaskQueueServiceError_TASK_ALREADY_EXISTS.Enum()
+			continue
+		case q.tombstones[name]:
+			result.Result = pb.TaskQueueServiceError_TOMBSTONED_TASK.Enum()
+			continue
+		}
+		if addReq.Transaction != nil {
+			handle := addReq.Transaction.GetHandle()
+			this.transactional[handle] = append(this.transactional[handle], &heldTask{string(addReq.QueueName), this.newTask(name, addReq)})
+			continue
+		}
+		q.tasks[name] = this.newTask(name, addReq)
+	}
+	return nil
+}
+
+// EndTransaction adds the tasks that were added in the datastore transaction with the given handle to their queues
+// if it was committed, or discards them if it was rolled back. NewContext has the datastore call it when a
+// transaction ends.
+func (this *InMemoryTaskQueue) EndTransaction(handle uint64, committed bool) {
+	if committed {
+		for _, h := range this.transactional[handle] {
+			this.addQueue(h.queue).tasks[h.task.Name] = h.task
+		}
+	}
+	delete(this.transactional, handle)
+}
+
+// checkAddRequest returns the error code of an invalid task, or OK
+func (this *InMemoryTaskQueue) checkAddRequest(req *pb.TaskQueueAddRequest) pb.TaskQueueServiceError_ErrorCode {
+	switch {
+	case !queueNameRE.Match(req.QueueName):
+		return pb.TaskQueueServiceError_INVALID_QUEUE_NAME
+	case len(req.TaskName) > 0 && !taskNameRE.Match(req.TaskName):
+		return pb.TaskQueueServiceError_INVALID_TASK_NAME
+	case len(req.TaskName) > 0 && req.Transaction != nil:
+		return pb.TaskQueueServiceError_INVALID_TASK_NAME
+	case this.configured && this.queueDef(req.QueueName) == nil:
+		return pb.TaskQueueServiceError_UNKNOWN_QUEUE
+	case this.configured && this.queueDef(req.QueueName).pull() != (req.GetMode() == pb.TaskQueueMode_PULL):
+		return pb.TaskQueueServiceError_INVALID_QUEUE_MODE
+	case req.GetMode() == pb.TaskQueueMode_PUSH && (len(req.Url) == 0 || req.Url[0] != '/'):
+		return pb.TaskQueueServiceError_INVALID_URL
+	case req.GetMode() == pb.TaskQueueMode_PUSH && proto.Size(req) > maxTaskSize:
+		return pb.TaskQueueServiceError_TASK_TOO_LARGE
+	case wallETA(req.GetEtaUsec()).Sub(time.Now()) > maxETA:
+		return pb.TaskQueueServiceError_INVALID_ETA
+	}
+	return pb.TaskQueueServiceError_OK
+}
+
+// queueDef returns the definition of a configured queue, or nil
+func (this *InMemoryTaskQueue) queueDef(name []byte) *QueueDef {
+	if q, ok := this.queues[string(name)]; ok {
+		return q.def
+	}
+	return nil
+}
+
+func wallETA(usec int64) time.Time {
+	return time.Unix(0, usec*1e3)
+}
+
+func usec(t time.Time) int64 {
+	return t.UnixNano() / 1e3
+}
+
+func (this *InMemoryTaskQueue) newTask(name string, req *pb.TaskQueueAddRequest) *Task {
+	now := this.now()
+	this.taskCounter++
+	t := &Task{
+		Name:    name,
+		Method:  "PULL",
+		Header:  make(http.Header),
+		Payload: append([]byte{}, req.Body...),
+		ETA:     now.Add(wallETA(req.GetEtaUsec()).Sub(time.Now())),
+		Tag:     string(req.Tag),
+		seq:     this.taskCounter,
+		created: now,
+		retry:   req.RetryParameters,
+	}
+	if req.GetMode() == pb.TaskQueueMode_PUSH {
+		t.Method = req.GetMethod().String()
+		t.Path = string(req.Url)
+		for _, h := range req.Header {
+			t.Header.Add(string(h.Key), string(h.Value))
+		}
+	}
+	return t
+}
+
+func (this *InMemoryTaskQueue) Delete(req *pb.TaskQueueDeleteRequest, res *pb.TaskQueueDeleteResponse) error {
+	q, err := this.queue(string(req.QueueName))
+	if err != nil {
+		return err
+	}
+	res.Result = make([]pb.TaskQueueServiceError_ErrorCode, len(req.TaskName))
+	for i, name := range req.TaskName {
+		switch {
+		case q.tasks[string(name)] != nil:
+			q.remove(string(name))
+			res.Result[i] = pb.TaskQueueServiceError_OK
+		case q.tombstones[string(name)]:
+			res.Result[i] = pb.TaskQueueServiceError_TOMBSTONED_TASK
+		default:
+			res.Result[i] = pb.TaskQueueServiceError_UNKNOWN_TASK
+		}
+	}
+	return nil
+}
+
+// remove removes the task and keeps a tombstone for its name
+func (this *queue) remove(name string) {
+	delete(this.tasks, name)
+	this.tombstones[name] = true
+}
+
+func (this *InMemoryTaskQueue) PurgeQueue(req *pb.TaskQueuePurgeQueueRequest, res *pb.TaskQueuePurgeQueueResponse) error {
+	q, err := this.queue(string(req.QueueName))
+	if err != nil {
+		return err
+	}
+	q.tasks = make(map[string]*Task)
+	return nil
+}
+
+// QueryTasks returns the tasks of a queue ordered by ETA and name, starting at the given ETA and name
+func (this *InMemoryTaskQueue) QueryTasks(req *pb.TaskQueueQueryTasksRequest, res *pb.TaskQueueQueryTasksResponse) error {
+	q, err := this.queue(string(req.QueueName))
+	if err != nil {
+		return err
+	}
+	for _, t := range q.sorted() {
+		if int32(len(res.Task)) >= req.GetMaxRows() {
+			break
+		}
+		if eta := usec(t.ETA); eta < req.GetStartEtaUsec() || eta == req.GetStartEtaUsec() && t.Name < string(req.StartTaskName) {
+			continue
+		}
+		res.Task = append(res.Task, t.toProto())
+	}
+	return nil
+}
+
+func (this *Task) toProto() *pb.TaskQueueQueryTasksResponse_Task {
+	p := &pb.TaskQueueQueryTasksResponse_Task{
+		TaskName:         []byte(this.Name),
+		EtaUsec:          proto.Int64(usec(this.ETA)),
+		RetryCount:       proto.Int32(int32(this.RetryCount)),
+		ExecutionCount:   proto.Int32(int32(this.executions)),
+		BodySize:         proto.Int32(int32(len(this.Payload))),
+		Body:             append([]byte{}, this.Payload...),
+		CreationTimeUsec: proto.Int64(usec(this.created)),
+	}
+	if this.Tag != "" {
+		p.Tag = []byte(this.Tag)
+	}
+	if this.Method != "PULL" {
+		method := pb.TaskQueueQueryTasksResponse_Task_RequestMethod(pb.TaskQueueQueryTasksResponse_Task_RequestMethod_value[this.Method])
+		p.Method = &method
+		p.Url = []byte(this.Path)
+		for k, vs := range this.Header {
+			for _, v := range vs {
+				p.Header = append(p.Header, &pb.TaskQueueQueryTasksResponse_Task_Header{Key: []byte(k), Value: []byte(v)})
+			}
+		}
+	}
+	return p
+}
@@ -0,0 +1,241 @@
+package taskqueue
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"appengine_internal"
+	dspb "appengine_internal/datastore"
+	pb "appengine_internal/taskqueue"
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTaskQueueAdd(t *testing.T) {
+	c := newContext(t)
+	task, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/work", url.Values{"a": {"1"}}), "")
+	PanicIfErr(err)
+	if task.Name == "" {
+		t.Errorf("Add did not choose a name for the task")
+	}
+	tasks := c.tq.Tasks("default")
+	if len(tasks) != 1 {
+		t.Fatalf("Queue had %d tasks, want 1", len(tasks))
+	}
+	if got := tasks[0]; got.Name != task.Name || got.Method != "POST" || got.Path != "/work" || string(got.Payload) != "a=1" {
+		t.Errorf("Queued task was %+v", got)
+	}
+
+	// Named tasks
+	named := &taskqueue.Task{Name: "named", Path: "/work"}
+	_, err = taskqueue.Add(c, named, "other")
+	PanicIfErr(err)
+	if _, err = taskqueue.Add(c, named, "other"); err != taskqueue.ErrTaskAlreadyAdded {
+		t.Errorf("Add of existing task returned %v, want %v", err, taskqueue.ErrTaskAlreadyAdded)
+	}
+	PanicIfErr(taskqueue.Delete(c, named, "other"))
+	if _, err = taskqueue.Add(c, named, "other"); err != taskqueue.ErrTaskAlreadyAdded {
+		t.Errorf("Add of deleted task returned %v, want %v", err, taskqueue.ErrTaskAlreadyAdded)
+	}
+	if err = taskqueue.Delete(c, named, "other"); err == nil {
+		t.Errorf("Delete of deleted task did not return an error")
+	}
+	if err = taskqueue.Delete(c, &taskqueue.Task{Name: "missing"}, "other"); err == nil {
+		t.Errorf("Delete of missing task did not return an error")
+	}
+
+	// Invalid tasks
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Name: "invalid name!", Path: "/work"}, ""); !isCode(err, pb.TaskQueueServiceError_INVALID_TASK_NAME) {
+		t.Errorf("Add of task with invalid name returned %v, want INVALID_TASK_NAME", err)
+	}
+	if _, err = taskqueue.Add(c, taskqueue.NewPOSTTask("/work", nil), "invalid queue!"); !isCode(err, pb.TaskQueueServiceError_INVALID_QUEUE_NAME) {
+		t.Errorf("Add to invalid queue returned %v, want INVALID_QUEUE_NAME", err)
+	}
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work", Delay: 31 * 24 * time.Hour}, ""); !isCode(err, pb.TaskQueueServiceError_INVALID_ETA) {
+		t.Errorf("Add of task with ETA after 31 days returned %v, want INVALID_ETA", err)
+	}
+	if _, err = taskqueue.Add(c, &taskqueue.Task{Path: "/work", Payload: make([]byte, maxTaskSize)}, ""); !isCode(err, pb.TaskQueueServiceError_TASK_TOO_LARGE) {
+		t.Errorf("Add of too large task returned %v, want TASK_TOO_LARGE", err)
+	}
+
+	PanicIfErr(taskqueue.Purge(c, "default"))
+	if n := len(c.tq.Tasks("default")); n != 0 {
+		t.Errorf("Queue had %d tasks after purge, want 0", n)
+	}
+}
+
+func TestTaskQueueBulkAdd(t *testing.T) {
+	c := newContext(t)
+	_, err := taskqueue.AddMulti(c, []*taskqueue.Task{
+		&taskqueue.Task{Name: "a", Path: "/work"},
+		&taskqueue.Task{Name: "b", Path: "/work"},
+	}, "")
+	PanicIfErr(err)
+
+	// An invalid task: none are added
+	_, err = taskqueue.AddMulti(c, []*taskqueue.Task{
+		&taskqueue.Task{Name: "c", Path: "/work"},
+		&taskqueue.Task{Name: "invalid name!", Path: "/work"},
+	}, "")
+	if me, ok := err.(appengine.MultiError); !ok || !isCode(me[0], pb.TaskQueueServiceError_SKIPPED) {
+		t.Errorf("AddMulti with an invalid task returned %v, want the valid task to be skipped", err)
+	}
+	// An existing task: the others are added
+	_, err = taskqueue.AddMulti(c, []*taskqueue.Task{
+		&taskqueue.Task{Name: "a", Path: "/work"},
+		&taskqueue.Task{Name: "d", Path: "/work"},
+	}, "")
+	if me, ok := err.(appengine.MultiError); !ok || me[0] != taskqueue.ErrTaskAlreadyAdded || me[1] != nil {
+		t.Errorf("AddMulti with an existing task returned %v", err)
+	}
+	names := ""
+	for _, task := range c.tq.Tasks("default") {
+		names += task.Name
+	}
+	if names != "abd" {
+		t.Errorf("Queue had tasks %q, want %q", names, "abd")
+	}
+}
+
+func TestTaskQueueOrder(t *testing.T) {
+	c := newContext(t)
+	names := make([]string, 12)
+	for i := range names {
+		task, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/work", nil), "")
+		PanicIfErr(err)
+		names[i] = task.Name
+	}
+	// Tasks with the same ETA are in the order they were added, also when there are more than 9 of them
+	eta := time.Now()
+	for _, task := range c.tq.queues["default"].tasks {
+		task.ETA = eta
+	}
+	for i, task := range c.tq.Tasks("default") {
+		if task.Name != names[i] {
+			t.Errorf("Task %d was %s, want %s", i, task.Name, names[i])
+		}
+	}
+}
+
+func TestTaskQueueQueryTasks(t *testing.T) {
+	c := newContext(t)
+	now := time.Now()
+	for i, name := range []string{"c", "b", "a"} {
+		_, err := taskqueue.Add(c, &taskqueue.Task{Name: name, Path: "/work", ETA: now.Add(time.Duration(i) * time.Second)}, "")
+		PanicIfErr(err)
+	}
+	req := &pb.TaskQueueQueryTasksRequest{QueueName: []byte("default"), MaxRows: proto.Int32(2)}
+	res := &pb.TaskQueueQueryTasksResponse{}
+	PanicIfErr(c.tq.QueryTasks(req, res))
+	if len(res.Task) != 2 || string(res.Task[0].TaskName) != "c" || string(res.Task[1].TaskName) != "b" {
+		t.Errorf("QueryTasks returned %v, want tasks c and b", res.Task)
+	}
+	req.StartEtaUsec = res.Task[1].EtaUsec
+	req.StartTaskName = res.Task[1].TaskName
+	res = &pb.TaskQueueQueryTasksResponse{}
+	PanicIfErr(c.tq.QueryTasks(req, res))
+	if len(res.Task) != 2 || string(res.Task[0].TaskName) != "b" || string(res.Task[1].TaskName) != "a" {
+		t.Errorf("QueryTasks from task b returned %v, want tasks b and a", res.Task)
+	}
+}
+
+func TestTaskQueueTransactionalAdd(t *testing.T) {
+	c := newContext(t)
+	add := func(handle uint64, n int) error {
+		req := &pb.TaskQueueBulkAddRequest{}
+		for i := 0; i < n; i++ {
+			req.AddRequest = append(req.AddRequest, &pb.TaskQueueAddRequest{
+				QueueName:   []byte("default"),
+				Url:         []byte("/work"),
+				EtaUsec:     proto.Int64(usec(time.Now())),
+				Method:      pb.TaskQueueAddRequest_POST.Enum(),
+				Transaction: &dspb.Transaction{Handle: proto.Uint64(handle)},
+			})
+		}
+		res := &pb.TaskQueueBulkAddResponse{}
+		PanicIfErr(c.tq.BulkAdd(req, res))
+		for _, result := range res.Taskresult {
+			if code := result.GetResult(); code != pb.TaskQueueServiceError_OK && code != pb.TaskQueueServiceError_SKIPPED {
+				return apiError(code, "%v", code)
+			}
+		}
+		return nil
+	}
+
+	PanicIfErr(add(1, 3))
+	PanicIfErr(add(2, 1))
+	if n := len(c.tq.Tasks("default")); n != 0 {
+		t.Errorf("Queue had %d tasks before the transactions ended, want 0", n)
+	}
+	if err := add(1, 3); !isCode(err, pb.TaskQueueServiceError_TOO_MANY_TASKS) {
+		t.Errorf("Add of a 6th task in a transaction returned %v, want TOO_MANY_TASKS", err)
+	}
+	c.tq.EndTransaction(1, true)
+	c.tq.EndTransaction(2, false)
+	if n := len(c.tq.Tasks("default")); n != 3 {
+		t.Errorf("Queue had %d tasks after a commit and a rollback, want the 3 committed tasks", n)
+	}
+
+	req := &pb.TaskQueueAddRequest{
+		QueueName:   []byte("default"),
+		TaskName:    []byte("named"),
+		Url:         []byte("/work"),
+		EtaUsec:     proto.Int64(usec(time.Now())),
+		Transaction: &dspb.Transaction{Handle: proto.Uint64(3)},
+	}
+	if err := c.tq.Add(req, &pb.TaskQueueAddResponse{}); !isCode(err, pb.TaskQueueServiceError_INVALID_TASK_NAME) {
+		t.Errorf("Add of a named task in a transaction returned %v, want INVALID_TASK_NAME", err)
+	}
+}
+
+func TestTaskQueueReadsDoNotCreateQueues(t *testing.T) {
+	c := newContext(t)
+	taskqueue.Delete(c, &taskqueue.Task{Name: "a"}, "deleted")
+	PanicIfErr(taskqueue.Purge(c, "purged"))
+	_, err := taskqueue.Lease(c, 1, "leased", 60)
+	PanicIfErr(err)
+	PanicIfErr(c.tq.QueryTasks(&pb.TaskQueueQueryTasksRequest{QueueName: []byte("queried"), MaxRows: proto.Int32(1)}, &pb.TaskQueueQueryTasksResponse{}))
+	if len(c.tq.queues) != 0 {
+		t.Errorf("Task queue had %d queues after reads, want 0", len(c.tq.queues))
+	}
+}
+
+func isCode(err error, code pb.TaskQueueServiceError_ErrorCode) bool {
+	apiErr, ok := err.(*appengine_internal.APIError)
+	return ok && apiErr.Code == int32(code)
+}
+
+type testContext struct {
+	t  *testing.T
+	tq *InMemoryTaskQueue
+}
+
+func newContext(t *testing.T) *testContext {
+	return &testContext{t: t, tq: New()}
+}
+
+func (this *testContext) Debugf(s string, v ...interface{}) {
+	this.t.Logf(s, v...)
+}
+func (this *testContext) Infof(s string, v ...interface{})     { this.Debugf(s, v...) }
+func (this *testContext) Warningf(s string, v ...interface{})  { this.Debugf(s, v...) }
+func (this *testContext) Errorf(s string, v ...interface{})    { this.Debugf(s, v...) }
+func (this *testContext) Criticalf(s string, v ...interface{}) { this.Debugf(s, v...) }
+func (this *testContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if service != "taskqueue" {
+		return fmt.Errorf("Unknown service: %s", service)
+	}
+	return this.tq.Call(method, in, out, opts)
+}
+func (this *testContext) FullyQualifiedAppID() string { return "dev~aeunit" }
+func (this *testContext) Request() interface{}        { panic("Request() is not implemented") }
+
+var _ appengine.Context = &testContext{}
+
+func PanicIfErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
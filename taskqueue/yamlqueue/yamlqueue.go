@@ -0,0 +1,37 @@
+package yamlqueue
+
+import (
+	"fmt"
+	"github.com/siniec/aeunit/taskqueue"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Read reads a queue configuration in the format of queue.yaml
+func Read(r io.Reader) (*taskqueue.QueueConfig, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	config := &taskqueue.QueueConfig{}
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("aeunit taskqueue: could not read queue configuration: %v", err)
+	}
+	return config, nil
+}
+
+// LoadFile configures the queues of the task queue with a queue.yaml file, see InMemoryTaskQueue.Configure
+func LoadFile(tq *taskqueue.InMemoryTaskQueue, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	config, err := Read(file)
+	if err != nil {
+		return err
+	}
+	return tq.Configure(config)
+}
@@ -0,0 +1,88 @@
+package yamlqueue
+
+import (
+	"github.com/siniec/aeunit/taskqueue"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testQueueYAML = `
+queue:
+- name: slow
+  rate: 1/s
+  bucket_size: 2
+- name: retried
+  rate: 100/s
+  retry_parameters:
+    task_retry_limit: 2
+    min_backoff_seconds: 1
+    max_backoff_seconds: 3
+- name: aged
+  rate: 100/s
+  retry_parameters:
+    task_retry_limit: 1
+    task_age_limit: 10m
+    min_backoff_seconds: 10
+- name: paused
+  rate: 0/s
+- name: work
+  mode: pull
+`
+
+func intPtr(i int) *int           { return &i }
+func floatPtr(f float64) *float64 { return &f }
+
+func TestRead(t *testing.T) {
+	config, err := Read(strings.NewReader(testQueueYAML))
+	if err != nil {
+		t.Errorf("Read returned error: %v", err)
+		t.FailNow()
+	}
+	want := &taskqueue.QueueConfig{Queues: []taskqueue.QueueDef{
+		{Name: "slow", Rate: "1/s", BucketSize: 2},
+		{Name: "retried", Rate: "100/s", RetryParameters: &taskqueue.RetryParameters{
+			TaskRetryLimit: intPtr(2), MinBackoffSeconds: floatPtr(1), MaxBackoffSeconds: floatPtr(3)}},
+		{Name: "aged", Rate: "100/s", RetryParameters: &taskqueue.RetryParameters{
+			TaskRetryLimit: intPtr(1), TaskAgeLimit: "10m", MinBackoffSeconds: floatPtr(10)}},
+		{Name: "paused", Rate: "0/s"},
+		{Name: "work", Mode: "pull"},
+	}}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Read returned %+v, want %+v", config, want)
+	}
+
+	if _, err = Read(strings.NewReader("queue: [")); err == nil {
+		t.Errorf("Read of invalid YAML did not return an error")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yamlqueue")
+	PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.yaml")
+	PanicIfErr(ioutil.WriteFile(path, []byte(testQueueYAML), 0644))
+
+	tq := taskqueue.New()
+	if err = LoadFile(tq, path); err != nil {
+		t.Errorf("LoadFile returned error: %v", err)
+	}
+
+	PanicIfErr(ioutil.WriteFile(path, []byte("queue:\n- name: invalid name!\n"), 0644))
+	if err = LoadFile(tq, path); err == nil {
+		t.Errorf("LoadFile of invalid queue did not return an error")
+	}
+	if err = LoadFile(tq, filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("LoadFile of missing file did not return an error")
+	}
+}
+
+func PanicIfErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,250 @@
+package urlfetch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+)
+
+// Cassette is an http.RoundTripper that replays the responses recorded in a file, and records the responses of
+// the requests that were not recorded yet. Set it as the transport of the urlfetch service with SetTransport:
+// the first run of a test records its fetches, and later runs replay them without reaching the network.
+//
+// Requests are matched to recordings by method, URL and body. A request that matches several recordings gets
+// their responses in the order they were recorded. After that, it is recorded again, or in strict mode, gets the
+// last response again. In strict mode, requests that match no recording fail, instead of being sent with the
+// transport.
+//
+// The file is a JSON array of interactions. Bodies that are not valid UTF-8 are encoded in base64. The values of
+// request headers that hold credentials, like Authorization and Cookie, are recorded as REDACTED, so that
+// cassettes can be committed; SetRedactedHeaders adds other headers, like the ones of API keys.
+type Cassette struct {
+	path         string
+	transport    http.RoundTripper
+	strict       bool
+	redacted     map[string]bool // canonical names of the request headers whose values are not recorded
+	interactions []*Interaction
+	played       map[*Interaction]bool
+	changed      bool // whether interactions were recorded since the file was loaded
+}
+
+// Interaction is a request and its response recorded in a Cassette
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"` // base64, or empty for text
+}
+
+type RecordedResponse struct {
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"` // base64, or empty for text
+}
+
+// redactedValue replaces the values of redacted request headers in recordings
+const redactedValue = "REDACTED"
+
+// defaultRedactedHeaders are the request headers that are always redacted
+var defaultRedactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// NewCassette returns a Cassette that replays the interactions recorded in the file at path, if it exists, and
+// records the other requests by sending them with the transport. Recorded interactions are saved to the file
+// when the cassette is closed, which the urlfetch service does when it is closed.
+func NewCassette(path string, transport http.RoundTripper) (*Cassette, error) {
+	if transport == nil {
+		transport = failingTransport{}
+	}
+	cassette := &Cassette{path: path, transport: transport, played: make(map[*Interaction]bool)}
+	cassette.SetRedactedHeaders()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cassette, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &cassette.interactions); err != nil {
+		return nil, fmt.Errorf("aeunit urlfetch: could not load cassette %s: %v", path, err)
+	}
+	return cassette, nil
+}
+
+// SetStrict sets whether requests that match no recorded interaction fail, instead of being recorded
+func (this *Cassette) SetStrict(strict bool) {
+	this.strict = strict
+}
+
+// SetRedactedHeaders sets the request headers, in addition to Authorization, Cookie and Proxy-Authorization, whose
+// values are replaced in the recordings. Requests are matched without their headers, so redacted recordings are
+// still replayed.
+func (this *Cassette) SetRedactedHeaders(names ...string) {
+	this.redacted = make(map[string]bool)
+	for _, name := range append(append([]string{}, defaultRedactedHeaders...), names...) {
+		this.redacted[http.CanonicalHeaderKey(name)] = true
+	}
+}
+
+// Interactions returns the recorded interactions, in the order they were recorded
+func (this *Cassette) Interactions() []*Interaction {
+	return append([]*Interaction{}, this.interactions...)
+}
+
+func (this *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	if interaction := this.match(req, body); interaction != nil {
+		this.played[interaction] = true
+		return interaction.Response.response(req)
+	}
+	if this.strict {
+		return nil, fmt.Errorf("aeunit urlfetch: cassette %s has no recording of %s %s", this.path, req.Method, req.URL)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res, err := this.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	interaction := &Interaction{
+		Request:  RecordedRequest{Method: req.Method, URL: req.URL.String(), Header: this.redact(req.Header)},
+		Response: RecordedResponse{StatusCode: res.StatusCode, Header: res.Header},
+	}
+	interaction.Request.Body, interaction.Request.BodyEncoding = encodeBody(body)
+	interaction.Response.Body, interaction.Response.BodyEncoding = encodeBody(resBody)
+	this.interactions = append(this.interactions, interaction)
+	this.played[interaction] = true
+	this.changed = true
+	return interaction.Response.response(req)
+}
+
+// redact returns a copy of the request header, with the values of the redacted headers replaced
+func (this *Cassette) redact(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	c := make(http.Header, len(h))
+	for k, vs := range h {
+		c[k] = append([]string{}, vs...)
+		if this.redacted[http.CanonicalHeaderKey(k)] {
+			for i := range c[k] {
+				c[k][i] = redactedValue
+			}
+		}
+	}
+	return c
+}
+
+// match returns the first interaction with the method, URL and body of the request that was not played yet, or
+// in strict mode the last one if all were played, or nil
+func (this *Cassette) match(req *http.Request, body []byte) *Interaction {
+	var last *Interaction
+	for _, interaction := range this.interactions {
+		recorded := interaction.Request
+		if recorded.Method != req.Method || recorded.URL != req.URL.String() {
+			continue
+		}
+		if recordedBody, err := decodeBody(recorded.Body, recorded.BodyEncoding); err != nil || !bytes.Equal(recordedBody, body) {
+			continue
+		}
+		if !this.played[interaction] {
+			return interaction
+		}
+		last = interaction
+	}
+	if this.strict {
+		return last
+	}
+	return nil
+}
+
+func (this *RecordedResponse) response(req *http.Request) (*http.Response, error) {
+	body, err := decodeBody(this.Body, this.BodyEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("aeunit urlfetch: recorded response of %s %s has an invalid body: %v", req.Method, req.URL, err)
+	}
+	header := make(http.Header, len(this.Header))
+	for k, vs := range this.Header {
+		header[k] = append([]string{}, vs...)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", this.StatusCode, http.StatusText(this.StatusCode)),
+		StatusCode:    this.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(body), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return nil, fmt.Errorf("unknown body encoding %q", encoding)
+}
+
+// Close saves the interactions to the file, if any were recorded. The file is replaced atomically, so a failed
+// save does not corrupt an existing file.
+func (this *Cassette) Close() error {
+	if !this.changed {
+		return nil
+	}
+	b, err := json.MarshalIndent(this.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(this.path), filepath.Base(this.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("aeunit urlfetch: could not save cassette %s: %v", this.path, err)
+	}
+	this.changed = false
+	return nil
+}
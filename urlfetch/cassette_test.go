@@ -0,0 +1,160 @@
+package urlfetch
+
+import (
+	"appengine/urlfetch"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestURLFetchCassette(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aeunit")
+	PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassette.json")
+
+	sent := 0
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent++
+		body, _ := ioutil.ReadAll(r.Body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader(r.Method + " " + string(body) + " " + string(rune('0'+sent)))),
+			Request:    r,
+		}, nil
+	})
+	fetch := func(c *testContext, method, body string) (string, error) {
+		req, _ := http.NewRequest(method, "http://example.com/api", strings.NewReader(body))
+		res, err := urlfetch.Client(c).Do(req)
+		if err != nil {
+			return "", err
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		return string(b), nil
+	}
+
+	// Record
+	c := newContext(t)
+	cassette, err := NewCassette(path, transport)
+	PanicIfErr(err)
+	c.uf.SetTransport(cassette)
+	for _, want := range []string{"GET  1", "POST a 2", "POST a 3"} {
+		fields := strings.SplitN(want, " ", 3)
+		if got, err := fetch(c, fields[0], fields[1]); got != want || err != nil {
+			t.Errorf("Recorded fetch returned %q, %v, want %q", got, err, want)
+		}
+	}
+	PanicIfErr(c.uf.Close())
+
+	// Replay, in strict mode
+	c = newContext(t)
+	cassette, err = NewCassette(path, transport)
+	PanicIfErr(err)
+	cassette.SetStrict(true)
+	c.uf.SetTransport(cassette)
+	for _, want := range []string{"POST a 2", "GET  1", "POST a 3", "POST a 3"} {
+		fields := strings.SplitN(want, " ", 3)
+		if got, err := fetch(c, fields[0], fields[1]); got != want || err != nil {
+			t.Errorf("Replayed fetch returned %q, %v, want %q", got, err, want)
+		}
+	}
+	if sent != 3 {
+		t.Errorf("Transport sent %d requests, want only the 3 recorded ones", sent)
+	}
+	if _, err := fetch(c, "POST", "b"); err == nil {
+		t.Errorf("Fetch of unrecorded request in strict mode did not return an error")
+	}
+
+	// Unrecorded requests are recorded when not strict
+	cassette.SetStrict(false)
+	if got, err := fetch(c, "POST", "b"); got != "POST b 4" || err != nil {
+		t.Errorf("Fetch of unrecorded request returned %q, %v, want %q", got, err, "POST b 4")
+	}
+	if n := len(cassette.Interactions()); n != 4 {
+		t.Errorf("Cassette had %d interactions, want 4", n)
+	}
+}
+
+func TestURLFetchCassetteBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aeunit")
+	PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassette.json")
+	binary := "\xff\x00\xfe"
+
+	cassette, err := NewCassette(path, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(binary)), Request: r}, nil
+	}))
+	PanicIfErr(err)
+	req, _ := http.NewRequest("GET", "http://example.com/binary", nil)
+	_, err = cassette.RoundTrip(req)
+	PanicIfErr(err)
+	PanicIfErr(cassette.Close())
+
+	cassette, err = NewCassette(path, nil)
+	PanicIfErr(err)
+	cassette.SetStrict(true)
+	res, err := cassette.RoundTrip(req)
+	PanicIfErr(err)
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != binary {
+		t.Errorf("Replayed binary body was %q, want %q", body, binary)
+	}
+}
+
+func TestURLFetchCassetteRedactedHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aeunit")
+	PanicIfErr(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassette.json")
+
+	var sent http.Header
+	cassette, err := NewCassette(path, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		sent = r.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Request: r}, nil
+	}))
+	PanicIfErr(err)
+	cassette.SetRedactedHeaders("x-api-key")
+	req, _ := http.NewRequest("GET", "http://example.com/private", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("Cookie", "session=secret-session")
+	req.Header.Set("X-Api-Key", "secret-key")
+	req.Header.Set("Accept", "text/plain")
+	_, err = cassette.RoundTrip(req)
+	PanicIfErr(err)
+	PanicIfErr(cassette.Close())
+
+	if sent.Get("Authorization") != "Bearer secret-token" {
+		t.Errorf("Transport was sent Authorization %q, want the real value", sent.Get("Authorization"))
+	}
+	if req.Header.Get("Authorization") != "Bearer secret-token" {
+		t.Errorf("Recording changed the Authorization of the request to %q", req.Header.Get("Authorization"))
+	}
+	b, err := ioutil.ReadFile(path)
+	PanicIfErr(err)
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("Cassette file has the values of redacted headers:\n%s", b)
+	}
+	h := cassette.Interactions()[0].Request.Header
+	for _, name := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+		if v := h.Get(name); v != redactedValue {
+			t.Errorf("Recorded %s was %q, want %q", name, v, redactedValue)
+		}
+	}
+	if v := h.Get("Accept"); v != "text/plain" {
+		t.Errorf("Recorded Accept was %q, want text/plain", v)
+	}
+
+	// Redacted recordings are still replayed
+	cassette, err = NewCassette(path, nil)
+	PanicIfErr(err)
+	cassette.SetStrict(true)
+	res, err := cassette.RoundTrip(req)
+	PanicIfErr(err)
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "ok" {
+		t.Errorf("Replayed body was %q, want %q", body, "ok")
+	}
+}
@@ -0,0 +1,163 @@
+package urlfetch
+
+import (
+	"appengine_internal"
+	pb "appengine_internal/urlfetch"
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Limits of the production urlfetch service
+const (
+	defaultDeadline        = 5 * time.Second
+	maxRedirects           = 5
+	defaultMaxResponseSize = 32 << 20 // bytes, after which responses are truncated
+)
+
+var errTooManyRedirects = errors.New("too many redirects")
+
+// Service is a urlfetch service that translates fetches into net/http requests, which it sends with an
+// http.RoundTripper. The default RoundTripper fails every request, so tests don't reach the network by accident:
+// set one with SetTransport, like http.DefaultTransport, or one that serves the requests in the test.
+type Service struct {
+	transport       http.RoundTripper
+	maxResponseSize int
+}
+
+func New() *Service {
+	return &Service{
+		transport:       failingTransport{},
+		maxResponseSize: defaultMaxResponseSize,
+	}
+}
+
+func (this *Service) Call(method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	switch method {
+	case "Fetch":
+		return this.Fetch(in.(*pb.URLFetchRequest), out.(*pb.URLFetchResponse), opts)
+	default:
+		return fmt.Errorf("aeunit urlfetch: Unknown method %s", method)
+	}
+}
+
+// Close closes the transport if it can be closed, which saves a Cassette
+func (this *Service) Close() error {
+	if closer, ok := this.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SetTransport sets the RoundTripper that sends the requests of fetches
+func (this *Service) SetTransport(transport http.RoundTripper) {
+	this.transport = transport
+}
+
+// SetMaxResponseSize sets the size in bytes after which response bodies are truncated. The default is 32 MB, like
+// in production.
+func (this *Service) SetMaxResponseSize(n int) {
+	this.maxResponseSize = n
+}
+
+// failingTransport is the default RoundTripper, which fails every request
+type failingTransport struct{}
+
+func (this failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("aeunit urlfetch: no transport is set to fetch %s, see SetTransport", req.URL)
+}
+
+// apiError returns an application error of the urlfetch service, like the ones returned by production
+func apiError(code pb.URLFetchServiceError_ErrorCode, format string, v ...interface{}) error {
+	return &appengine_internal.APIError{
+		Service: "urlfetch",
+		Detail:  fmt.Sprintf(format, v...),
+		Code:    int32(code),
+	}
+}
+
+// Fetch sends the request with the transport. Like in production, redirects are followed if the request asks
+// for it, up to 5 times, the request fails if it takes longer than its deadline, 5 seconds by default, and
+// response bodies that are too large are truncated. Deadlines are measured in real time, and rely on the
+// transport to cancel requests.
+func (this *Service) Fetch(req *pb.URLFetchRequest, res *pb.URLFetchResponse, opts *appengine_internal.CallOptions) error {
+	u, err := url.Parse(req.GetUrl())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return apiError(pb.URLFetchServiceError_INVALID_URL, "invalid URL %q", req.GetUrl())
+	}
+	httpReq, err := http.NewRequest(req.GetMethod().String(), u.String(), bytes.NewReader(req.Payload))
+	if err != nil {
+		return apiError(pb.URLFetchServiceError_INVALID_URL, "invalid request: %v", err)
+	}
+	for _, h := range req.Header {
+		httpReq.Header.Add(h.GetKey(), h.GetValue())
+	}
+
+	client := &http.Client{
+		Transport: this.transport,
+		Timeout:   deadline(req, opts),
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if !req.GetFollowRedirects() {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > maxRedirects {
+				return errTooManyRedirects
+			}
+			return nil
+		},
+	}
+	httpRes, err := client.Do(httpReq)
+	if err != nil {
+		return fetchError(err)
+	}
+	defer httpRes.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(httpRes.Body, int64(this.maxResponseSize)+1))
+	if err != nil {
+		return fetchError(err)
+	}
+
+	if len(content) > this.maxResponseSize {
+		content = content[:this.maxResponseSize]
+		res.ContentWasTruncated = proto.Bool(true)
+	}
+	res.Content = content
+	res.StatusCode = proto.Int32(int32(httpRes.StatusCode))
+	for k, vs := range httpRes.Header {
+		for _, v := range vs {
+			res.Header = append(res.Header, &pb.URLFetchResponse_Header{Key: proto.String(k), Value: proto.String(v)})
+		}
+	}
+	if final := httpRes.Request.URL.String(); final != u.String() {
+		res.FinalUrl = proto.String(final)
+	}
+	return nil
+}
+
+// deadline returns the deadline of a fetch: the one of the request, or the timeout of the call
+func deadline(req *pb.URLFetchRequest, opts *appengine_internal.CallOptions) time.Duration {
+	switch {
+	case req.Deadline != nil:
+		return time.Duration(req.GetDeadline() * float64(time.Second))
+	case opts != nil && opts.Timeout > 0:
+		return opts.Timeout
+	}
+	return defaultDeadline
+}
+
+// fetchError returns the application error of a request that failed
+func fetchError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok && urlErr.Err == errTooManyRedirects {
+		return apiError(pb.URLFetchServiceError_TOO_MANY_REDIRECTS, "%v", err)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return apiError(pb.URLFetchServiceError_DEADLINE_EXCEEDED, "%v", err)
+	}
+	return apiError(pb.URLFetchServiceError_FETCH_ERROR, "%v", err)
+}
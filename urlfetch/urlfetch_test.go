@@ -0,0 +1,170 @@
+package urlfetch
+
+import (
+	"appengine"
+	"appengine/urlfetch"
+	"appengine_internal"
+	pb "appengine_internal/urlfetch"
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLFetch(t *testing.T) {
+	c := newContext(t)
+	client := urlfetch.Client(c)
+	if _, err := client.Get("http://example.com/"); err == nil {
+		t.Errorf("Get with the default transport did not return an error")
+	}
+
+	var got *http.Request
+	var gotBody string
+	c.uf.SetTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		got = r
+		b, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(b)
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Header:     http.Header{"X-Answer": {"42"}},
+			Body:       ioutil.NopCloser(strings.NewReader("created")),
+			Request:    r,
+		}, nil
+	}))
+	req, _ := http.NewRequest("POST", "http://example.com/things?a=1", strings.NewReader("payload"))
+	req.Header.Set("X-Question", "?")
+	res, err := client.Do(req)
+	PanicIfErr(err)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusCreated || res.Header.Get("X-Answer") != "42" || string(body) != "created" {
+		t.Errorf("Response was %d with headers %v and body %q", res.StatusCode, res.Header, body)
+	}
+	if got.Method != "POST" || got.URL.String() != "http://example.com/things?a=1" || got.Header.Get("X-Question") != "?" || gotBody != "payload" {
+		t.Errorf("Request was %s %s with headers %v and body %q", got.Method, got.URL, got.Header, gotBody)
+	}
+
+	if _, err = client.Get("ftp://example.com/"); !isCode(err, pb.URLFetchServiceError_INVALID_URL) {
+		t.Errorf("Get of ftp URL returned %v, want INVALID_URL", err)
+	}
+}
+
+func TestURLFetchRedirects(t *testing.T) {
+	c := newContext(t)
+	c.uf.SetTransport(http.DefaultTransport)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(r.URL.Path, "/%d", &n)
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/%d", n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "done")
+	}))
+	defer server.Close()
+
+	// The client follows redirects itself
+	res, err := urlfetch.Client(c).Get(server.URL + "/2")
+	PanicIfErr(err)
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "done" {
+		t.Errorf("Get with redirects returned body %q, want %q", body, "done")
+	}
+
+	fetch := func(path string) (*pb.URLFetchResponse, error) {
+		req := &pb.URLFetchRequest{Method: pb.URLFetchRequest_GET.Enum(), Url: proto.String(server.URL + path)}
+		res := &pb.URLFetchResponse{}
+		return res, c.uf.Fetch(req, res, nil)
+	}
+	fres, err := fetch("/3")
+	PanicIfErr(err)
+	if string(fres.Content) != "done" || fres.GetFinalUrl() != server.URL+"/0" {
+		t.Errorf("Fetch with redirects returned %q from %s", fres.Content, fres.GetFinalUrl())
+	}
+	if _, err = fetch("/6"); !isCode(err, pb.URLFetchServiceError_TOO_MANY_REDIRECTS) {
+		t.Errorf("Fetch with 6 redirects returned %v, want TOO_MANY_REDIRECTS", err)
+	}
+}
+
+func TestURLFetchDeadline(t *testing.T) {
+	c := newContext(t)
+	c.uf.SetTransport(http.DefaultTransport)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &urlfetch.Transport{Context: c, Deadline: 10 * time.Millisecond}}
+	if _, err := client.Get(server.URL); !isCode(err, pb.URLFetchServiceError_DEADLINE_EXCEEDED) {
+		t.Errorf("Get that took longer than its deadline returned %v, want DEADLINE_EXCEEDED", err)
+	}
+	client.Transport = &urlfetch.Transport{Context: c, Deadline: time.Second}
+	if _, err := client.Get(server.URL); err != nil {
+		t.Errorf("Get within its deadline returned error %v", err)
+	}
+}
+
+func TestURLFetchTruncation(t *testing.T) {
+	c := newContext(t)
+	c.uf.SetMaxResponseSize(4)
+	c.uf.SetTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("too large")), Request: r}, nil
+	}))
+	res, err := urlfetch.Client(c).Get("http://example.com/")
+	PanicIfErr(err)
+	body, err := ioutil.ReadAll(res.Body)
+	if string(body) != "too " || err != urlfetch.ErrTruncatedBody {
+		t.Errorf("Body of too large response was %q, %v, want %q, %v", body, err, "too ", urlfetch.ErrTruncatedBody)
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (this roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return this(r)
+}
+
+func isCode(err error, code pb.URLFetchServiceError_ErrorCode) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		// Errors of the transport are wrapped by the client
+		err = urlErr.Err
+	}
+	apiErr, ok := err.(*appengine_internal.APIError)
+	return ok && apiErr.Code == int32(code)
+}
+
+type testContext struct {
+	t  *testing.T
+	uf *Service
+}
+
+func newContext(t *testing.T) *testContext {
+	return &testContext{t: t, uf: New()}
+}
+
+func (this *testContext) Debugf(s string, v ...interface{}) {
+	this.t.Logf(s, v...)
+}
+func (this *testContext) Infof(s string, v ...interface{})     { this.Debugf(s, v...) }
+func (this *testContext) Warningf(s string, v ...interface{})  { this.Debugf(s, v...) }
+func (this *testContext) Errorf(s string, v ...interface{})    { this.Debugf(s, v...) }
+func (this *testContext) Criticalf(s string, v ...interface{}) { this.Debugf(s, v...) }
+func (this *testContext) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	if service != "urlfetch" {
+		return fmt.Errorf("Unknown service: %s", service)
+	}
+	return this.uf.Call(method, in, out, opts)
+}
+func (this *testContext) FullyQualifiedAppID() string { return "dev~aeunit" }
+func (this *testContext) Request() interface{}        { panic("Request() is not implemented") }
+
+var _ appengine.Context = &testContext{}
+
+func PanicIfErr(err error) {
+	if err != nil {
+		panic(err)
+	}
+}